@@ -13,6 +13,8 @@ import (
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"text/template"
@@ -21,6 +23,7 @@ import (
 	"github.com/ltkh/netmap/internal/cache"
 	"github.com/ltkh/netmap/internal/client"
 	"github.com/ltkh/netmap/internal/config"
+	"github.com/ltkh/netmap/internal/maintenance"
 	"github.com/ltkh/netmap/internal/netstat"
 	"github.com/naoina/toml"
 	"github.com/pkg/errors"
@@ -46,12 +49,16 @@ type Config struct {
 }
 
 type Global struct {
-	URLs            []string `toml:"urls"`
-	ContentEncoding string   `toml:"content_encoding"`
-	Interval        string   `toml:"interval"`
-	Timeout         string   `toml:"timeout"`
-	MaxRespTime     string   `toml:"max_resp_time"`
-	AccountID       uint32   `toml:"account_id"`
+	URLs            []string          `toml:"urls"`
+	ContentEncoding string            `toml:"content_encoding"`
+	Interval        string            `toml:"interval"`
+	Timeout         string            `toml:"timeout"`
+	MaxRespTime     string            `toml:"max_resp_time"`
+	AccountID       uint32            `toml:"account_id"`
+	Username        string            `toml:"username"`
+	Password        string            `toml:"password"`
+	Token           string            `toml:"token"`
+	Labels          map[string]string `toml:"labels"`
 }
 
 type Netstat struct {
@@ -94,6 +101,68 @@ type ExceptionData struct {
 	Data []config.Exception `json:"data"`
 }
 
+var (
+	// Tags every line protocol record has, labels with these names are left out
+	lineFixedTags = map[string]bool{
+		"src_name": true,
+		"src_ip":   true,
+		"dst_name": true,
+		"dst_ip":   true,
+		"service":  true,
+		"port":     true,
+		"mode":     true,
+	}
+
+	lineEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+)
+
+// mergeLabels returns the default labels overridden by the labels of a record
+func mergeLabels(defaults, labels map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return labels
+	}
+	merged := make(map[string]string, len(defaults)+len(labels))
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+	return merged
+}
+
+// lineTags formats the labels of a record as line protocol tags sorted by name
+func lineTags(labels map[string]string) string {
+	var names []string
+	for name, value := range labels {
+		if lineFixedTags[name] || value == "" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, ",%s=%s", lineEscaper.Replace(name), lineEscaper.Replace(labels[name]))
+	}
+	return b.String()
+}
+
+// httpConfig returns the client settings with the server credentials
+func httpConfig(global *Global, urls []string, encoding string) client.HttpConfig {
+	cfg := client.HttpConfig{
+		URLs:            urls,
+		ContentEncoding: encoding,
+		Username:        global.Username,
+		Password:        global.Password,
+	}
+	if global.Token != "" {
+		cfg.Headers = map[string]string{"Authorization": "Bearer " + global.Token}
+	}
+	return cfg
+}
+
 func randURLs(urls []string) []string {
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
@@ -256,26 +325,23 @@ func getConnections(cfg Config, hname string, debug bool) {
 	}
 
 	// Get connections
-	clnt := client.HttpConfig{
-		URLs:            randURLs(cfg.Connections.URLs),
-		ContentEncoding: cfg.Global.ContentEncoding,
-	}
+	clnt := httpConfig(cfg.Global, randURLs(cfg.Connections.URLs), cfg.Global.ContentEncoding)
 
-	body, err := httpClient.ReadRecords(clnt, fmt.Sprintf("/api/v1/netmap/records?src_name=%s", hname))
+	body, err := httpClient.ReadRecords(clnt, fmt.Sprintf("/api/v1/netmap/records?src_name=%s&account_id=%d", hname, cfg.Global.AccountID))
 	if err != nil {
-		log.Printf("[error] %v - /api/v1/netmap/records?src_name=%s", err, hname)
+		log.Printf("[error] %v - /api/v1/netmap/records?src_name=%s&account_id=%d", err, hname, cfg.Global.AccountID)
 		return
 	}
 
 	var nrs netstat.NetstatData
 	err = json.Unmarshal(body, &nrs)
 	if err != nil {
-		log.Printf("[error] %v - /api/v1/netmap/records?src_name=%s", err, hname)
+		log.Printf("[error] %v - /api/v1/netmap/records?src_name=%s&account_id=%d", err, hname, cfg.Global.AccountID)
 		return
 	}
 
 	if debug {
-		log.Printf("[debug] GET - /api/v1/netmap/records?src_name=%s (%v)", hname, len(nrs.Data))
+		log.Printf("[debug] GET - /api/v1/netmap/records?src_name=%s&account_id=%d (%v)", hname, cfg.Global.AccountID, len(nrs.Data))
 		for _, nr := range nrs.Data {
 			log.Printf(
 				"[debug] record name=%s,ip=%s,port=%d,mode=%s,result=%d,response=%f,status=%s",
@@ -299,6 +365,8 @@ func getConnections(cfg Config, hname string, debug bool) {
 			nr.Options.MaxRespTime = float64(cnMaxRespTime / time.Second)
 		}
 
+		nr.Labels = mergeLabels(cfg.Global.Labels, nr.Labels)
+
 		err := cacheRecords.Set(config.GetIdRec(&nr), nr, timestamp)
 		if err != nil {
 			log.Printf("[error] %v", err)
@@ -357,6 +425,10 @@ func main() {
 	}
 	f.Close()
 
+	if err := config.CheckLabels(cfg.Global.Labels); err != nil {
+		log.Fatalf("[error] setting global labels: %v", err)
+	}
+
 	// Set default Timeout
 	if cfg.Global.Timeout == "" {
 		cfg.Global.Timeout = "5s"
@@ -418,10 +490,7 @@ func main() {
 
 	// Сheck connections
 	go func() {
-		clnt := client.HttpConfig{
-			URLs:            randURLs(cfg.Global.URLs),
-			ContentEncoding: cfg.Global.ContentEncoding,
-		}
+		clnt := httpConfig(cfg.Global, randURLs(cfg.Global.URLs), cfg.Global.ContentEncoding)
 
 		for {
 			getConnections(cfg, hname, *debug)
@@ -448,6 +517,11 @@ func main() {
 					continue
 				}
 
+				// Relations in a maintenance window are not checked
+				if maintenance.Suppressed(nr.Maintenance, maintenance.SuppressChecks) {
+					continue
+				}
+
 				wg.Add(1)
 
 				go func(nr config.SockTable) {
@@ -468,8 +542,17 @@ func main() {
 						"status":     nr.Options.Status,
 						"account_id": fmt.Sprintf("%v", nr.Options.AccountID),
 					}
+					// Labels are available to templates unless they are named like a tag
+					for name, value := range nr.Labels {
+						if _, ok := tags[name]; !ok {
+							tags[name] = value
+						}
+					}
 					timeout := time.Duration(nr.Options.Timeout) * time.Second
 
+					// Traces of relations in a maintenance window are not run
+					notify := !maintenance.Suppressed(nr.Maintenance, maintenance.SuppressNotifications)
+
 					switch nr.Relation.Mode {
 
 					case "tcp", "udp":
@@ -479,11 +562,15 @@ func main() {
 						if result == 1 || response >= nr.Options.MaxRespTime || nr.Relation.Trace == 2 {
 							if nr.Relation.Trace == 0 && nr.Options.Command != "" {
 								trace = 1
-								go runTrace(nr.Options.Command, tags, clnt, "netmapTraceroute")
+								if notify {
+									go runTrace(nr.Options.Command, tags, clnt, "netmapTraceroute")
+								}
 							}
 							if nr.Relation.Trace == 2 && nr.Options.Command != "" {
 								trace = 1
-								go runTrace(nr.Options.Command, tags, clnt, "netmapCustomCommand")
+								if notify {
+									go runTrace(nr.Options.Command, tags, clnt, "netmapCustomCommand")
+								}
 							}
 						}
 
@@ -496,7 +583,9 @@ func main() {
 								result = 1
 								if nr.Relation.Trace == 0 && nr.Options.Command != "" {
 									trace = 1
-									go runTrace(nr.Options.Command, tags, clnt, "netmapTraceroute")
+									if notify {
+										go runTrace(nr.Options.Command, tags, clnt, "netmapTraceroute")
+									}
 								}
 							}
 
@@ -527,7 +616,7 @@ func main() {
 
 					if *plugin == "telegraf" || *plugin == "windows" {
 						fmt.Printf(
-							"netmap,src_name=%s,src_ip=%s,dst_name=%s,dst_ip=%s,service=%s,port=%d,mode=%s result_code=%d,response_time=%f\n",
+							"netmap,src_name=%s,src_ip=%s,dst_name=%s,dst_ip=%s,service=%s,port=%d,mode=%s%s result_code=%d,response_time=%f\n",
 							nr.LocalAddr.Name,
 							nr.LocalAddr.IP,
 							nr.RemoteAddr.Name,
@@ -535,6 +624,7 @@ func main() {
 							nr.Options.Service,
 							nr.Relation.Port,
 							nr.Relation.Mode,
+							lineTags(nr.Labels),
 							nr.Relation.Result,
 							nr.Relation.Response,
 						)
@@ -596,10 +686,7 @@ func main() {
 			cfg.Netstat.ContentEncoding = cfg.Global.ContentEncoding
 		}
 
-		clnt := client.HttpConfig{
-			URLs:            randURLs(cfg.Netstat.URLs),
-			ContentEncoding: cfg.Netstat.ContentEncoding,
-		}
+		clnt := httpConfig(cfg.Global, randURLs(cfg.Netstat.URLs), cfg.Netstat.ContentEncoding)
 
 		// Set Interval
 		if cfg.Netstat.Interval == "" {
@@ -677,6 +764,9 @@ func main() {
 					if err != nil {
 						log.Printf("[error] %v", err)
 					} else {
+						for i := range nrs.Data {
+							nrs.Data[i].Labels = mergeLabels(cfg.Global.Labels, nil)
+						}
 						if len(nrs.Data) > 0 {
 							jsn, err := json.Marshal(nrs)
 							if err != nil {
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ltkh/netmap/internal/client"
+	"github.com/ltkh/netmap/internal/graph"
+)
+
+var (
+	Version = "unknown"
+)
+
+// Global holds the server settings shared by all commands
+type Global struct {
+	URL     string
+	Token   string
+	Account string
+}
+
+type command struct {
+	help string
+	run  func(global *Global, args []string) error
+}
+
+var commands = map[string]command{
+	"graph":   {"render the map around a host or account", runGraph},
+	"deps":    {"list upstream or downstream dependencies of a host", runDeps},
+	"path":    {"show how one host reaches another", runPath},
+	"impact":  {"list failing relations and the hosts depending on them", runImpact},
+	"analyze": {"report single points of failure, cycles and fan-in/fan-out", runAnalyze},
+}
+
+type graphResp struct {
+	Status string        `json:"status"`
+	Error  string        `json:"error"`
+	Data   []graph.Graph `json:"data"`
+}
+
+type depsResp struct {
+	Data []graph.Dependency `json:"data"`
+}
+
+type pathResp struct {
+	Data []graph.Path `json:"data"`
+}
+
+type impactResp struct {
+	Data []graph.Impact `json:"data"`
+}
+
+type analysisResp struct {
+	Data []graph.Analysis `json:"data"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: netctl [flags] <command> [command flags]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var global Global
+	var version bool
+
+	flag.StringVar(&global.URL, "url", getEnv("NETCTL_URL", "http://127.0.0.1:8084"), "netserver URL")
+	flag.StringVar(&global.Token, "token", getEnv("NETCTL_TOKEN", ""), "API token")
+	flag.StringVar(&global.Account, "account", getEnv("NETCTL_ACCOUNT", ""), "account id")
+	flag.BoolVar(&version, "version", false, "show netctl version")
+	flag.Usage = usage
+
+	flag.Parse()
+
+	if version {
+		fmt.Printf("%v\n", Version)
+		return
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %v\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(&global, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// get requests a netserver path and returns the body of a successful response
+func get(global *Global, path string, params url.Values) ([]byte, error) {
+	if global.Account != "" {
+		params.Set("account_id", global.Account)
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	clnt := client.NewHttpClient(&client.HttpConfig{
+		URL:      global.URL,
+		Password: global.Token,
+	})
+
+	resp, err := clnt.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		var data graphResp
+		if err := json.Unmarshal(resp.Body, &data); err == nil && data.Error != "" {
+			return nil, fmt.Errorf("%v: %v", resp.StatusCode, data.Error)
+		}
+		return nil, fmt.Errorf("received status code: %d", resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// loadGraph reads the graph selected by the filter from netserver
+func loadGraph(global *Global, filter graph.Filter, status string) (*graph.Graph, error) {
+	params := url.Values{}
+	if filter.Host != "" {
+		params.Set("host", filter.Host)
+		params.Set("depth", strconv.Itoa(filter.Depth))
+	}
+	if status != "" {
+		params.Set("status", status)
+	}
+
+	body, err := get(global, "/api/v1/netmap/graph", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var data graphResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Data) == 0 {
+		return &graph.Graph{}, nil
+	}
+
+	return &data.Data[0], nil
+}
+
+// output writes the result to a file or to stdout
+func output(file string, data []byte) error {
+	if file == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func runGraph(global *Global, args []string) error {
+	var filter graph.Filter
+	var status, format, cluster, file string
+
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	fs.StringVar(&filter.Host, "host", "", "host in the center of the map")
+	fs.IntVar(&filter.Depth, "depth", 1, "hops around the host, -1 without limit")
+	fs.StringVar(&status, "status", "", "edge statuses to keep, comma separated (ok,slow,failed,disabled)")
+	fs.StringVar(&format, "format", graph.FormatDOT, "output format (json, dot, mermaid, plantuml)")
+	fs.StringVar(&cluster, "cluster", "", "group nodes by service or subnet")
+	fs.StringVar(&file, "output", "", "output file, stdout by default")
+	fs.Parse(args)
+
+	g, err := loadGraph(global, filter, status)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		data, err := json.MarshalIndent(g, "", "  ")
+		if err != nil {
+			return err
+		}
+		return output(file, append(data, '\n'))
+	}
+
+	text, err := graph.Render(g, format, cluster)
+	if err != nil {
+		return err
+	}
+
+	return output(file, []byte(text))
+}
+
+// printJSON writes the data of a response indented
+func printJSON(data interface{}) error {
+	jsn, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return output("", append(jsn, '\n'))
+}
+
+func runDeps(global *Global, args []string) error {
+	var host, direction, status string
+	var depth int
+	var asJSON bool
+
+	fs := flag.NewFlagSet("deps", flag.ExitOnError)
+	fs.StringVar(&host, "host", "", "host name or address, optionally with :port")
+	fs.StringVar(&direction, "direction", graph.Downstream, "downstream (what the host uses) or upstream (what uses the host)")
+	fs.IntVar(&depth, "depth", -1, "maximum hops, -1 without limit")
+	fs.StringVar(&status, "status", "", "edge statuses to follow, comma separated")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Parse(args)
+
+	params := url.Values{}
+	params.Set("host", host)
+	params.Set("direction", direction)
+	params.Set("depth", strconv.Itoa(depth))
+	if status != "" {
+		params.Set("status", status)
+	}
+
+	body, err := get(global, "/api/v1/netmap/graph/dependencies", params)
+	if err != nil {
+		return err
+	}
+
+	var data depsResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(data.Data)
+	}
+
+	for _, item := range data.Data {
+		fmt.Printf("%d\t%s\t%s\n", item.Depth, item.Host, strings.Join(item.Path, " -> "))
+	}
+
+	return nil
+}
+
+func runPath(global *Global, args []string) error {
+	var from, to, status string
+	var depth int
+	var all, asJSON bool
+
+	fs := flag.NewFlagSet("path", flag.ExitOnError)
+	fs.StringVar(&from, "from", "", "source host name or address")
+	fs.StringVar(&to, "to", "", "target host name or address")
+	fs.BoolVar(&all, "all", false, "list all paths instead of a shortest one")
+	fs.IntVar(&depth, "depth", -1, "maximum hops, -1 without limit")
+	fs.StringVar(&status, "status", "", "edge statuses to follow, comma separated")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Parse(args)
+
+	params := url.Values{}
+	params.Set("from", from)
+	params.Set("to", to)
+	params.Set("all", strconv.FormatBool(all))
+	params.Set("depth", strconv.Itoa(depth))
+	if status != "" {
+		params.Set("status", status)
+	}
+
+	body, err := get(global, "/api/v1/netmap/graph/paths", params)
+	if err != nil {
+		return err
+	}
+
+	var data pathResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(data.Data)
+	}
+
+	if len(data.Data) == 0 {
+		return fmt.Errorf("no path from %v to %v", from, to)
+	}
+
+	for _, item := range data.Data {
+		fmt.Println(strings.Join(item.Hosts, " -> "))
+	}
+
+	return nil
+}
+
+func runImpact(global *Global, args []string) error {
+	var depth int
+	var asJSON bool
+
+	fs := flag.NewFlagSet("impact", flag.ExitOnError)
+	fs.IntVar(&depth, "depth", -1, "maximum hops to dependents, -1 without limit")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Parse(args)
+
+	params := url.Values{}
+	params.Set("depth", strconv.Itoa(depth))
+
+	body, err := get(global, "/api/v1/netmap/graph/impact", params)
+	if err != nil {
+		return err
+	}
+
+	var data impactResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(data.Data)
+	}
+
+	for _, item := range data.Data {
+		var hosts []string
+		for _, dep := range item.Impacted {
+			hosts = append(hosts, dep.Host)
+		}
+		fmt.Printf("%s\t%s\n", item.Edge, strings.Join(hosts, ","))
+	}
+
+	return nil
+}
+
+func runAnalyze(global *Global, args []string) error {
+	var host, status, file string
+	var depth, top int
+	var asJSON bool
+
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	fs.StringVar(&host, "host", "", "analyze only the map around a host")
+	fs.IntVar(&depth, "depth", -1, "hops around the host, -1 without limit")
+	fs.StringVar(&status, "status", "", "edge statuses to keep, comma separated")
+	fs.IntVar(&top, "top", 10, "length of the fan-in and fan-out rankings")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.StringVar(&file, "output", "", "output file, stdout by default")
+	fs.Parse(args)
+
+	params := url.Values{}
+	params.Set("top", strconv.Itoa(top))
+	if host != "" {
+		params.Set("host", host)
+		params.Set("depth", strconv.Itoa(depth))
+	}
+	if status != "" {
+		params.Set("status", status)
+	}
+
+	body, err := get(global, "/api/v1/netmap/graph/analysis", params)
+	if err != nil {
+		return err
+	}
+
+	var data analysisResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+	if len(data.Data) == 0 {
+		return fmt.Errorf("empty analysis")
+	}
+
+	if asJSON {
+		jsn, err := json.MarshalIndent(data.Data[0], "", "  ")
+		if err != nil {
+			return err
+		}
+		return output(file, append(jsn, '\n'))
+	}
+
+	return output(file, []byte(data.Data[0].Report()))
+}
+
+func getEnv(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
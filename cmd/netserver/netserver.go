@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -30,11 +31,11 @@ func main() {
 	// Command-line flag parsing with environment variables
 	var clAddress, prAddress, initCluster, connString, cfFile, lgFile string
 	var logMaxSize, logMaxBackups, logMaxAge int
-	var logCompress, version, logHTTPRequests bool
+	var logCompress, version, logHTTPRequests, dbMigrate, dbMigrateDryRun bool
 
 	flag.StringVar(&clAddress, "listen.client-address", getEnv("NETSERVER_CLIENT_ADDRESS", "127.0.0.1:8084"), "listen client address")
 	flag.StringVar(&prAddress, "listen.peer-address", getEnv("NETSERVER_PEER_ADDRESS", "127.0.0.1:8085"), "listen peer address")
-	flag.StringVar(&initCluster, "initial-cluster", getEnv("NETSERVER_INITIAL_CLUSTER", ""), "initial cluster nodes")
+	flag.StringVar(&initCluster, "initial-cluster", getEnv("NETSERVER_INITIAL_CLUSTER", ""), "initial cluster nodes, ignored once members are stored in the db")
 	flag.StringVar(&connString, "db.conn-string", getEnv("NETSERVER_DB_CONN_STRING", ""), "db connection string")
 	flag.StringVar(&cfFile, "config.file", getEnv("NETSERVER_CONFIG_FILE", "config/config.yml"), "config file")
 	flag.StringVar(&lgFile, "log.file", getEnv("NETSERVER_LOG_FILE", ""), "log file")
@@ -43,6 +44,8 @@ func main() {
 	flag.IntVar(&logMaxAge, "log.max-age", getEnvInt("NETSERVER_LOG_MAX_AGE", 10), "log max age")
 	flag.BoolVar(&logCompress, "log.compress", getEnvBool("NETSERVER_LOG_COMPRESS", true), "log compress")
 	flag.BoolVar(&logHTTPRequests, "log.http-requests", getEnvBool("NETSERVER_LOG_HTTP_REQUESTS", false), "enable HTTP request logging")
+	flag.BoolVar(&dbMigrate, "db.migrate", false, "apply pending db migrations and exit")
+	flag.BoolVar(&dbMigrateDryRun, "db.migrate-dry-run", false, "show pending db migrations and exit")
 	flag.BoolVar(&version, "version", false, "show netserver version")
 
 	flag.Parse()
@@ -73,28 +76,53 @@ func main() {
 		cfg.DB.ConnString = connString
 	}
 
+	// List pending db migrations and exit, the database is not opened for writes
+	if dbMigrateDryRun {
+		names, err := db.PendingMigrations(cfg.DB)
+		if err != nil {
+			log.Fatalf("[error] %v", err)
+		}
+		for _, name := range names {
+			fmt.Printf("%v\n", name)
+		}
+		if len(names) == 0 {
+			log.Print("[info] db schema is up to date")
+		}
+		return
+	}
+
 	// Creating DB client
 	clientDB, err := db.NewClient(cfg.DB)
 	if err != nil {
 		log.Fatalf("[error] %v", err)
 	}
 
+	// Run db migrations and exit if requested
+	if dbMigrate {
+		migrator, ok := clientDB.(db.Migrator)
+		if !ok {
+			log.Fatalf("[error] db client %v does not support migrations", cfg.DB.Client)
+		}
+		names, err := migrator.Migrate(false)
+		if err != nil {
+			log.Fatalf("[error] %v", err)
+		}
+		for _, name := range names {
+			fmt.Printf("%v\n", name)
+		}
+		if len(names) == 0 {
+			log.Print("[info] db schema is up to date")
+		}
+		clientDB.Close()
+		return
+	}
+
 	// Creating RPC
 	rpcV1, err := v1.NewRPC(cfg, clientDB)
 	if err != nil {
 		log.Fatalf("[error] %v", err)
 	}
 
-	// TCP Listen
-	go func() {
-		inbound, err := net.Listen("tcp", prAddress)
-		if err != nil {
-			log.Fatalf("[error] %v", err)
-		}
-		rpc.Register(rpcV1)
-		rpc.Accept(inbound)
-	}()
-
 	// Initial cluster nodes
 	peers := []string{}
 	if initCluster != "" {
@@ -105,10 +133,20 @@ func main() {
 	}
 
 	// Creating API
-	apiV1, err := v1.NewAPI(cfg, peers, clientDB)
+	apiV1, err := v1.NewAPI(cfg, prAddress, peers, clientDB)
+	if err != nil {
+		log.Fatalf("[error] %v", err)
+	}
+
+	// TCP Listen
+	inbound, err := net.Listen("tcp", prAddress)
 	if err != nil {
 		log.Fatalf("[error] %v", err)
 	}
+	rpc.Register(rpcV1)
+	go apiV1.Peer.Serve(inbound)
+
+	v1.MonRegister()
 
 	// Enable logging middleware only if logHTTPRequests is enabled
 	mux := http.NewServeMux()
@@ -117,23 +155,38 @@ func main() {
 	mux.HandleFunc("/api/v1/netmap/netstat", apiV1.ApiNetstat)
 	mux.HandleFunc("/api/v1/netmap/tracert", apiV1.ApiTracert)
 	mux.HandleFunc("/api/v1/netmap/records", apiV1.ApiRecords)
+	mux.HandleFunc("/api/v1/netmap/records/history", apiV1.ApiRecordsHistory)
+	mux.HandleFunc("/api/v1/netmap/maintenance", apiV1.ApiMaintenance)
+	mux.HandleFunc("/api/v1/netmap/retention", apiV1.ApiRecordsRetention)
 	mux.HandleFunc("/api/v1/netmap/webhook", apiV1.ApiWebhook)
+	mux.HandleFunc("/api/v1/netmap/watch", apiV1.ApiWatch)
 	mux.HandleFunc("/api/v1/netmap/exceptions", apiV1.ApiExceptions)
+	mux.HandleFunc("/api/v1/netmap/graph", apiV1.ApiGraph)
+	mux.HandleFunc("/api/v1/netmap/graph/dependencies", apiV1.ApiGraphDependencies)
+	mux.HandleFunc("/api/v1/netmap/graph/paths", apiV1.ApiGraphPaths)
+	mux.HandleFunc("/api/v1/netmap/graph/impact", apiV1.ApiGraphImpact)
+	mux.HandleFunc("/api/v1/netmap/graph/analysis", apiV1.ApiGraphAnalysis)
+	mux.HandleFunc("/api/v1/cluster/members", apiV1.ApiMembers)
+	mux.HandleFunc("/api/v1/cluster/status", apiV1.ApiClusterStatus)
+	mux.HandleFunc("/api/v1/cluster/leader", apiV1.ApiClusterLeader)
+	mux.HandleFunc("/api/v1/auth/tokens", apiV1.ApiTokens)
 	mux.Handle("/metrics", promhttp.Handler())
 
-	var handler http.Handler = mux
+	var handler http.Handler = apiV1.Authenticate(mux)
 	if logHTTPRequests {
-		handler = loggingMiddleware(mux)
+		handler = loggingMiddleware(handler)
 	}
 
+	server := &http.Server{Addr: clAddress, Handler: handler}
+
 	go func(cfg *config.Global) {
 		log.Printf("[info] listen client address: %v", clAddress)
 		if cfg.CertFile != "" && cfg.CertKey != "" {
-			if err := http.ListenAndServeTLS(clAddress, cfg.CertFile, cfg.CertKey, handler); err != nil {
+			if err := server.ListenAndServeTLS(cfg.CertFile, cfg.CertKey); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("[error] %v", err)
 			}
 		} else {
-			if err := http.ListenAndServe(clAddress, handler); err != nil {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Fatalf("[error] %v", err)
 			}
 		}
@@ -142,20 +195,40 @@ func main() {
 	go func() {
 		for {
 			apiV1.ApiPeers()
-			time.Sleep(10 * time.Second)
+			apiV1.WaitPeers(10 * time.Second)
+		}
+	}()
+
+	go func() {
+		for {
+			apiV1.ApiCluster()
+			time.Sleep(1 * time.Minute)
 		}
 	}()
 
+	// Cluster-wide jobs run on the leader only
+	go apiV1.ApiLeader()
+	apiV1.LeaderJob("retention", 1*time.Hour, apiV1.ApiRetention)
+
 	log.Print("[info] netserver started -_^")
 
 	// Program completion signal processing
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	for {
-		<-c
-		log.Print("[info] netserver stopped")
-		os.Exit(0)
+	<-c
+
+	// Stop accepting requests, then flush pending writes
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[error] %v", err)
 	}
+	inbound.Close()
+	if err := clientDB.Close(); err != nil {
+		log.Printf("[error] %v", err)
+	}
+
+	log.Print("[info] netserver stopped")
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -5,7 +5,6 @@ import (
     "fmt"
     "sync"
     "strconv"
-    "net"
     "net/rpc"
     "net/http"
     "time"
@@ -20,6 +19,8 @@ import (
     "github.com/ltkh/netmap/internal/config"
     "github.com/ltkh/netmap/internal/client"
     "github.com/ltkh/netmap/internal/db"
+    "github.com/ltkh/netmap/internal/filter"
+    "github.com/ltkh/netmap/internal/maintenance"
 )
 
 var (
@@ -29,27 +30,37 @@ var (
         prometheus.GaugeOpts{
             Namespace: "netmap",
             Name:      "result_code",
-            Help:      "",
+            Help:      "Result of the last check of a relation, 0 is ok",
         },
-        []string{"src_name","dst_name","mode","port"},
+        []string{"src_name","dst_name","mode","port","account_id"},
     )
 
     responseTime = prometheus.NewGaugeVec(
         prometheus.GaugeOpts{
             Namespace: "netmap",
             Name:      "response_time",
-            Help:      "",
+            Help:      "Response time of the last check of a relation in seconds",
         },
-        []string{"src_name","dst_name","mode","port"},
+        []string{"src_name","dst_name","mode","port","account_id"},
     )
 
-    connections = make(map[string]chan int)
+    connections = &Connections{
+        items:   make(map[string]chan int),
+        changed: make(chan struct{}, 1),
+    }
+
+    ring = &Ring{}
 )
 
 type Api struct {
     Conf         *config.Config            `json:"conf"`
+    Self         string                    `json:"self"`
     Peers        *Peers                    `json:"peers"`
     DB           *db.DbClient              `json:"db"`
+    Handoff      *Handoff                  `json:"-"`
+    Peer         *Peer                     `json:"-"`
+    refresh      sync.Mutex
+    balance      sync.Mutex
 }
 
 type Resp struct {
@@ -57,6 +68,7 @@ type Resp struct {
     Error        string                    `json:"error,omitempty"`
     Warnings     []string                  `json:"warnings,omitempty"`
     Data         []interface{}             `json:"data"`
+    Next         string                    `json:"next,omitempty"`
 }
 
 type Records struct {
@@ -123,47 +135,248 @@ func compressData(data []byte, encoding string) (bytes.Buffer, bool, error) {
 func MonRegister(){
     prometheus.MustRegister(resultCode)
     prometheus.MustRegister(responseTime)
+    prometheus.MustRegister(handoffQueued)
+    prometheus.MustRegister(handoffReplayed)
+    prometheus.MustRegister(handoffDropped)
+    prometheus.MustRegister(handoffPending)
+    prometheus.MustRegister(peerCalls)
+    prometheus.MustRegister(peerUp)
+    prometheus.MustRegister(peerLastSuccess)
+    prometheus.MustRegister(peerRecords)
+    prometheus.MustRegister(peerDiverged)
+    prometheus.MustRegister(leaderGauge)
+    prometheus.MustRegister(leaderEpoch)
+    prometheus.MustRegister(ingestedRecords)
+    prometheus.MustRegister(rejectedRecords)
+    prometheus.MustRegister(peerCallDuration)
+    prometheus.MustRegister(accountRecords)
 }
 
-func NewAPI(conf *config.Config, peers []string, db db.DbClient) (*Api, error) {
+func NewAPI(conf *config.Config, self string, peers []string, db db.DbClient) (*Api, error) {
+    if conf.Cluster == nil {
+        conf.Cluster = &config.Cluster{}
+    }
+    if conf.Auth == nil {
+        conf.Auth = &config.Auth{}
+    }
+
+    handoff, err := NewHandoff(conf.Cluster)
+    if err != nil {
+        return nil, err
+    }
+
+    peer, err := NewPeer(conf.Global)
+    if err != nil {
+        return nil, err
+    }
+
     api := &Api{
         Conf: conf,
+        Self: self,
         Peers: &Peers{items: make(map[string]*rpc.Client)},
         DB: &db,
+        Handoff: handoff,
+        Peer: peer,
     }
 
-    for _, id := range peers {
-        connections[id] = make(chan int, 1)
+    accountRequired = conf.Auth.RequireAccount
+
+    // Members are kept in the DB, once stored they replace the initial cluster
+    // so that removed members do not come back on restart
+    members, err := db.LoadMembers()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, id := range members {
+        connections.Add(id)
+    }
+
+    if len(members) == 0 {
+        if _, err := addMembers(db, peers); err != nil {
+            return nil, err
+        }
+    } else if len(peers) > 0 {
+        log.Printf("[info] loaded stored cluster members (%d), initial cluster is ignored", len(members))
+    }
+
+    // Peers know this node by its address in the member list
+    api.Self = selfMember(self, connections.List())
+    if api.Self != self {
+        log.Printf("[info] peer address %v is cluster member %v", self, api.Self)
+    }
+    if !connections.Has(api.Self) {
+        log.Printf("[warning] peer address %v is not a cluster member, this node does not take part in leader election and owns no shards", api.Self)
+    }
+    connections.self = api.Self
+
+    // Watch cursors name the node and its start
+    hub.Open(api.Self)
+
+    ring.configure(conf.Cluster)
+    ring.update(connections.List())
+
+    stored, err := db.LoadRecords(config.RecArgs{})
+    if err != nil {
+        return nil, err
+    }
+    labelSeries.set(stored)
+
+    if err := prometheus.Register(labelSeries); err != nil {
+        log.Printf("[warning] %v", err)
+    }
+
+    if err := loadTokens(db); err != nil {
+        return nil, err
+    }
+
+    if err := loadMaintenance(db); err != nil {
+        return nil, err
     }
 
     return api, nil
 }
 
+// callPeer calls a peer and stores the call for hinted handoff when it can not be reached.
+// Older hints are replayed first to keep the order, a call that has to wait behind
+// a replay running on another request is queued and delivered by it.
+func (api *Api) callPeer(id string, client *rpc.Client, method string, args interface{}) error {
+    if api.Handoff.Pending(id) > 0 {
+        if err := api.Handoff.Replay(id, client); err != nil {
+            connections.Flag(id)
+            api.Handoff.Push(id, method, args)
+            return err
+        }
+        if api.Handoff.Pending(id) > 0 {
+            api.Handoff.Push(id, method, args)
+            return nil
+        }
+    }
+
+    err := api.call(id, client, method, args, nil)
+    if _, ok := err.(rpc.ServerError); ok {
+        // The peer refused the call, sending it again will not help
+        return err
+    }
+    if err != nil {
+        connections.Flag(id)
+        api.Handoff.Push(id, method, args)
+    }
+
+    return err
+}
+
+// callPeers makes the same call to every connected peer and returns the failed ones
+func (api *Api) callPeers(method string, args interface{}) map[string]error {
+    er := Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for id, client := range api.Peers.items {
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            if err := api.callPeer(id, client, method, args); err != nil {
+                log.Printf("[error] %v - %s %s", err, id, method)
+                er.Lock()
+                er.items[id] = err
+                er.Unlock()
+            }
+
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    return er.items
+}
+
+// restorePeer replays stored calls and then pulls what is still missing
+func (api *Api) restorePeer(id string, client *rpc.Client) {
+    if err := api.Handoff.Replay(id, client); err != nil {
+        log.Printf("[error] handoff: %v - %s", err, id)
+        connections.Flag(id)
+        return
+    }
+    api.ApiSync(id, client)
+}
+
 func (api *Api) ApiPeers() {
-    for id, _ := range connections {
+    api.refresh.Lock()
+    defer api.refresh.Unlock()
+
+    for _, id := range connections.List() {
 
-        conn, err := net.DialTimeout("tcp", id, 2 * time.Second)
+        api.Peers.RLock()
+        _, ok := api.Peers.items[id]
+        api.Peers.RUnlock()
+
+        if ok && !connections.Flagged(id) {
+            continue
+        }
+
+        conn, err := api.Peer.Dial(id)
         if err == nil {
-            if _, ok := api.Peers.items[id]; !ok {
+            if !ok {
+                client := rpc.NewClient(conn)
                 api.Peers.Lock()
-                api.Peers.items[id] = rpc.NewClient(conn)
+                api.Peers.items[id] = client
                 api.Peers.Unlock()
                 log.Printf("[info] successful connection: %v", id)
+                go api.restorePeer(id, client)
                 continue
             }
-            if len(connections[id]) > 0 {
-                <- connections[id]
+            if connections.Reset(id) {
+                client := rpc.NewClient(conn)
                 api.Peers.Lock()
-                api.Peers.items[id] = rpc.NewClient(conn)
+                api.Peers.items[id] = client
                 api.Peers.Unlock()
                 log.Printf("[info] connection restored: %v", id)
+                go api.restorePeer(id, client)
                 continue
             }
+            conn.Close()
         } else {
             log.Printf("[error] %v", err)
         }
         
     }
+
+    // Close clients of removed members
+    api.Peers.Lock()
+    for id, client := range api.Peers.items {
+        if !connections.Has(id) {
+            client.Close()
+            delete(api.Peers.items, id)
+        }
+    }
+    api.Peers.Unlock()
+
+    if old, ok := ring.update(connections.List()); ok && ring.Enabled() {
+        go api.rebalance(old)
+    }
+}
+
+// loadRecords reads records for a query. Sharded records are read from their
+// owners, replicated ones from the peers when more than one answer is required.
+func (api *Api) loadRecords(args config.RecArgs, level string) ([]config.SockTable, map[string]error, bool, error) {
+    if ring.Enabled() || level != levelOne {
+        items, errs, ok := api.readPeers(args, level)
+        return items, errs, ok, nil
+    }
+
+    items, err := db.DbClient.LoadRecords(*api.DB, args)
+    return items, nil, true, err
+}
+
+// WaitPeers blocks until cluster membership changes or the timeout expires
+func (api *Api) WaitPeers(timeout time.Duration) {
+    connections.Wait(timeout)
 }
 
 func (api *Api) ApiHealthy(w http.ResponseWriter, r *http.Request) {
@@ -205,32 +418,30 @@ func (api *Api) ApiStatus(w http.ResponseWriter, r *http.Request) {
         var netstat config.NetstatData
 
         if err := json.Unmarshal(body, &netstat); err != nil {
+            rejectedRecords.WithLabelValues("status", "decode").Inc()
             log.Printf("[error] %v - %s", err, r.URL.Path)
             w.WriteHeader(400)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
+        ingestedRecords.WithLabelValues("status").Add(float64(len(netstat.Data)))
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
+        if err := checkRecords(r, netstat.Data); err != nil {
+            rejectedRecords.WithLabelValues("status", "account").Add(float64(len(netstat.Data)))
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
 
-            go func(id string, cli *rpc.Client) {
-    
-                err := client.Call("RPC.SetStatus", netstat.Data, nil)
-                if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                    return
-                }
-    
-            }(id, client)
-            
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
-        
-        w.WriteHeader(204)
+
+        errs, ok := api.writePeers("RPC.SetStatus", netstat.Data, level)
+        writeResponse(w, level, errs, ok)
         return
     }
 
@@ -272,32 +483,43 @@ func (api *Api) ApiNetstat(w http.ResponseWriter, r *http.Request) {
         var netstat config.NetstatData
 
         if err := json.Unmarshal(body, &netstat); err != nil {
+            rejectedRecords.WithLabelValues("netstat", "decode").Inc()
             log.Printf("[error] %v - %s", err, r.URL.Path)
             w.WriteHeader(400)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
+        ingestedRecords.WithLabelValues("netstat").Add(float64(len(netstat.Data)))
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
+        var records []config.SockTable
 
-            go func(id string, client *rpc.Client) {
-    
-                err := client.Call("RPC.SetNetstat", netstat.Data, nil)
-                if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                    return
-                }
-    
-            }(id, client)
-            
+        for _, nr := range netstat.Data {
+            if err := config.CheckLabels(nr.Labels); err != nil {
+                rejectedRecords.WithLabelValues("netstat", "invalid").Inc()
+                log.Printf("[error] %v, sender - %s", err, readUserIP(r))
+                continue
+            }
+            nr.Maintenance = nil
+            records = append(records, nr)
         }
-        
-        w.WriteHeader(204)
+        netstat.Data = records
+
+        if err := checkRecords(r, netstat.Data); err != nil {
+            rejectedRecords.WithLabelValues("netstat", "account").Add(float64(len(netstat.Data)))
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        errs, ok := api.writePeers("RPC.SetNetstat", netstat.Data, level)
+        writeResponse(w, level, errs, ok)
         return
     }
 
@@ -339,32 +561,30 @@ func (api *Api) ApiTracert(w http.ResponseWriter, r *http.Request) {
         var netstat config.NetstatData
 
         if err := json.Unmarshal(body, &netstat); err != nil {
+            rejectedRecords.WithLabelValues("tracert", "decode").Inc()
             log.Printf("[error] %v - %s", err, r.URL.Path)
             w.WriteHeader(400)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
+        ingestedRecords.WithLabelValues("tracert").Add(float64(len(netstat.Data)))
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
+        if err := checkRecords(r, netstat.Data); err != nil {
+            rejectedRecords.WithLabelValues("tracert", "account").Add(float64(len(netstat.Data)))
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
 
-            go func(id string, client *rpc.Client) {
-    
-                err := client.Call("RPC.SetTracert", netstat.Data, nil)
-                if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                    return
-                }
-    
-            }(id, client)
-            
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
-        
-        w.WriteHeader(204)
+
+        errs, ok := api.writePeers("RPC.SetTracert", netstat.Data, level)
+        writeResponse(w, level, errs, ok)
         return
     }
 
@@ -375,13 +595,16 @@ func (api *Api) ApiTracert(w http.ResponseWriter, r *http.Request) {
 func (api *Api) ApiRecords(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
-    var wg sync.WaitGroup
     var records []config.SockTable
 
     if r.Method == "GET" {
 
         //rc := Records{items: make(map[string]config.SockTable)}
         var args config.RecArgs
+        var keys []filter.SortKey
+        var limit int
+        var cursor string
+        paged := false
 
         for k, v := range r.URL.Query() {
             switch k {
@@ -399,97 +622,91 @@ func (api *Api) ApiRecords(w http.ResponseWriter, r *http.Request) {
                         return
                     }
                     args.Timestamp = int64(i)
+                case "filter":
+                    if _, err := filter.Parse(v[0]); err != nil {
+                        w.WriteHeader(400)
+                        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                        return
+                    }
+                    args.Filter = v[0]
+                case "sort":
+                    var err error
+                    if keys, err = filter.ParseSort(v[0]); err != nil {
+                        w.WriteHeader(400)
+                        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                        return
+                    }
+                    paged = true
+                case "limit":
+                    i, err := strconv.Atoi(v[0])
+                    if err != nil || i < 0 {
+                        w.WriteHeader(400)
+                        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("executing query: invalid parameter: %v", k)}))
+                        return
+                    }
+                    limit = i
+                    paged = true
+                case "cursor":
+                    cursor = v[0]
+                    paged = true
             }
         }
 
-        items, err := db.DbClient.LoadRecords(*api.DB, args)
+        account, err := accountParam(r)
         if err != nil {
-            log.Printf("[error] %v - %s", err, r.URL.Path)
-            w.WriteHeader(500)
+            w.WriteHeader(accountCode(err))
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
+        args.AccountID = account
 
-        var records []interface{}
-        for _, item := range items{
-            if item.Timestamp < args.Timestamp {
-                continue
-            }
-            records = append(records, item)
+        level, err := consistencyLevel(r, api.Conf.Cluster.ReadLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
 
-        data := encodeResp(&Resp{Status:"success", Data:records})
-        /*
-        buf, ok, err := compressData(data, r.Header.Get("Accept-Encoding"))
+        items, errs, ok, err := api.loadRecords(args, level)
         if err != nil {
             log.Printf("[error] %v - %s", err, r.URL.Path)
             w.WriteHeader(500)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
-
-        if ok {
-            w.Header().Set("Content-Encoding", "gzip")
+        if !ok {
+            w.WriteHeader(503)
+            w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("consistency level %v not met", level), Warnings:peerErrors(errs)}))
+            return
         }
-        */
-
-        w.WriteHeader(200)
-        w.Write(data)
-        return
 
-        /*
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items { 
-
-            wg.Add(1)
-
-            go func(id string, client *rpc.Client, rc *Records, wg *sync.WaitGroup) {
-                defer wg.Done()
-    
-                var items []config.SockTable
-                err := client.Call("RPC.GetRecords", args, &items)
-                if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                    return
-                }
-    
-                rc.Lock()
-                defer rc.Unlock()
-    
-                for _, item := range items{
-                    if args.Timestamp > item.Timestamp {
-                        continue
-                    }
-                    if it, ok := rc.items[item.Id]; ok {
-                        if it.Timestamp >= item.Timestamp {
-                            continue
-                        }
-                    }
-                    rc.items[item.Id] = item
-                }
-    
-            }(id, client, &rc, &wg)
-            
+        var selected []config.SockTable
+        for _, item := range items{
+            if item.Timestamp < args.Timestamp {
+                continue
+            }
+            selected = append(selected, item)
         }
 
-        wg.Wait()
-
-        rc.RLock()
-        defer rc.RUnlock()
-
-        for _, item := range rc.items{
-            records = append(records, item)
+        // Pages are cut after merging the answers of the peers
+        var next string
+        if paged {
+            selected, next, err = filter.Page(selected, keys, limit, cursor)
+            if err != nil {
+                w.WriteHeader(400)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
         }
 
-        if len(records) == 0 {
-            records = make([]config.SockTable, 0)
+        var records []interface{}
+        for _, item := range selected {
+            item.Maintenance = maintenances.windows(item)
+            records = append(records, item)
         }
 
-        data := encodeResp(&Resp{Status:"success", Data:records})
+        data := encodeResp(&Resp{Status:"success", Data:records, Next:next})
+        /*
         buf, ok, err := compressData(data, r.Header.Get("Accept-Encoding"))
         if err != nil {
             log.Printf("[error] %v - %s", err, r.URL.Path)
@@ -501,11 +718,11 @@ func (api *Api) ApiRecords(w http.ResponseWriter, r *http.Request) {
         if ok {
             w.Header().Set("Content-Encoding", "gzip")
         }
+        */
 
         w.WriteHeader(200)
-        w.Write(buf.Bytes())
+        w.Write(data)
         return
-        */
     }
 
     if r.Method == "POST" {
@@ -539,74 +756,206 @@ func (api *Api) ApiRecords(w http.ResponseWriter, r *http.Request) {
         var netstat config.NetstatData
 
         if err := json.Unmarshal(body, &netstat); err != nil {
+            rejectedRecords.WithLabelValues("records", "decode").Inc()
             log.Printf("[error] %v - %s", err, r.URL.Path)
             w.WriteHeader(400)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
+        ingestedRecords.WithLabelValues("records").Add(float64(len(netstat.Data)))
 
         rhost := readUserIP(r)
 
         for _, nr := range netstat.Data {
             if nr.LocalAddr.Name == "" {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing localAddr.name, sender - %s", rhost)
                 continue
             }
             if nr.LocalAddr.IP == nil {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing LocalAddr.IP, sender - %s", rhost)
                 continue
             }
             if nr.RemoteAddr.Name == "" {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing RemoteAddr.Name, sender - %s", rhost)
                 continue
             }
             if nr.RemoteAddr.IP == nil {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing RemoteAddr.IP, sender - %s", rhost)
                 continue
             }
             if nr.Relation.Port == 0 {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing Relation.Port, sender - %s", rhost)
                 continue
             }
             if nr.Relation.Mode == "" {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
                 log.Printf("[error] parameter missing Relation.Mode, sender - %s", rhost)
                 continue
             }
+            if err := config.CheckLabels(nr.Labels); err != nil {
+                rejectedRecords.WithLabelValues("records", "invalid").Inc()
+                log.Printf("[error] %v, sender - %s", err, rhost)
+                continue
+            }
+            // Records read from the API carry the windows in effect
+            nr.Maintenance = nil
             //nr.Id = config.GetIdRec(&nr)
             records = append(records, nr)
         }
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
+        if err := checkRecords(r, records); err != nil {
+            rejectedRecords.WithLabelValues("records", "account").Add(float64(len(records)))
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
 
-            wg.Add(1)
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
 
-            go func(id string, client *rpc.Client) {
-                defer wg.Done()
+        errs, ok := api.writePeers("RPC.SetRecords", records, level)
+        writeResponse(w, level, errs, ok)
+        return
+    }
 
-                err := client.Call("RPC.SetRecords", records, nil)
+    if r.Method == "PATCH" {
+        var reader io.ReadCloser
+        var err error
+
+        // Check that the server actual sent compressed data
+        switch r.Header.Get("Content-Encoding") {
+            case "gzip":
+                reader, err = gzip.NewReader(r.Body)
                 if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
+                    log.Printf("[error] %v - %s", err, r.URL.Path)
+                    w.WriteHeader(400)
+                    w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
                     return
                 }
+                defer reader.Close()
+            default:
+                reader = r.Body
+        }
+        defer r.Body.Close()
 
-            }(id, client)
-            
+        body, err := ioutil.ReadAll(reader)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
 
-        wg.Wait()
-        
-        w.WriteHeader(204)
+        var patch config.RecordsPatch
+
+        if err := json.Unmarshal(body, &patch); err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        // An empty selector would change every record
+        if patch.Selector.Empty() {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"parameter missing selector"}))
+            return
+        }
+
+        if len(patch.Options.Args(nil).Fields) == 0 {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"parameter missing options"}))
+            return
+        }
+
+        if _, err := filter.Parse(patch.Selector.Filter); err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        account, err := accountParam(r)
+        if err != nil {
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        args := config.RecArgs{
+            SrcName:   patch.Selector.SrcName,
+            Type:      patch.Selector.Type,
+            Filter:    patch.Selector.Filter,
+            AccountID: account,
+        }
+        if len(patch.Selector.Ids) == 1 {
+            args.Id = patch.Selector.Ids[0]
+        }
+
+        items, errs, ok, err := api.loadRecords(args, levelOne)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+        if !ok {
+            w.WriteHeader(503)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"records could not be selected", Warnings:peerErrors(errs)}))
+            return
+        }
+
+        selected := map[string]bool{}
+        for _, id := range patch.Selector.Ids {
+            selected[id] = true
+        }
+
+        var ids []string
+        var data []interface{}
+        for _, item := range items {
+            if len(selected) > 0 && !selected[item.Id] {
+                continue
+            }
+            ids = append(ids, item.Id)
+            data = append(data, item.Id)
+        }
+
+        if patch.DryRun || len(ids) == 0 {
+            w.WriteHeader(200)
+            w.Write(encodeResp(&Resp{Status:"success", Data:data}))
+            return
+        }
+
+        // Every peer changes the records it stores, the others are skipped
+        members := connections.List()
+        errs = api.callPeers("RPC.PatchRecords", patch.Options.Args(ids))
+        if len(members) - len(errs) < required(level, len(members)) {
+            w.WriteHeader(503)
+            w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("consistency level %v not met", level), Warnings:peerErrors(errs)}))
+            return
+        }
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(errs), Data:data}))
         return
     }
 
     if r.Method == "DELETE" {
-
-        er := Errors{items: make(map[string]error)}
         var reader io.ReadCloser
         var err error
 
@@ -643,44 +992,22 @@ func (api *Api) ApiRecords(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
-
-            wg.Add(1)
-
-            go func(id string, client *rpc.Client, er *Errors) {
-                defer wg.Done()
-    
-                err := client.Call("RPC.DelRecords", keys, nil)
-                if err != nil {
-                    er.Lock()
-                    er.items[id] = err
-                    er.Unlock()
-
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                }
-    
-            }(id, client, &er)
-            
+        if err := api.checkRecordIds(r, keys); err != nil {
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
 
-        wg.Wait()
-
-        er.RLock()
-        defer er.RUnlock()
-
-        for _, err := range er.items {
-            w.WriteHeader(500)
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
             w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
             return
         }
 
-        w.WriteHeader(200)
-        w.Write(encodeResp(&Resp{Status:"success"}))
+        // Every peer deletes the records it stores, the other ids are skipped
+        errs, ok := api.writeAll("RPC.DelRecords", keys, level)
+        writeResponse(w, level, errs, ok)
         return
     }
 
@@ -705,11 +1032,17 @@ func (api *Api) ApiExceptions(w http.ResponseWriter, r *http.Request) {
                     args.Id = v[0]
                 case "src_name":
                     args.SrcName = v[0]
-                case "account_id":
-                    args.AccountID = v[0]
             }
         }
 
+        account, err := accountParam(r)
+        if err != nil {
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+        args.AccountID = account
+
         api.Peers.RLock()
         defer api.Peers.RUnlock()
         for id, client := range api.Peers.items {
@@ -720,12 +1053,10 @@ func (api *Api) ApiExceptions(w http.ResponseWriter, r *http.Request) {
                 defer wg.Done()
     
                 var items []config.Exception
-                err := client.Call("RPC.GetExceptions", args, &items)
+                err := api.call(id, client, "RPC.GetExceptions", args, &items)
                 if err != nil {
                     log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
+                    connections.Flag(id)
                     return
                 }
     
@@ -803,39 +1134,28 @@ func (api *Api) ApiExceptions(w http.ResponseWriter, r *http.Request) {
             return
         }
 
+        var items []config.Exception
+
         for _, ex := range expdata.Data {
             if ex.Id == "" {
                 ex.Id = config.GetIdExp(&ex)
             } 
-            exceptions = append(exceptions, ex)
+            items = append(items, ex)
         }
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
-
-            go func(id string, client *rpc.Client) {
-    
-                err := client.Call("RPC.SetExceptions", exceptions, nil)
-                if err != nil {
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                    return
-                }
-    
-            }(id, client)
-            
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
         }
-        
-        w.WriteHeader(204)
+
+        errs, ok := api.writeAll("RPC.SetExceptions", items, level)
+        writeResponse(w, level, errs, ok)
         return
     }
 
     if r.Method == "DELETE" {
-
-        er := Errors{items: make(map[string]error)}
         var reader io.ReadCloser
         var err error
 
@@ -872,49 +1192,68 @@ func (api *Api) ApiExceptions(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        api.Peers.RLock()
-        defer api.Peers.RUnlock()
-        for id, client := range api.Peers.items {
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
 
-            wg.Add(1)
+        errs, ok := api.writeAll("RPC.DelExceptions", keys, level)
+        writeResponse(w, level, errs, ok)
+        return
+    }
 
-            go func(id string, client *rpc.Client, er *Errors) {
-                defer wg.Done()
-    
-                err := client.Call("RPC.DelExceptions", keys, nil)
-                if err != nil {
-                    er.Lock()
-                    er.items[id] = err
-                    er.Unlock()
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
 
-                    log.Printf("[error] %v - %s%s", err, id, r.URL.Path)
-                    if len(connections[id]) < 1 {
-                        connections[id] <- 1
-                    }
-                }
-    
-            }(id, client, &er)
-            
+// labeled adds the labels of the stored records to the webhook alerts, labels
+// set on an alert win, bodies that are not a list of alerts are sent as they are
+func (api *Api) labeled(body []byte) []byte {
+    var items []map[string]json.RawMessage
+    if err := json.Unmarshal(body, &items); err != nil {
+        return body
+    }
+
+    changed := false
+    for _, item := range items {
+        var labels map[string]string
+        if err := json.Unmarshal(item["labels"], &labels); err != nil || len(labels) == 0 {
+            continue
         }
-        
-        wg.Wait()
 
-        er.RLock()
-        defer er.RUnlock()
+        rec := maintenance.FromLabels(labels)
+        if rec.LocalAddr.IP == nil || rec.RemoteAddr.IP == nil {
+            continue
+        }
 
-        for _, err := range er.items {
-            w.WriteHeader(500)
-            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
-            return
+        found, _, _, err := api.loadRecords(config.RecArgs{Id: config.GetIdRec(&rec)}, levelOne)
+        if err != nil || len(found) == 0 {
+            continue
         }
 
-        w.WriteHeader(200)
-        w.Write(encodeResp(&Resp{Status:"success"}))
-        return
+        merged, ok := config.DefaultLabels(labels, found[0].Labels)
+        if !ok {
+            continue
+        }
+        jsn, err := json.Marshal(merged)
+        if err != nil {
+            continue
+        }
+        item["labels"] = jsn
+        changed = true
     }
 
-    w.WriteHeader(405)
-    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+    if !changed {
+        return body
+    }
+
+    jsn, err := json.Marshal(items)
+    if err != nil {
+        return body
+    }
+    return jsn
 }
 
 func (api *Api) ApiWebhook(w http.ResponseWriter, r *http.Request) {
@@ -948,7 +1287,12 @@ func (api *Api) ApiWebhook(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        if len(api.Conf.Notifier.URLs) > 0 {
+        body, silenced := notified(api.labeled(body))
+        if silenced > 0 {
+            log.Printf("[info] webhook: %d alerts suppressed by maintenance, sender - %s", silenced, readUserIP(r))
+        }
+
+        if len(api.Conf.Notifier.URLs) > 0 && body != nil {
             for _, url := range api.Conf.Notifier.URLs {
                 config := client.HttpConfig{
                     URLs: []string{url},
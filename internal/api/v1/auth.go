@@ -0,0 +1,442 @@
+package v1
+
+import (
+    "io"
+    "fmt"
+    "errors"
+    "log"
+    "sync"
+    "time"
+    "strings"
+    "strconv"
+    "context"
+    "net/http"
+    "io/ioutil"
+    "compress/gzip"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+const (
+    roleReader   = "reader"
+    roleAgent    = "agent"
+    roleAdmin    = "admin"
+)
+
+type ctxKey int
+
+const tokenCtx ctxKey = 0
+
+var errForbidden = errors.New("record belongs to another account")
+
+var errAccount = errors.New("parameter missing account_id")
+
+var errUnchecked = errors.New("records could not be checked")
+
+var (
+    // Every role includes the permissions of the lower ones
+    roles = map[string]int{
+        roleReader: 1,
+        roleAgent:  2,
+        roleAdmin:  3,
+    }
+
+    tokens = &Tokens{items: make(map[string]config.Token)}
+
+    // Writes not bound to an account must name one, see auth.require_account
+    accountRequired = false
+)
+
+type Tokens struct {
+    sync.RWMutex
+    items        map[string]config.Token
+}
+
+// NewToken is the body of a token request, the reply carries the secret
+type NewToken struct {
+    Name         string                    `json:"name"`
+    Role         string                    `json:"role"`
+    AccountID    uint32                    `json:"accountID"`
+    Secret       string                    `json:"secret,omitempty"`
+}
+
+func (t *Tokens) set(items []config.Token) {
+    t.Lock()
+    defer t.Unlock()
+
+    for _, tok := range items {
+        t.items[tok.Id] = tok
+    }
+}
+
+func (t *Tokens) del(ids []string) {
+    t.Lock()
+    defer t.Unlock()
+
+    for _, id := range ids {
+        delete(t.items, id)
+    }
+}
+
+func (t *Tokens) get(id string) (config.Token, bool) {
+    t.RLock()
+    defer t.RUnlock()
+
+    tok, ok := t.items[id]
+    return tok, ok
+}
+
+func (t *Tokens) list() []config.Token {
+    t.RLock()
+    defer t.RUnlock()
+
+    items := make([]config.Token, 0, len(t.items))
+    for _, tok := range t.items {
+        items = append(items, tok)
+    }
+    return items
+}
+
+func loadTokens(client db.DbClient) error {
+    items, err := client.LoadTokens()
+    if err != nil {
+        return err
+    }
+    tokens.set(items)
+    return nil
+}
+
+// requiredRole returns the role a request needs
+func requiredRole(r *http.Request) string {
+    path := r.URL.Path
+
+    switch {
+        case strings.HasPrefix(path, "/api/v1/auth/"):
+            return roleAdmin
+        case strings.HasPrefix(path, "/api/v1/cluster/"):
+            if r.Method == "GET" {
+                return roleReader
+            }
+            return roleAdmin
+        case path == "/api/v1/netmap/retention":
+            return roleAdmin
+        case path == "/api/v1/netmap/exceptions", path == "/api/v1/netmap/maintenance":
+            if r.Method == "GET" {
+                return roleReader
+            }
+            return roleAdmin
+        case strings.HasPrefix(path, "/api/v1/netmap/"):
+            if r.Method == "GET" {
+                return roleReader
+            }
+            return roleAgent
+    }
+
+    return roleAdmin
+}
+
+// authenticate finds the token of a bearer or basic authorization header,
+// for basic auth the password is the secret and the user the token name
+func (api *Api) authenticate(r *http.Request) (config.Token, bool) {
+    var secret, name string
+
+    header := r.Header.Get("Authorization")
+    if strings.HasPrefix(header, "Bearer ") {
+        secret = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+    } else if user, pass, ok := r.BasicAuth(); ok {
+        secret, name = pass, user
+    }
+
+    if secret == "" {
+        return config.Token{}, false
+    }
+
+    admin := api.Conf.Auth.AdminToken
+    if admin != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(admin)) == 1 {
+        return config.Token{Name: "admin", Role: roleAdmin}, true
+    }
+
+    tok, ok := tokens.get(config.GetHash(secret))
+    if !ok || (name != "" && name != tok.Name) {
+        return config.Token{}, false
+    }
+
+    return tok, true
+}
+
+// Authenticate checks the credentials of /api requests when auth is enabled
+func (api *Api) Authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !api.Conf.Auth.Enabled || !strings.HasPrefix(r.URL.Path, "/api/") {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        tok, ok := api.authenticate(r)
+        if !ok {
+            log.Printf("[error] authentication failed - %s, sender - %s", r.URL.Path, readUserIP(r))
+            w.Header().Set("Content-Type", "application/json")
+            w.Header().Set("WWW-Authenticate", `Basic realm="netmap"`)
+            w.WriteHeader(401)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"unauthorized"}))
+            return
+        }
+
+        if roles[tok.Role] < roles[requiredRole(r)] {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(403)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"forbidden"}))
+            return
+        }
+
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenCtx, tok)))
+    })
+}
+
+// requestAccount returns the account a request is bound to,
+// false means the request may see every account
+func requestAccount(r *http.Request) (uint32, bool) {
+    tok, ok := r.Context().Value(tokenCtx).(config.Token)
+    if !ok || tok.Role == roleAdmin {
+        return 0, false
+    }
+    return tok.AccountID, true
+}
+
+// accountParam returns the account_id parameter of a request, requests
+// bound to an account get their own one and can not ask for another.
+// An empty account is not a filter, reads return the records of every account
+func accountParam(r *http.Request) (string, error) {
+    param := r.URL.Query().Get("account_id")
+
+    if account, ok := requestAccount(r); ok {
+        if param != "" && param != fmt.Sprint(account) {
+            return "", errForbidden
+        }
+        return fmt.Sprint(account), nil
+    }
+
+    if param != "" {
+        if _, err := strconv.ParseUint(param, 10, 32); err != nil {
+            return "", fmt.Errorf("executing query: invalid parameter: account_id")
+        }
+    }
+
+    return param, nil
+}
+
+// accountCode returns the response code of an account error
+func accountCode(err error) int {
+    if err == errForbidden {
+        return 403
+    }
+    if err == errUnchecked {
+        return 503
+    }
+    return 400
+}
+
+// checkRecords sets the account of the request on records without one
+// and refuses records of other accounts. Without an account the records
+// keep their own, account 0 unless set, when accounts are not required
+func checkRecords(r *http.Request, items []config.SockTable) error {
+    param, err := accountParam(r)
+    if err != nil {
+        return err
+    }
+    if param == "" {
+        if accountRequired {
+            return errAccount
+        }
+        return nil
+    }
+
+    account, _ := strconv.ParseUint(param, 10, 32)
+
+    for i := range items {
+        if items[i].Options.AccountID == 0 {
+            items[i].Options.AccountID = uint32(account)
+        }
+        if items[i].Options.AccountID != uint32(account) {
+            return errForbidden
+        }
+    }
+
+    return nil
+}
+
+// checkRecordIds refuses to delete records stored under other accounts,
+// with sharding the records are looked up on their owners
+func (api *Api) checkRecordIds(r *http.Request, ids []string) error {
+    param, err := accountParam(r)
+    if err != nil {
+        return err
+    }
+    if param == "" {
+        if accountRequired {
+            return errAccount
+        }
+        return nil
+    }
+
+    stored, errs, ok, err := api.loadRecords(config.RecArgs{AccountID: param}, levelOne)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        log.Printf("[error] %v: %v", errUnchecked, peerErrors(errs))
+        return errUnchecked
+    }
+
+    keys := map[string]bool{}
+    for _, rec := range stored {
+        keys[rec.Id] = true
+    }
+
+    for _, id := range ids {
+        if !keys[id] {
+            return errForbidden
+        }
+    }
+
+    return nil
+}
+
+func newSecret() (string, error) {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(buf), nil
+}
+
+func (api *Api) ApiTokens(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method == "GET" {
+        var items []interface{}
+        for _, tok := range tokens.list() {
+            items = append(items, tok)
+        }
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Data:items}))
+        return
+    }
+
+    if r.Method == "POST" || r.Method == "DELETE" {
+        var reader io.ReadCloser
+        var err error
+
+        // Check that the server actual sent compressed data
+        switch r.Header.Get("Content-Encoding") {
+            case "gzip":
+                reader, err = gzip.NewReader(r.Body)
+                if err != nil {
+                    log.Printf("[error] %v - %s", err, r.URL.Path)
+                    w.WriteHeader(400)
+                    w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                    return
+                }
+                defer reader.Close()
+            default:
+                reader = r.Body
+        }
+        defer r.Body.Close()
+
+        body, err := ioutil.ReadAll(reader)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        if r.Method == "DELETE" {
+            var ids []string
+
+            if err := json.Unmarshal(body, &ids); err != nil {
+                log.Printf("[error] %v - %s", err, r.URL.Path)
+                w.WriteHeader(400)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
+
+            errs, ok := api.writeAll("RPC.DelTokens", ids, level)
+            if !ok {
+                writeResponse(w, level, errs, ok)
+                return
+            }
+
+            w.WriteHeader(200)
+            w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(errs)}))
+            return
+        }
+
+        var req NewToken
+
+        if err := json.Unmarshal(body, &req); err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        if req.Name == "" {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"parameter missing name"}))
+            return
+        }
+
+        if _, ok := roles[req.Role]; !ok {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("invalid role: %v", req.Role)}))
+            return
+        }
+
+        secret, err := newSecret()
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        tok := config.Token{
+            Id:        config.GetHash(secret),
+            Name:      req.Name,
+            Role:      req.Role,
+            AccountID: req.AccountID,
+            Created:   time.Now().UTC().Unix(),
+        }
+
+        errs, ok := api.writeAll("RPC.SetTokens", []config.Token{tok}, level)
+        if !ok {
+            // The secret is not returned, the stored token can not be used
+            writeResponse(w, level, errs, ok)
+            return
+        }
+
+        log.Printf("[info] token created: %v (%v), sender - %s", tok.Name, tok.Role, readUserIP(r))
+
+        req.Secret = secret
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(errs), Data:[]interface{}{tok, req}}))
+        return
+    }
+
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
@@ -0,0 +1,281 @@
+package v1
+
+import (
+    "log"
+    "sync"
+    "time"
+    "net/rpc"
+    "net/http"
+    "encoding/json"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+var (
+    peerCalls = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "peer_calls_total",
+            Help:      "Peer RPC calls by result",
+        },
+        []string{"peer","result"},
+    )
+
+    peerUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "peer_up",
+            Help:      "Whether the peer is connected and not waiting for reconnection",
+        },
+        []string{"peer"},
+    )
+
+    peerLastSuccess = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "peer_last_success_timestamp_seconds",
+            Help:      "Time of the last successful RPC call to the peer",
+        },
+        []string{"peer"},
+    )
+
+    peerRecords = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "peer_records",
+            Help:      "Records stored on the peer",
+        },
+        []string{"peer"},
+    )
+
+    peerDiverged = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "peer_diverged",
+            Help:      "Whether the data of the peer differs from the local node",
+        },
+        []string{"peer"},
+    )
+
+    peerStats = &PeerStats{items: make(map[string]*PeerStat)}
+)
+
+// PeerStat counts the RPC calls made to a peer
+type PeerStat struct {
+    Calls        int64                     `json:"calls"`
+    Errors       int64                     `json:"errors"`
+    LastSuccess  int64                     `json:"lastSuccess"`
+    LastError    string                    `json:"lastError,omitempty"`
+    LastErrorAt  int64                     `json:"lastErrorAt,omitempty"`
+}
+
+type PeerStats struct {
+    sync.RWMutex
+    items        map[string]*PeerStat
+}
+
+type PeerStatus struct {
+    Address      string                    `json:"address"`
+    Self         bool                      `json:"self"`
+    Connected    bool                      `json:"connected"`
+    Reconnect    bool                      `json:"reconnect"`
+    Pending      int                       `json:"pending"`
+    Lag          int64                     `json:"lag"`
+    Records      int                       `json:"records"`
+    Exceptions   int                       `json:"exceptions"`
+    Diverged     bool                      `json:"diverged"`
+    Error        string                    `json:"error,omitempty"`
+    PeerStat
+}
+
+func (s *PeerStats) add(id string, err error) {
+    s.Lock()
+    defer s.Unlock()
+
+    stat, ok := s.items[id]
+    if !ok {
+        stat = &PeerStat{}
+        s.items[id] = stat
+    }
+
+    now := time.Now().UTC().Unix()
+
+    stat.Calls++
+    if err != nil {
+        stat.Errors++
+        stat.LastError = err.Error()
+        stat.LastErrorAt = now
+        peerCalls.WithLabelValues(id, "error").Inc()
+        return
+    }
+
+    stat.LastSuccess = now
+    peerCalls.WithLabelValues(id, "success").Inc()
+    peerLastSuccess.WithLabelValues(id).Set(float64(now))
+}
+
+func (s *PeerStats) get(id string) PeerStat {
+    s.RLock()
+    defer s.RUnlock()
+
+    if stat, ok := s.items[id]; ok {
+        return *stat
+    }
+    return PeerStat{}
+}
+
+// call makes an RPC call to a peer and counts the result
+func (api *Api) call(id string, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+    start := time.Now()
+    err := client.Call(method, args, reply)
+    peerCallDuration.WithLabelValues(id, method).Observe(time.Since(start).Seconds())
+    peerStats.add(id, err)
+    return err
+}
+
+// getStats returns record and exception counts with a hash of the digest,
+// equal hashes on two nodes mean their data is the same
+func getStats(client db.DbClient) (config.Stats, error) {
+    var stats config.Stats
+
+    digest, err := getDigest(client, config.DigestArgs{})
+    if err != nil {
+        return stats, err
+    }
+
+    records, err := client.LoadRecords(config.RecArgs{})
+    if err != nil {
+        return stats, err
+    }
+
+    exceptions, err := client.LoadExceptions(config.ExpArgs{})
+    if err != nil {
+        return stats, err
+    }
+
+    jsn, _ := json.Marshal([]map[string]string{digest.Records, digest.Exceptions})
+
+    stats.Records = len(records)
+    stats.Exceptions = len(exceptions)
+    stats.Hash = config.GetHash(string(jsn))
+
+    return stats, nil
+}
+
+// clusterStatus collects the state of every member and updates the peer metrics
+func (api *Api) clusterStatus() []PeerStatus {
+    local, err := getStats(*api.DB)
+    if err != nil {
+        log.Printf("[error] cluster status: %v", err)
+    }
+
+    ids := connections.List()
+    items := make([]PeerStatus, len(ids))
+
+    var wg sync.WaitGroup
+
+    for i, id := range ids {
+        api.Peers.RLock()
+        client, ok := api.Peers.items[id]
+        api.Peers.RUnlock()
+
+        items[i] = PeerStatus{
+            Address:   id,
+            Self:      id == api.Self,
+            Connected: ok,
+            Reconnect: connections.Flagged(id),
+            Pending:   api.Handoff.Pending(id),
+            PeerStat:  peerStats.get(id),
+        }
+
+        if oldest := api.Handoff.Oldest(id); oldest > 0 {
+            items[i].Lag = time.Now().UTC().Unix() - oldest
+        }
+
+        if !ok {
+            continue
+        }
+
+        wg.Add(1)
+
+        go func(st *PeerStatus, client *rpc.Client) {
+            defer wg.Done()
+
+            var stats config.Stats
+            if err := api.call(st.Address, client, "RPC.GetStats", "", &stats); err != nil {
+                st.Error = err.Error()
+                return
+            }
+
+            st.Records = stats.Records
+            st.Exceptions = stats.Exceptions
+            // Shards differ by design, so only replicated clusters are compared
+            st.Diverged = !ring.Enabled() && stats.Hash != local.Hash
+        }(&items[i], client)
+    }
+
+    wg.Wait()
+
+    for _, st := range items {
+        up := 0.0
+        if st.Connected && !st.Reconnect {
+            up = 1
+        }
+        diverged := 0.0
+        if st.Diverged {
+            diverged = 1
+        }
+        peerUp.WithLabelValues(st.Address).Set(up)
+        peerDiverged.WithLabelValues(st.Address).Set(diverged)
+        if st.Error == "" && st.Connected {
+            peerRecords.WithLabelValues(st.Address).Set(float64(st.Records))
+        }
+    }
+
+    return items
+}
+
+// ApiCluster refreshes the peer metrics, it is called periodically
+func (api *Api) ApiCluster() {
+    known := map[string]bool{}
+    for _, st := range api.clusterStatus() {
+        known[st.Address] = true
+    }
+
+    // Forget the series of removed members
+    peerStats.Lock()
+    for id := range peerStats.items {
+        if !known[id] {
+            delete(peerStats.items, id)
+            peerUp.DeleteLabelValues(id)
+            peerDiverged.DeleteLabelValues(id)
+            peerRecords.DeleteLabelValues(id)
+            peerLastSuccess.DeleteLabelValues(id)
+            peerCalls.DeleteLabelValues(id, "success")
+            peerCalls.DeleteLabelValues(id, "error")
+            peerCallDuration.DeletePartialMatch(prometheus.Labels{"peer": id})
+        }
+    }
+    peerStats.Unlock()
+
+    countRecords(*api.DB)
+}
+
+func (api *Api) ApiClusterStatus(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    var data []interface{}
+    for _, item := range api.clusterStatus() {
+        data = append(data, item)
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:data}))
+}
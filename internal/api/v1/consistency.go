@@ -0,0 +1,190 @@
+package v1
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "net/rpc"
+    "net/http"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+const (
+    levelOne     = "one"
+    levelQuorum  = "quorum"
+    levelAll     = "all"
+)
+
+// required returns the number of acknowledgements a level needs out of n peers
+func required(level string, n int) int {
+    switch level {
+        case levelAll:
+            return n
+        case levelQuorum:
+            return n / 2 + 1
+    }
+    if n == 0 {
+        return 0
+    }
+    return 1
+}
+
+// consistencyLevel reads the consistency parameter of a request, def is used when it is not set
+func consistencyLevel(r *http.Request, def string) (string, error) {
+    level := r.URL.Query().Get("consistency")
+    if level == "" {
+        level = def
+    }
+    switch level {
+        case "":
+            return levelOne, nil
+        case levelOne, levelQuorum, levelAll:
+            return level, nil
+    }
+    return level, fmt.Errorf("executing query: invalid parameter: consistency")
+}
+
+// peerErrors formats errors as "peer: error" sorted by peer
+func peerErrors(items map[string]error) []string {
+    var list []string
+    for id, err := range items {
+        list = append(list, id + ": " + err.Error())
+    }
+    sort.Strings(list)
+    return list
+}
+
+type writeResult struct {
+    id           string
+    err          error
+}
+
+// writePeers sends records to their owners and waits until every owner set
+// has the acknowledgements the level needs, or until all calls returned.
+// Calls still in flight finish in the background and use hinted handoff.
+// It returns the peer errors seen so far and whether the level was met.
+func (api *Api) writePeers(method string, records []config.SockTable, level string) (map[string]error, bool) {
+    shards := ring.shard(records)
+
+    // Every distinct owner set has to be acknowledged on its own
+    groups := map[string][]string{}
+    if shards == nil {
+        ids := connections.List()
+        groups[strings.Join(ids, ",")] = ids
+    } else {
+        for _, rec := range records {
+            ids := ring.Owners(rec)
+            groups[strings.Join(ids, ",")] = ids
+        }
+    }
+
+    errs := map[string]error{}
+    acks := map[string]bool{}
+
+    met := func() bool {
+        for _, ids := range groups {
+            n := 0
+            for _, id := range ids {
+                if acks[id] {
+                    n++
+                }
+            }
+            if n < required(level, len(ids)) {
+                return false
+            }
+        }
+        return true
+    }
+
+    var results chan writeResult
+    calls := 0
+
+    api.Peers.RLock()
+    results = make(chan writeResult, len(api.Peers.items))
+    for _, ids := range groups {
+        for _, id := range ids {
+            if _, ok := api.Peers.items[id]; !ok {
+                errs[id] = fmt.Errorf("peer is not connected")
+            }
+        }
+    }
+    for id, client := range api.Peers.items {
+
+        items := shards.get(id, records)
+        if len(items) == 0 {
+            continue
+        }
+
+        calls++
+
+        go func(id string, client *rpc.Client) {
+            err := api.callPeer(id, client, method, items)
+            if err != nil {
+                log.Printf("[error] %v - %s %s", err, id, method)
+            }
+            results <- writeResult{id: id, err: err}
+        }(id, client)
+
+    }
+    api.Peers.RUnlock()
+
+    for i := 0; i < calls; i++ {
+        if met() {
+            return errs, true
+        }
+        res := <- results
+        if res.err != nil {
+            errs[res.id] = res.err
+            continue
+        }
+        acks[res.id] = true
+    }
+
+    return errs, met()
+}
+
+// writeAll makes the same call to every member, unconnected members count as failed
+func (api *Api) writeAll(method string, args interface{}, level string) (map[string]error, bool) {
+    members := connections.List()
+    errs := api.callPeers(method, args)
+
+    api.Peers.RLock()
+    for _, id := range members {
+        if _, ok := api.Peers.items[id]; !ok {
+            errs[id] = fmt.Errorf("peer is not connected")
+        }
+    }
+    api.Peers.RUnlock()
+
+    return errs, len(members) - len(errs) >= required(level, len(members))
+}
+
+// writeResponse sends a write result, 503 with the peer errors when the level was not met
+func writeResponse(w http.ResponseWriter, level string, errs map[string]error, ok bool) {
+    if !ok {
+        w.WriteHeader(503)
+        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("consistency level %v not met", level), Warnings:peerErrors(errs)}))
+        return
+    }
+    w.WriteHeader(204)
+}
+
+// readPeers loads records from the members that store them and merges them
+// by Timestamp, it fails when fewer peers than the level needs answered.
+// A sharded read of all members also fails once every owner of some records
+// could be missing, whatever the level.
+func (api *Api) readPeers(args config.RecArgs, level string) ([]config.SockTable, map[string]error, bool) {
+    ids, named := ring.NameOwners(args.SrcName)
+    if !named {
+        ids = connections.List()
+    }
+
+    items, errs := api.gatherRecords(args, ids)
+
+    ok := len(ids) - len(errs) >= required(level, len(ids))
+    if !named && ring.Enabled() && len(errs) > 0 && len(errs) >= ring.Replicas(len(ids)) {
+        ok = false
+    }
+    return items, errs, ok
+}
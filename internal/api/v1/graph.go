@@ -0,0 +1,278 @@
+package v1
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "net/http"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/graph"
+)
+
+// graphQuery reads the graph parameters of a request and loads the records,
+// on failure it writes the error response and returns false
+func (api *Api) graphQuery(w http.ResponseWriter, r *http.Request, depth int) (*graph.Graph, graph.Filter, bool) {
+    var args config.RecArgs
+    filter := graph.Filter{Depth: depth}
+
+    for k, v := range r.URL.Query() {
+        switch k {
+            case "host":
+                filter.Host = v[0]
+            case "status":
+                filter.Status = strings.Split(v[0], ",")
+            case "depth":
+                i, err := strconv.Atoi(v[0])
+                if err != nil {
+                    w.WriteHeader(400)
+                    w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("executing query: invalid parameter: %v", k)}))
+                    return nil, filter, false
+                }
+                filter.Depth = i
+        }
+    }
+
+    account, err := accountParam(r)
+    if err != nil {
+        w.WriteHeader(accountCode(err))
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return nil, filter, false
+    }
+    args.AccountID = account
+
+    level, err := consistencyLevel(r, api.Conf.Cluster.ReadLevel)
+    if err != nil {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return nil, filter, false
+    }
+
+    items, errs, ok, err := api.loadRecords(args, level)
+    if err != nil {
+        log.Printf("[error] %v - %s", err, r.URL.Path)
+        w.WriteHeader(500)
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return nil, filter, false
+    }
+    if !ok {
+        w.WriteHeader(503)
+        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("consistency level %v not met", level), Warnings:peerErrors(errs)}))
+        return nil, filter, false
+    }
+
+    return graph.New(items), filter, true
+}
+
+func (api *Api) ApiGraph(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    g, filter, ok := api.graphQuery(w, r, 1)
+    if !ok {
+        return
+    }
+
+    format := r.URL.Query().Get("format")
+    if format == "" || format == "json" {
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Data:[]interface{}{g.Filter(filter)}}))
+        return
+    }
+
+    text, err := graph.Render(g.Filter(filter), format, r.URL.Query().Get("cluster"))
+    if err != nil {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.WriteHeader(200)
+    w.Write([]byte(text))
+}
+
+// graphHost resolves a host parameter, on failure it writes the error response
+func graphHost(w http.ResponseWriter, g *graph.Graph, name, value string) (string, uint16, bool) {
+    if value == "" {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("parameter missing %v", name)}))
+        return "", 0, false
+    }
+
+    host, port := graph.ParseHost(value)
+
+    id, err := g.Resolve(host)
+    if err != nil {
+        w.WriteHeader(404)
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return "", 0, false
+    }
+
+    return id, port, true
+}
+
+func (api *Api) ApiGraphDependencies(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    direction := r.URL.Query().Get("direction")
+    switch direction {
+        case "":
+            direction = graph.Downstream
+        case graph.Downstream, graph.Upstream:
+        default:
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: direction"}))
+            return
+    }
+
+    g, filter, ok := api.graphQuery(w, r, -1)
+    if !ok {
+        return
+    }
+    g = g.Filter(graph.Filter{Status: filter.Status})
+
+    host, port, ok := graphHost(w, g, "host", filter.Host)
+    if !ok {
+        return
+    }
+
+    var data []interface{}
+    for _, item := range g.Dependencies(host, port, direction, filter.Depth) {
+        data = append(data, item)
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:data}))
+}
+
+func (api *Api) ApiGraphPaths(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    all := false
+    if v := r.URL.Query().Get("all"); v != "" {
+        var err error
+        if all, err = strconv.ParseBool(v); err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: all"}))
+            return
+        }
+    }
+
+    g, filter, ok := api.graphQuery(w, r, -1)
+    if !ok {
+        return
+    }
+    g = g.Filter(graph.Filter{Status: filter.Status})
+
+    from, _, ok := graphHost(w, g, "from", r.URL.Query().Get("from"))
+    if !ok {
+        return
+    }
+    to, _, ok := graphHost(w, g, "to", r.URL.Query().Get("to"))
+    if !ok {
+        return
+    }
+
+    var paths []graph.Path
+    if all {
+        // The search of all paths is bounded unless a depth is given
+        if filter.Depth < 0 {
+            filter.Depth = 10
+        }
+        paths = g.AllPaths(from, to, filter.Depth)
+    } else {
+        paths = g.ShortestPath(from, to, filter.Depth)
+    }
+
+    var data []interface{}
+    for _, item := range paths {
+        data = append(data, item)
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:data}))
+}
+
+func (api *Api) ApiGraphImpact(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    g, filter, ok := api.graphQuery(w, r, -1)
+    if !ok {
+        return
+    }
+
+    var data []interface{}
+    for _, item := range g.Impacts(filter.Depth) {
+        data = append(data, item)
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:data}))
+}
+
+func (api *Api) ApiGraphAnalysis(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    top := 0
+    if v := r.URL.Query().Get("top"); v != "" {
+        var err error
+        if top, err = strconv.Atoi(v); err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: top"}))
+            return
+        }
+    }
+
+    g, filter, ok := api.graphQuery(w, r, -1)
+    if !ok {
+        return
+    }
+
+    analysis := g.Filter(filter).Analyze(top)
+
+    switch r.URL.Query().Get("format") {
+        case "", "json":
+        case "text":
+            w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+            w.WriteHeader(200)
+            w.Write([]byte(analysis.Report()))
+            return
+        default:
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: format"}))
+            return
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:[]interface{}{analysis}}))
+}
@@ -0,0 +1,342 @@
+package v1
+
+import (
+    "os"
+    "log"
+    "fmt"
+    "sync"
+    "time"
+    "bufio"
+    "bytes"
+    "strings"
+    "net/rpc"
+    "path/filepath"
+    "encoding/json"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+var (
+    handoffQueued = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "handoff_queued_total",
+            Help:      "Peer calls stored for hinted handoff",
+        },
+        []string{"peer"},
+    )
+
+    handoffReplayed = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "handoff_replayed_total",
+            Help:      "Stored peer calls replayed after the connection was restored",
+        },
+        []string{"peer"},
+    )
+
+    handoffDropped = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "handoff_dropped_total",
+            Help:      "Stored peer calls dropped because the per-peer limit was reached",
+        },
+        []string{"peer"},
+    )
+
+    handoffPending = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "handoff_pending",
+            Help:      "Peer calls waiting for replay",
+        },
+        []string{"peer"},
+    )
+)
+
+// Hint is a peer call that failed and waits for replay
+type Hint struct {
+    Method       string                    `json:"method"`
+    Args         json.RawMessage           `json:"args"`
+    Timestamp    int64                     `json:"timestamp"`
+}
+
+// Handoff keeps a bounded queue of failed calls per peer, optionally
+// mirrored to <dir>/<peer>.jsonl so that hints survive a restart
+type Handoff struct {
+    sync.Mutex
+    dir          string
+    limit        int
+    items        map[string][]Hint
+    replaying    map[string]bool
+}
+
+func NewHandoff(conf *config.Cluster) (*Handoff, error) {
+    h := &Handoff{
+        dir:       conf.HandoffDir,
+        limit:     conf.HandoffLimit,
+        items:     make(map[string][]Hint),
+        replaying: make(map[string]bool),
+    }
+
+    if h.limit == 0 {
+        h.limit = 10000
+    }
+
+    if h.dir == "" {
+        return h, nil
+    }
+
+    if err := os.MkdirAll(h.dir, 0755); err != nil {
+        return h, err
+    }
+
+    files, err := filepath.Glob(filepath.Join(h.dir, "*.jsonl"))
+    if err != nil {
+        return h, err
+    }
+
+    for _, file := range files {
+        peer := strings.Replace(strings.TrimSuffix(filepath.Base(file), ".jsonl"), "_", ":", -1)
+        hints, err := readHints(file)
+        if err != nil {
+            return h, err
+        }
+        if len(hints) > h.limit {
+            handoffDropped.WithLabelValues(peer).Add(float64(len(hints) - h.limit))
+            hints = hints[len(hints)-h.limit:]
+        }
+        h.items[peer] = hints
+        handoffPending.WithLabelValues(peer).Set(float64(len(hints)))
+        log.Printf("[info] handoff: loaded hints for %s (%d)", peer, len(hints))
+    }
+
+    return h, nil
+}
+
+func readHints(file string) ([]Hint, error) {
+    var hints []Hint
+
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+    for scanner.Scan() {
+        var hint Hint
+        if err := json.Unmarshal(scanner.Bytes(), &hint); err != nil {
+            log.Printf("[error] handoff: %v - %s", err, file)
+            continue
+        }
+        hints = append(hints, hint)
+    }
+
+    return hints, scanner.Err()
+}
+
+func (h *Handoff) file(peer string) string {
+    return filepath.Join(h.dir, strings.Replace(peer, ":", "_", -1) + ".jsonl")
+}
+
+// store rewrites the file of a peer with the hints currently in memory
+func (h *Handoff) store(peer string) {
+    if h.dir == "" {
+        return
+    }
+
+    file := h.file(peer)
+    if len(h.items[peer]) == 0 {
+        if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+            log.Printf("[error] handoff: %v", err)
+        }
+        return
+    }
+
+    tmp := file + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        log.Printf("[error] handoff: %v", err)
+        return
+    }
+
+    w := bufio.NewWriter(f)
+    for _, hint := range h.items[peer] {
+        jsn, _ := json.Marshal(hint)
+        w.Write(jsn)
+        w.WriteByte('\n')
+    }
+    if err := w.Flush(); err != nil {
+        log.Printf("[error] handoff: %v", err)
+    }
+    f.Close()
+
+    if err := os.Rename(tmp, file); err != nil {
+        log.Printf("[error] handoff: %v", err)
+    }
+}
+
+// append adds a single line to the file of a peer
+func (h *Handoff) append(peer string, hint Hint) {
+    if h.dir == "" {
+        return
+    }
+
+    f, err := os.OpenFile(h.file(peer), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        log.Printf("[error] handoff: %v", err)
+        return
+    }
+    defer f.Close()
+
+    jsn, _ := json.Marshal(hint)
+    f.Write(append(jsn, '\n'))
+}
+
+// Pending returns the number of calls waiting for a peer
+func (h *Handoff) Pending(peer string) int {
+    h.Lock()
+    defer h.Unlock()
+
+    return len(h.items[peer])
+}
+
+// Oldest returns the timestamp of the oldest call waiting for a peer, or zero
+func (h *Handoff) Oldest(peer string) int64 {
+    h.Lock()
+    defer h.Unlock()
+
+    if len(h.items[peer]) == 0 {
+        return 0
+    }
+    return h.items[peer][0].Timestamp
+}
+
+// Push stores a failed call, the oldest tenth of the queue is dropped when the limit is reached
+func (h *Handoff) Push(peer, method string, args interface{}) {
+    jsn, err := json.Marshal(args)
+    if err != nil {
+        log.Printf("[error] handoff: %v", err)
+        return
+    }
+
+    h.Lock()
+    defer h.Unlock()
+
+    hint := Hint{Method: method, Args: jsn, Timestamp: time.Now().UTC().Unix()}
+
+    if len(h.items[peer]) >= h.limit {
+        drop := h.limit / 10 + 1
+        if drop > len(h.items[peer]) {
+            drop = len(h.items[peer])
+        }
+        h.items[peer] = h.items[peer][drop:]
+        handoffDropped.WithLabelValues(peer).Add(float64(drop))
+        log.Printf("[error] handoff: limit reached for %s, dropped oldest (%d)", peer, drop)
+        h.items[peer] = append(h.items[peer], hint)
+        h.store(peer)
+    } else {
+        h.items[peer] = append(h.items[peer], hint)
+        h.append(peer, hint)
+    }
+
+    handoffQueued.WithLabelValues(peer).Inc()
+    handoffPending.WithLabelValues(peer).Set(float64(len(h.items[peer])))
+}
+
+func sameHint(a, b Hint) bool {
+    return a.Method == b.Method && a.Timestamp == b.Timestamp && bytes.Equal(a.Args, b.Args)
+}
+
+func hintArgs(hint Hint) (interface{}, error) {
+    switch hint.Method {
+        case "RPC.SetStatus", "RPC.SetNetstat", "RPC.SetTracert", "RPC.SetRecords":
+            var args []config.SockTable
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+        case "RPC.SetExceptions":
+            var args []config.Exception
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+        case "RPC.SetTokens":
+            var args []config.Token
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+        case "RPC.SetMaintenance":
+            var args []config.Maintenance
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+        case "RPC.PatchRecords":
+            var args config.PatchArgs
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+        case "RPC.DelRecords", "RPC.DelExceptions", "RPC.DelTokens", "RPC.DelMaintenance":
+            var args []string
+            err := json.Unmarshal(hint.Args, &args)
+            return args, err
+    }
+    return nil, fmt.Errorf("unknown handoff method: %v", hint.Method)
+}
+
+// Replay sends stored calls to the peer in order. It stops at the first
+// failed call and keeps it, so the order is preserved for the next attempt.
+func (h *Handoff) Replay(peer string, client *rpc.Client) error {
+    h.Lock()
+    if h.replaying[peer] {
+        h.Unlock()
+        return nil
+    }
+    h.replaying[peer] = true
+    h.Unlock()
+
+    replayed := 0
+
+    defer func() {
+        h.Lock()
+        h.replaying[peer] = false
+        if replayed > 0 {
+            h.store(peer)
+        }
+        handoffPending.WithLabelValues(peer).Set(float64(len(h.items[peer])))
+        h.Unlock()
+        if replayed > 0 {
+            log.Printf("[info] handoff: replayed hints for %s (%d)", peer, replayed)
+        }
+    }()
+
+    for {
+        h.Lock()
+        if len(h.items[peer]) == 0 {
+            h.Unlock()
+            return nil
+        }
+        hint := h.items[peer][0]
+        h.Unlock()
+
+        args, err := hintArgs(hint)
+        if err == nil {
+            err = client.Call(hint.Method, args, nil)
+            if _, ok := err.(rpc.ServerError); ok {
+                // The peer refused the call, sending it again will not help
+                log.Printf("[error] handoff: %v - %s %s", err, peer, hint.Method)
+                handoffDropped.WithLabelValues(peer).Inc()
+            } else if err != nil {
+                return err
+            } else {
+                handoffReplayed.WithLabelValues(peer).Inc()
+            }
+        } else {
+            log.Printf("[error] handoff: %v", err)
+        }
+
+        h.Lock()
+        // The head may have been dropped by Push while the call was in flight
+        if len(h.items[peer]) > 0 && sameHint(h.items[peer][0], hint) {
+            h.items[peer] = h.items[peer][1:]
+        }
+        h.Unlock()
+        replayed++
+    }
+}
@@ -0,0 +1,240 @@
+package v1
+
+import (
+    "log"
+    "fmt"
+    "sync"
+    "time"
+    "strconv"
+    "net/rpc"
+    "net/http"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+type History struct {
+    Id           string                    `json:"id"`
+    SrcName      string                    `json:"srcName"`
+    DstName      string                    `json:"dstName"`
+    Mode         string                    `json:"mode"`
+    Port         uint16                    `json:"port"`
+    Result       int                       `json:"result"`
+    Start        int64                     `json:"start"`
+    End          int64                     `json:"end"`
+    Availability float64                   `json:"availability"`
+    Downtime     int64                     `json:"downtime"`
+    Transitions  []config.StatusEvent      `json:"transitions"`
+}
+
+// getHistory computes the time spent with a non-zero result inside [start, end],
+// the state before the first transition is taken from its OldResult
+func getHistory(rec config.SockTable, events []config.StatusEvent, start, end int64) History {
+    hist := History{
+        Id:          rec.Id,
+        SrcName:     rec.LocalAddr.Name,
+        DstName:     rec.RemoteAddr.Name,
+        Mode:        rec.Relation.Mode,
+        Port:        rec.Relation.Port,
+        Result:      rec.Relation.Result,
+        Start:       start,
+        End:         end,
+        Transitions: events,
+    }
+
+    if hist.Transitions == nil {
+        hist.Transitions = make([]config.StatusEvent, 0)
+    }
+
+    result := rec.Relation.Result
+    if len(events) > 0 {
+        result = events[0].OldResult
+    }
+
+    from := start
+    for _, event := range events {
+        if result != 0 {
+            hist.Downtime += event.Timestamp - from
+        }
+        result = event.NewResult
+        from = event.Timestamp
+    }
+    if result != 0 {
+        hist.Downtime += end - from
+    }
+
+    hist.Availability = 100
+    if end > start {
+        hist.Availability = float64(end - start - hist.Downtime) * 100 / float64(end - start)
+    }
+
+    return hist
+}
+
+// loadHistory returns the transitions of the records. With sharding they are
+// kept by the owners of a record only, so they are gathered from the peers,
+// and as every owner times them itself the longest list of a record wins.
+func (api *Api) loadHistory(args config.HistArgs) ([]config.StatusEvent, map[string]error, error) {
+    if !ring.Enabled() {
+        items, err := db.DbClient.LoadHistory(*api.DB, args)
+        return items, nil, err
+    }
+
+    ids, ok := ring.NameOwners(args.SrcName)
+    if !ok {
+        ids = connections.List()
+    }
+
+    var mu sync.Mutex
+    lists := map[string][]config.StatusEvent{}
+    er := Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for _, id := range ids {
+        if _, ok := api.Peers.items[id]; !ok {
+            er.items[id] = fmt.Errorf("peer is not connected")
+        }
+    }
+    for id, client := range api.Peers.items {
+
+        if !contains(ids, id) {
+            continue
+        }
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            var items []config.StatusEvent
+            if err := api.call(id, client, "RPC.GetHistory", args, &items); err != nil {
+                log.Printf("[error] %v - %s RPC.GetHistory", err, id)
+                er.Lock()
+                er.items[id] = err
+                er.Unlock()
+                return
+            }
+
+            peer := map[string][]config.StatusEvent{}
+            for _, item := range items {
+                peer[item.RecordId] = append(peer[item.RecordId], item)
+            }
+
+            mu.Lock()
+            defer mu.Unlock()
+
+            for rid, list := range peer {
+                if len(list) > len(lists[rid]) {
+                    lists[rid] = list
+                }
+            }
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    var items []config.StatusEvent
+    for _, list := range lists {
+        items = append(items, list...)
+    }
+
+    return items, er.items, nil
+}
+
+func (api *Api) ApiRecordsHistory(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method == "GET" {
+
+        end := time.Now().UTC().Unix()
+        start := end - 86400
+
+        var args config.RecArgs
+
+        for k, v := range r.URL.Query() {
+            switch k {
+                case "id":
+                    args.Id = v[0]
+                case "src_name":
+                    args.SrcName = v[0]
+                case "start", "end":
+                    i, err := strconv.ParseInt(v[0], 10, 64)
+                    if err != nil {
+                        w.WriteHeader(400)
+                        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("executing query: invalid parameter: %v", k)}))
+                        return
+                    }
+                    if k == "start" {
+                        start = i
+                    } else {
+                        end = i
+                    }
+            }
+        }
+
+        account, err := accountParam(r)
+        if err != nil {
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+        args.AccountID = account
+
+        if start > end {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: start is after end"}))
+            return
+        }
+
+        level, err := consistencyLevel(r, api.Conf.Cluster.ReadLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        // With sharding the records may be stored on other nodes only
+        items, errs, ok, err := api.loadRecords(args, level)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+        if !ok {
+            w.WriteHeader(503)
+            w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("consistency level %v not met", level), Warnings:peerErrors(errs)}))
+            return
+        }
+
+        events, herrs, err := api.loadHistory(config.HistArgs{Id: args.Id, SrcName: args.SrcName, Start: start, End: end})
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        transitions := map[string][]config.StatusEvent{}
+        for _, event := range events {
+            transitions[event.RecordId] = append(transitions[event.RecordId], event)
+        }
+
+        var records []interface{}
+        for _, item := range items {
+            if args.Id != "" && item.Id != args.Id {
+                continue
+            }
+            records = append(records, getHistory(item, transitions[item.Id], start, end))
+        }
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(herrs), Data:records}))
+        return
+    }
+
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
@@ -0,0 +1,263 @@
+package v1
+
+import (
+    "log"
+    "sync"
+    "time"
+    "math/rand"
+    "net/rpc"
+    "net/http"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+var (
+    leaderGauge = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "leader",
+            Help:      "Whether this node holds the cluster leader lease",
+        },
+    )
+
+    leaderEpoch = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "leader_epoch",
+            Help:      "Epoch of the current leader lease",
+        },
+    )
+
+    leases = &Leases{}
+)
+
+// Leases is the view of a node on the leader lease. A member grants the lease
+// when the one it holds has expired or belongs to the candidate, so within a
+// lease period at most one candidate collects grants from a majority. Every
+// new lease takes the next epoch, renewals keep it.
+type Leases struct {
+    sync.RWMutex
+    lease        config.Lease
+    epoch        uint64
+    leading      bool
+    until        time.Time
+}
+
+type LeaderStatus struct {
+    Leader       string                    `json:"leader"`
+    Epoch        uint64                    `json:"epoch"`
+    Expires      int64                     `json:"expires"`
+    Self         bool                      `json:"self"`
+}
+
+func nowMillis() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// grant handles a lease request of a candidate, requests older than the
+// granted lease are refused so that a paused former leader can not renew
+func (l *Leases) grant(args config.LeaseArgs) config.Lease {
+    l.Lock()
+    defer l.Unlock()
+
+    if args.Epoch > l.epoch {
+        l.epoch = args.Epoch
+    }
+
+    if args.Epoch < l.lease.Epoch || (l.lease.Expires > nowMillis() && l.lease.Leader != args.Candidate) {
+        lease := l.lease
+        lease.Epoch = l.epoch
+        lease.Granted = false
+        return lease
+    }
+
+    l.lease = config.Lease{
+        Leader:  args.Candidate,
+        Epoch:   args.Epoch,
+        Expires: nowMillis() + args.Duration,
+        Granted: true,
+    }
+    if args.Candidate != connections.self {
+        l.leading = false
+    }
+
+    return l.lease
+}
+
+func (l *Leases) get() config.Lease {
+    l.RLock()
+    defer l.RUnlock()
+
+    return l.lease
+}
+
+// observe keeps the highest epoch seen in replies so the next lease goes beyond it
+func (l *Leases) observe(lease config.Lease) {
+    l.Lock()
+    defer l.Unlock()
+
+    if lease.Epoch > l.epoch {
+        l.epoch = lease.Epoch
+    }
+}
+
+// IsLeader reports whether this node holds a valid leader lease
+func (api *Api) IsLeader() bool {
+    leases.RLock()
+    defer leases.RUnlock()
+
+    return leases.leading && time.Now().Before(leases.until)
+}
+
+func (api *Api) leaseDuration() time.Duration {
+    if d, err := time.ParseDuration(api.Conf.Cluster.LeaseDuration); err == nil && d > 0 {
+        return d
+    }
+    return 15 * time.Second
+}
+
+// requestLease asks every member for the lease and reports whether a majority granted it
+func (api *Api) requestLease(epoch uint64, duration time.Duration) bool {
+    args := config.LeaseArgs{
+        Candidate: api.Self,
+        Epoch:     epoch,
+        Duration:  int64(duration / time.Millisecond),
+    }
+
+    members := connections.List()
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    granted := 0
+
+    api.Peers.RLock()
+    for id, client := range api.Peers.items {
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            var reply config.Lease
+            if err := api.call(id, client, "RPC.RequestLease", args, &reply); err != nil {
+                return
+            }
+
+            if !reply.Granted {
+                leases.observe(reply)
+                return
+            }
+
+            mu.Lock()
+            granted++
+            mu.Unlock()
+
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    return granted >= required(levelQuorum, len(members))
+}
+
+// ApiLeader campaigns for the leader lease and renews it while holding it
+func (api *Api) ApiLeader() {
+    duration := api.leaseDuration()
+    tick := duration / 3
+
+    for {
+        if api.Self == "" || !connections.Has(api.Self) {
+            time.Sleep(tick)
+            continue
+        }
+
+        lease := leases.get()
+
+        if api.IsLeader() || lease.Expires <= nowMillis() {
+            epoch := lease.Epoch
+            if !api.IsLeader() {
+                // Spread out campaigns of nodes that saw the lease expire together
+                time.Sleep(time.Duration(rand.Int63n(int64(tick))))
+                if leases.get().Expires > nowMillis() {
+                    continue
+                }
+                leases.RLock()
+                epoch = leases.epoch + 1
+                leases.RUnlock()
+            }
+
+            start := time.Now()
+            ok := api.requestLease(epoch, duration)
+
+            leases.Lock()
+            was := leases.leading
+            leases.leading = ok && leases.lease.Epoch == epoch && leases.lease.Leader == api.Self
+            if leases.leading {
+                leases.until = start.Add(duration)
+            } else if leases.lease.Leader == api.Self {
+                // Give up the own grant so that other candidates can win
+                leases.lease.Expires = 0
+            }
+            is := leases.leading
+            leases.Unlock()
+
+            if is && !was {
+                log.Printf("[info] leader: acquired lease, epoch %d", epoch)
+            }
+            if was && !is {
+                log.Printf("[info] leader: lost lease, epoch %d", epoch)
+            }
+        }
+
+        if api.IsLeader() {
+            leaderGauge.Set(1)
+        } else {
+            leaderGauge.Set(0)
+        }
+        leaderEpoch.Set(float64(leases.get().Epoch))
+
+        time.Sleep(tick)
+    }
+}
+
+// LeaderJob runs fn every interval on the node that holds the leader lease,
+// a node that takes over runs the job as soon as it becomes the leader
+func (api *Api) LeaderJob(name string, interval time.Duration, fn func()) {
+    go func() {
+        var last time.Time
+        for {
+            if api.IsLeader() && time.Since(last) >= interval {
+                last = time.Now()
+                log.Printf("[info] leader: running job %v", name)
+                fn()
+            }
+            time.Sleep(5 * time.Second)
+        }
+    }()
+}
+
+func (api *Api) ApiClusterLeader(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    lease := leases.get()
+    if lease.Expires <= nowMillis() {
+        lease.Leader = ""
+    }
+
+    data := LeaderStatus{
+        Leader:  lease.Leader,
+        Epoch:   lease.Epoch,
+        Expires: lease.Expires,
+        Self:    api.IsLeader(),
+    }
+
+    w.WriteHeader(200)
+    w.Write(encodeResp(&Resp{Status:"success", Data:[]interface{}{data}}))
+}
@@ -0,0 +1,370 @@
+package v1
+
+import (
+    "io"
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "net/http"
+    "io/ioutil"
+    "compress/gzip"
+    "encoding/json"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+    "github.com/ltkh/netmap/internal/maintenance"
+)
+
+var (
+    maintenances = &Maintenances{items: make(map[string]*maintenance.Window)}
+)
+
+// Maintenances holds the maintenance windows, the windows in effect
+// are worked out once a minute
+type Maintenances struct {
+    sync.RWMutex
+    items        map[string]*maintenance.Window
+    minute       int64
+    active       []activeWindow
+    // Changed windows drop the windows in effect
+    version      int
+}
+
+type activeWindow struct {
+    window       *maintenance.Window
+    end          int64
+}
+
+func (m *Maintenances) set(items []config.Maintenance) {
+    m.Lock()
+    defer m.Unlock()
+
+    for _, item := range items {
+        w, err := maintenance.Compile(item)
+        if err != nil {
+            log.Printf("[error] maintenance %v: %v", item.Id, err)
+            continue
+        }
+        m.items[item.Id] = w
+    }
+    m.active = nil
+    m.minute = 0
+    m.version++
+}
+
+func (m *Maintenances) del(ids []string) {
+    m.Lock()
+    defer m.Unlock()
+
+    for _, id := range ids {
+        delete(m.items, id)
+    }
+    m.active = nil
+    m.minute = 0
+    m.version++
+}
+
+func (m *Maintenances) list() []*maintenance.Window {
+    m.RLock()
+    defer m.RUnlock()
+
+    items := make([]*maintenance.Window, 0, len(m.items))
+    for _, w := range m.items {
+        items = append(items, w)
+    }
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Name < items[j].Name
+    })
+    return items
+}
+
+// current returns the windows in effect
+func (m *Maintenances) current() []activeWindow {
+    now := time.Now().UTC()
+    minute := now.Unix() / 60
+
+    m.RLock()
+    if m.minute == minute {
+        active := m.active
+        m.RUnlock()
+        return active
+    }
+    version := m.version
+    m.RUnlock()
+
+    var active []activeWindow
+    for _, w := range m.list() {
+        if end, ok := w.Active(now); ok {
+            active = append(active, activeWindow{window: w, end: end})
+        }
+    }
+
+    m.Lock()
+    if m.version == version {
+        m.active = active
+        m.minute = minute
+    }
+    m.Unlock()
+
+    return active
+}
+
+// windows returns the windows in effect for a record
+func (m *Maintenances) windows(rec config.SockTable) []config.ActiveMaintenance {
+    var items []config.ActiveMaintenance
+    for _, a := range m.current() {
+        if a.window.Match(rec) {
+            items = append(items, a.window.Entry(a.end))
+        }
+    }
+    return items
+}
+
+// suppressed reports whether a window in effect suppresses the kind for a record
+func (m *Maintenances) suppressed(rec config.SockTable, kind string) bool {
+    for _, a := range m.current() {
+        if a.window.Suppresses(kind) && a.window.Match(rec) {
+            return true
+        }
+    }
+    return false
+}
+
+// checked leaves out the status updates of records whose checks are suppressed,
+// found holds the stored records
+func checked(found map[string]config.SockTable, items []config.SockTable) []config.SockTable {
+    if len(maintenances.current()) == 0 {
+        return items
+    }
+
+    var checked []config.SockTable
+    for _, item := range items {
+        rec, ok := found[item.Id]
+        if !ok {
+            rec = item
+        }
+        if maintenances.suppressed(rec, maintenance.SuppressChecks) {
+            continue
+        }
+        checked = append(checked, item)
+    }
+    return checked
+}
+
+// notified leaves out the webhook alerts of relations whose notifications are
+// suppressed, bodies that are not a list of alerts are sent as they are
+func notified(body []byte) ([]byte, int) {
+    if len(maintenances.current()) == 0 {
+        return body, 0
+    }
+
+    var items []json.RawMessage
+    if err := json.Unmarshal(body, &items); err != nil {
+        return body, 0
+    }
+
+    var kept []json.RawMessage
+    for _, item := range items {
+        var alert struct {
+            Labels   map[string]string  `json:"labels"`
+        }
+        if err := json.Unmarshal(item, &alert); err == nil && len(alert.Labels) > 0 {
+            if maintenances.suppressed(maintenance.FromLabels(alert.Labels), maintenance.SuppressNotifications) {
+                continue
+            }
+        }
+        kept = append(kept, item)
+    }
+
+    if len(kept) == 0 {
+        return nil, len(items)
+    }
+
+    jsn, err := json.Marshal(kept)
+    if err != nil {
+        return body, 0
+    }
+    return jsn, len(items) - len(kept)
+}
+
+func loadMaintenance(client db.DbClient) error {
+    items, err := client.LoadMaintenance()
+    if err != nil {
+        return err
+    }
+    maintenances.set(items)
+    return nil
+}
+
+// hasAccount reports whether a window can target records of the account
+func hasAccount(w *maintenance.Window, account string) bool {
+    if account == "" || len(w.Accounts) == 0 {
+        return true
+    }
+    for _, id := range w.Accounts {
+        if strconv.FormatUint(uint64(id), 10) == account {
+            return true
+        }
+    }
+    return false
+}
+
+func (api *Api) ApiMaintenance(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method == "GET" {
+        active := false
+        if v := r.URL.Query().Get("active"); v != "" {
+            b, err := strconv.ParseBool(v)
+            if err != nil {
+                w.WriteHeader(400)
+                w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: active"}))
+                return
+            }
+            active = b
+        }
+
+        account, err := accountParam(r)
+        if err != nil {
+            w.WriteHeader(accountCode(err))
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        running := map[string]bool{}
+        for _, a := range maintenances.current() {
+            running[a.window.Id] = true
+        }
+
+        var items []interface{}
+        for _, win := range maintenances.list() {
+            if active && !running[win.Id] {
+                continue
+            }
+            if !hasAccount(win, account) {
+                continue
+            }
+            items = append(items, win.Maintenance)
+        }
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Data:items}))
+        return
+    }
+
+    if r.Method == "POST" || r.Method == "DELETE" {
+        var reader io.ReadCloser
+        var err error
+
+        // Check that the server actual sent compressed data
+        switch r.Header.Get("Content-Encoding") {
+            case "gzip":
+                reader, err = gzip.NewReader(r.Body)
+                if err != nil {
+                    log.Printf("[error] %v - %s", err, r.URL.Path)
+                    w.WriteHeader(400)
+                    w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                    return
+                }
+                defer reader.Close()
+            default:
+                reader = r.Body
+        }
+        defer r.Body.Close()
+
+        body, err := ioutil.ReadAll(reader)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        level, err := consistencyLevel(r, api.Conf.Cluster.WriteLevel)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        if r.Method == "DELETE" {
+            var ids []string
+
+            if err := json.Unmarshal(body, &ids); err != nil {
+                log.Printf("[error] %v - %s", err, r.URL.Path)
+                w.WriteHeader(400)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
+
+            errs, ok := api.writeAll("RPC.DelMaintenance", ids, level)
+            if !ok {
+                writeResponse(w, level, errs, ok)
+                return
+            }
+
+            w.WriteHeader(200)
+            w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(errs)}))
+            return
+        }
+
+        var item config.Maintenance
+
+        if err := json.Unmarshal(body, &item); err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        if item.Name == "" {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"parameter missing name"}))
+            return
+        }
+
+        now := time.Now().UTC().Unix()
+
+        // A one-off window without start begins now
+        if item.Schedule == "" && item.Start == 0 {
+            item.Start = now
+        }
+
+        win, err := maintenance.Compile(item)
+        if err != nil {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+        item = win.Maintenance
+
+        // Posting a window with an id replaces it
+        if item.Id == "" {
+            secret, err := newSecret()
+            if err != nil {
+                log.Printf("[error] %v - %s", err, r.URL.Path)
+                w.WriteHeader(500)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
+            item.Id = config.GetHash(secret)
+        }
+        item.Created = now
+
+        errs, ok := api.writeAll("RPC.SetMaintenance", []config.Maintenance{item}, level)
+        if !ok {
+            writeResponse(w, level, errs, ok)
+            return
+        }
+
+        log.Printf("[info] maintenance saved: %v (%v), sender - %s", item.Name, item.Suppress, readUserIP(r))
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(errs), Data:[]interface{}{item}}))
+        return
+    }
+
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
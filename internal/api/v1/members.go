@@ -0,0 +1,391 @@
+package v1
+
+import (
+    "log"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "net/rpc"
+    "net/http"
+    "io"
+    "compress/gzip"
+    "io/ioutil"
+    "encoding/json"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+// Connections holds the cluster members, a value in the channel
+// marks a member whose rpc client has to be re-created
+type Connections struct {
+    sync.RWMutex
+    self         string
+    items        map[string]chan int
+    changed      chan struct{}
+}
+
+// hostIPs resolves a host, an IP address is returned as it is
+func hostIPs(host string) []net.IP {
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ip}
+    }
+    ips, err := net.LookupIP(host)
+    if err != nil {
+        return nil
+    }
+    return ips
+}
+
+// localHost reports whether a host names an address of this machine
+func localHost(host string) bool {
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return false
+    }
+    for _, ip := range hostIPs(host) {
+        if ip.IsLoopback() {
+            return true
+        }
+        for _, addr := range addrs {
+            if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func sameHost(a, b string) bool {
+    for _, x := range hostIPs(a) {
+        for _, y := range hostIPs(b) {
+            if x.Equal(y) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// selfMember returns the member that names the peer listener of this node,
+// a listener on ":8085" or "0.0.0.0:8085" is known to the others as "host:8085".
+// The address is returned unchanged when no single member matches it.
+func selfMember(self string, members []string) string {
+    for _, id := range members {
+        if id == self {
+            return self
+        }
+    }
+
+    host, port, err := net.SplitHostPort(self)
+    if err != nil {
+        return self
+    }
+    ip := net.ParseIP(host)
+    unspecified := host == "" || (ip != nil && ip.IsUnspecified())
+
+    var found []string
+    for _, id := range members {
+        h, p, err := net.SplitHostPort(id)
+        if err != nil || p != port {
+            continue
+        }
+        if (unspecified && localHost(h)) || (!unspecified && sameHost(host, h)) {
+            found = append(found, id)
+        }
+    }
+
+    if len(found) == 1 {
+        return found[0]
+    }
+    return self
+}
+
+type Member struct {
+    Address      string                    `json:"address"`
+    Connected    bool                      `json:"connected"`
+    Reconnect    bool                      `json:"reconnect"`
+}
+
+func (c *Connections) Add(id string) bool {
+    c.Lock()
+    defer c.Unlock()
+
+    if _, ok := c.items[id]; ok {
+        return false
+    }
+    c.items[id] = make(chan int, 1)
+    c.notify()
+
+    return true
+}
+
+func (c *Connections) Del(id string) bool {
+    c.Lock()
+    defer c.Unlock()
+
+    if _, ok := c.items[id]; !ok {
+        return false
+    }
+    delete(c.items, id)
+    c.notify()
+
+    return true
+}
+
+func (c *Connections) Has(id string) bool {
+    c.RLock()
+    defer c.RUnlock()
+
+    _, ok := c.items[id]
+    return ok
+}
+
+// List returns the members sorted by address
+func (c *Connections) List() []string {
+    c.RLock()
+    defer c.RUnlock()
+
+    ids := make([]string, 0, len(c.items))
+    for id := range c.items {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    return ids
+}
+
+// Flag marks a member for reconnection
+func (c *Connections) Flag(id string) {
+    c.RLock()
+    defer c.RUnlock()
+
+    if ch, ok := c.items[id]; ok && len(ch) < 1 {
+        select {
+            case ch <- 1:
+            default:
+        }
+    }
+}
+
+func (c *Connections) Flagged(id string) bool {
+    c.RLock()
+    defer c.RUnlock()
+
+    return len(c.items[id]) > 0
+}
+
+// Reset consumes the reconnect mark of a member
+func (c *Connections) Reset(id string) bool {
+    c.RLock()
+    defer c.RUnlock()
+
+    select {
+        case <- c.items[id]:
+            return true
+        default:
+            return false
+    }
+}
+
+func (c *Connections) notify() {
+    select {
+        case c.changed <- struct{}{}:
+        default:
+    }
+}
+
+// Wait blocks until membership changes or the timeout expires
+func (c *Connections) Wait(timeout time.Duration) {
+    select {
+        case <- c.changed:
+        case <- time.After(timeout):
+    }
+}
+
+// addMembers adds and persists members, it returns the ones that were new
+func addMembers(client db.DbClient, ids []string) ([]string, error) {
+    var added []string
+
+    for _, id := range ids {
+        if id == "" {
+            continue
+        }
+        if connections.Add(id) {
+            added = append(added, id)
+            log.Printf("[info] cluster member added: %v", id)
+        }
+    }
+
+    if len(added) > 0 {
+        if err := client.SaveMembers(added); err != nil {
+            return added, err
+        }
+    }
+
+    return added, nil
+}
+
+// delMembers removes and forgets members. A node never removes itself,
+// when its own address is in the list it leaves the cluster instead
+// and drops all the other members.
+func delMembers(client db.DbClient, ids []string) ([]string, error) {
+    var removed []string
+
+    for _, id := range ids {
+        if id != "" && id == connections.self {
+            ids = connections.List()
+            break
+        }
+    }
+
+    for _, id := range ids {
+        if id == connections.self {
+            continue
+        }
+        if connections.Del(id) {
+            removed = append(removed, id)
+            log.Printf("[info] cluster member removed: %v", id)
+        }
+    }
+
+    if len(removed) > 0 {
+        if err := client.DelMembers(removed); err != nil {
+            return removed, err
+        }
+    }
+
+    return removed, nil
+}
+
+// broadcastMembers sends a membership change to every connected peer,
+// the local node is skipped, the handler applies the change itself
+func (api *Api) broadcastMembers(method string, ids []string) *Errors {
+    er := &Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for id, client := range api.Peers.items {
+
+        if id == api.Self {
+            continue
+        }
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            if err := api.call(id, client, method, ids, nil); err != nil {
+                er.Lock()
+                er.items[id] = err
+                er.Unlock()
+
+                log.Printf("[error] %v - %s %s", err, id, method)
+                connections.Flag(id)
+            }
+
+        }(id, client)
+
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    return er
+}
+
+func (api *Api) ApiMembers(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method == "GET" {
+        var members []interface{}
+
+        api.Peers.RLock()
+        for _, id := range connections.List() {
+            _, ok := api.Peers.items[id]
+            members = append(members, Member{Address: id, Connected: ok, Reconnect: connections.Flagged(id)})
+        }
+        api.Peers.RUnlock()
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Data:members}))
+        return
+    }
+
+    if r.Method == "POST" || r.Method == "DELETE" {
+        var reader io.ReadCloser
+        var err error
+
+        // Check that the server actual sent compressed data
+        switch r.Header.Get("Content-Encoding") {
+            case "gzip":
+                reader, err = gzip.NewReader(r.Body)
+                if err != nil {
+                    log.Printf("[error] %v - %s", err, r.URL.Path)
+                    w.WriteHeader(400)
+                    w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                    return
+                }
+                defer reader.Close()
+            default:
+                reader = r.Body
+        }
+        defer r.Body.Close()
+
+        body, err := ioutil.ReadAll(reader)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        var ids []string
+
+        if err := json.Unmarshal(body, &ids); err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        var er *Errors
+
+        if r.Method == "POST" {
+            if _, err := addMembers(*api.DB, ids); err != nil {
+                log.Printf("[error] %v - %s", err, r.URL.Path)
+                w.WriteHeader(500)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
+
+            // Connect new members, then send them the full list. A new member
+            // pulls the data from the cluster when it connects to its peers.
+            api.ApiPeers()
+            er = api.broadcastMembers("RPC.AddMembers", connections.List())
+        } else {
+            // Removed members are told first, so that they leave the cluster
+            er = api.broadcastMembers("RPC.DelMembers", ids)
+
+            if _, err := delMembers(*api.DB, ids); err != nil {
+                log.Printf("[error] %v - %s", err, r.URL.Path)
+                w.WriteHeader(500)
+                w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+                return
+            }
+
+            api.ApiPeers()
+        }
+
+        er.RLock()
+        defer er.RUnlock()
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:peerErrors(er.items)}))
+        return
+    }
+
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
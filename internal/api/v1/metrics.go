@@ -0,0 +1,186 @@
+package v1
+
+import (
+    "log"
+    "fmt"
+    "sort"
+    "sync"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+var (
+    ingestedRecords = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "ingested_records_total",
+            Help:      "Records received by the write endpoints",
+        },
+        []string{"endpoint"},
+    )
+
+    rejectedRecords = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "netmap",
+            Name:      "rejected_records_total",
+            Help:      "Records or requests rejected by the write endpoints",
+        },
+        []string{"endpoint","reason"},
+    )
+
+    peerCallDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "netmap",
+            Name:      "peer_call_duration_seconds",
+            Help:      "Duration of RPC calls to peers",
+            Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+        },
+        []string{"peer","method"},
+    )
+
+    accountRecords = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "account_records",
+            Help:      "Records stored on this node per account",
+        },
+        []string{"account_id"},
+    )
+
+    accounts = &Accounts{items: make(map[string]bool)}
+
+    labelSeries = &recordLabels{items: make(map[string]prometheus.Metric)}
+)
+
+// recordLabels exports the labels of the stored records as the info metric
+// netmap_record_labels, with every label name prefixed by "label_". The label
+// names differ between records, so the collector is unchecked. The series are
+// built when records are written and dropped with the relation gauges.
+type recordLabels struct {
+    sync.RWMutex
+    items        map[string]prometheus.Metric
+}
+
+func (c *recordLabels) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *recordLabels) Collect(ch chan<- prometheus.Metric) {
+    c.RLock()
+    defer c.RUnlock()
+
+    for _, metric := range c.items {
+        ch <- metric
+    }
+}
+
+// set replaces the series of the records, records without labels have none
+func (c *recordLabels) set(items []config.SockTable) {
+    c.Lock()
+    defer c.Unlock()
+
+    for _, item := range items {
+        if len(item.Labels) == 0 {
+            delete(c.items, item.Id)
+            continue
+        }
+
+        names := make([]string, 0, len(item.Labels))
+        for name := range item.Labels {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+
+        keys := []string{"id","src_name","dst_name","mode","port","account_id"}
+        values := append([]string{item.Id}, relationLabels(item)...)
+        for _, name := range names {
+            keys = append(keys, "label_"+name)
+            values = append(values, item.Labels[name])
+        }
+
+        desc := prometheus.NewDesc("netmap_record_labels", "Labels of a stored record, the value is always 1", keys, nil)
+        metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, item.Id)
+            continue
+        }
+        c.items[item.Id] = metric
+    }
+}
+
+func (c *recordLabels) del(items []config.SockTable) {
+    c.Lock()
+    defer c.Unlock()
+
+    for _, item := range items {
+        delete(c.items, item.Id)
+    }
+}
+
+// Accounts remembers the accounts with a records series
+type Accounts struct {
+    sync.Mutex
+    items        map[string]bool
+}
+
+func relationLabels(rec config.SockTable) []string {
+    return []string{
+        rec.LocalAddr.Name,
+        rec.RemoteAddr.Name,
+        rec.Relation.Mode,
+        fmt.Sprint(rec.Relation.Port),
+        fmt.Sprint(rec.Options.AccountID),
+    }
+}
+
+// setRelations updates the relation gauges from applied status updates,
+// found holds the stored records
+func setRelations(found map[string]config.SockTable, items []config.SockTable) {
+    for _, item := range items {
+        rec, ok := found[item.Id]
+        if !ok {
+            continue
+        }
+        labels := relationLabels(rec)
+        resultCode.WithLabelValues(labels...).Set(float64(item.Relation.Result))
+        responseTime.WithLabelValues(labels...).Set(item.Relation.Response)
+    }
+}
+
+// delRelations removes the series of deleted records
+func delRelations(items []config.SockTable) {
+    for _, item := range items {
+        labels := relationLabels(item)
+        resultCode.DeleteLabelValues(labels...)
+        responseTime.DeleteLabelValues(labels...)
+    }
+    labelSeries.del(items)
+}
+
+// countRecords sets the number of records per account,
+// accounts without records lose their series
+func countRecords(client db.DbClient) {
+    items, err := client.LoadRecords(config.RecArgs{})
+    if err != nil {
+        log.Printf("[error] %v", err)
+        return
+    }
+
+    counts := map[string]int{}
+    for _, item := range items {
+        counts[fmt.Sprint(item.Options.AccountID)]++
+    }
+
+    accounts.Lock()
+    defer accounts.Unlock()
+
+    for account := range accounts.items {
+        if _, ok := counts[account]; !ok {
+            accountRecords.DeleteLabelValues(account)
+            delete(accounts.items, account)
+        }
+    }
+    for account, count := range counts {
+        accountRecords.WithLabelValues(account).Set(float64(count))
+        accounts.items[account] = true
+    }
+}
@@ -0,0 +1,220 @@
+package v1
+
+import (
+    "io"
+    "os"
+    "log"
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "net/rpc"
+    "crypto/tls"
+    "crypto/hmac"
+    "crypto/x509"
+    "crypto/rand"
+    "crypto/sha256"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+var (
+    peerTimeout = 5 * time.Second
+)
+
+// Peer holds the settings of the peer RPC channel. With TLS both sides
+// present certificates signed by the CA bundle, with a secret both sides
+// prove they know it before any RPC call is served. The secret does not
+// protect the calls that follow, without TLS they are sent in plaintext.
+type Peer struct {
+    TLS          *tls.Config
+    Secret       string
+}
+
+func NewPeer(conf *config.Global) (*Peer, error) {
+    peer := &Peer{}
+
+    if conf == nil {
+        return peer, nil
+    }
+    peer.Secret = conf.PeerSecret
+
+    if !conf.PeerTLS {
+        if peer.Secret != "" {
+            log.Printf("[warning] peer_secret is set without peer_tls, peer calls are sent in plaintext")
+        }
+        return peer, nil
+    }
+
+    if conf.CertFile == "" || conf.CertKey == "" || conf.CaFile == "" {
+        return peer, fmt.Errorf("peer tls requires cert_file, cert_key and ca_file")
+    }
+
+    cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.CertKey)
+    if err != nil {
+        return peer, err
+    }
+
+    ca, err := os.ReadFile(conf.CaFile)
+    if err != nil {
+        return peer, err
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(ca) {
+        return peer, fmt.Errorf("no certificates found in %v", conf.CaFile)
+    }
+
+    peer.TLS = &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        RootCAs:      pool,
+        ClientCAs:    pool,
+        ClientAuth:   tls.RequireAndVerifyClientCert,
+        MinVersion:   tls.VersionTLS12,
+    }
+
+    return peer, nil
+}
+
+func peerMac(secret, label string, nonce []byte) []byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(label))
+    mac.Write(nonce)
+    return mac.Sum(nil)
+}
+
+func peerNonce() ([]byte, error) {
+    nonce := make([]byte, 32)
+    _, err := rand.Read(nonce)
+    return nonce, err
+}
+
+// accept runs the server side of the handshake: the server sends a nonce,
+// the client answers with its mac and a nonce of its own, the server
+// answers with its mac, so each side checks the other
+func (p *Peer) accept(conn net.Conn) error {
+    if p.Secret == "" {
+        return nil
+    }
+
+    nonce, err := peerNonce()
+    if err != nil {
+        return err
+    }
+    if _, err := conn.Write(nonce); err != nil {
+        return err
+    }
+
+    buf := make([]byte, 64)
+    if _, err := io.ReadFull(conn, buf); err != nil {
+        return err
+    }
+    if !hmac.Equal(buf[:32], peerMac(p.Secret, "client", nonce)) {
+        return errors.New("peer authentication failed")
+    }
+
+    _, err = conn.Write(peerMac(p.Secret, "server", buf[32:]))
+    return err
+}
+
+func (p *Peer) dial(conn net.Conn) error {
+    if p.Secret == "" {
+        return nil
+    }
+
+    buf := make([]byte, 32)
+    if _, err := io.ReadFull(conn, buf); err != nil {
+        return err
+    }
+
+    nonce, err := peerNonce()
+    if err != nil {
+        return err
+    }
+    if _, err := conn.Write(append(peerMac(p.Secret, "client", buf), nonce...)); err != nil {
+        return err
+    }
+
+    if _, err := io.ReadFull(conn, buf); err != nil {
+        return err
+    }
+    if !hmac.Equal(buf, peerMac(p.Secret, "server", nonce)) {
+        return errors.New("peer authentication failed")
+    }
+
+    return nil
+}
+
+// Dial opens a connection to a peer and completes the TLS and secret handshakes
+func (p *Peer) Dial(id string) (net.Conn, error) {
+    conn, err := net.DialTimeout("tcp", id, 2 * time.Second)
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(peerTimeout))
+
+    if p.TLS != nil {
+        host, _, err := net.SplitHostPort(id)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        cfg := p.TLS.Clone()
+        cfg.ServerName = host
+        tconn := tls.Client(conn, cfg)
+        if err := tconn.Handshake(); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        conn = tconn
+    }
+
+    if err := p.dial(conn); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("%v - %s", err, id)
+    }
+
+    conn.SetDeadline(time.Time{})
+
+    return conn, nil
+}
+
+// Serve accepts peer connections and serves RPC calls on the ones
+// that pass the handshakes, it returns when the listener is closed
+func (p *Peer) Serve(lis net.Listener) {
+    for {
+        conn, err := lis.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            log.Printf("[error] %v", err)
+            time.Sleep(100 * time.Millisecond)
+            continue
+        }
+
+        go func(conn net.Conn) {
+            conn.SetDeadline(time.Now().Add(peerTimeout))
+
+            if p.TLS != nil {
+                tconn := tls.Server(conn, p.TLS)
+                if err := tconn.Handshake(); err != nil {
+                    log.Printf("[error] %v - %s", err, conn.RemoteAddr())
+                    conn.Close()
+                    return
+                }
+                conn = tconn
+            }
+
+            if err := p.accept(conn); err != nil {
+                log.Printf("[error] %v - %s", err, conn.RemoteAddr())
+                conn.Close()
+                return
+            }
+
+            conn.SetDeadline(time.Time{})
+
+            rpc.ServeConn(conn)
+        }(conn)
+    }
+}
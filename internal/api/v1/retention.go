@@ -0,0 +1,246 @@
+package v1
+
+import (
+    "log"
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+    "strconv"
+    "net/rpc"
+    "net/http"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+type Retention struct {
+    Days         int                       `json:"days"`
+    Cutoff       int64                     `json:"cutoff"`
+    Purged       int                       `json:"purged"`
+}
+
+func retentionCutoff(days int) int64 {
+    return time.Now().UTC().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+}
+
+// expiredRecords returns records whose Timestamp was not refreshed for the given number of days,
+// sharded records are gathered from every member with the errors of the members that did not answer
+func (api *Api) expiredRecords(days int) ([]config.SockTable, int64, map[string]error, error) {
+    cutoff := retentionCutoff(days)
+
+    if !ring.Enabled() {
+        items, err := db.DbClient.LoadExpiredRecords(*api.DB, cutoff)
+        if err != nil {
+            return nil, cutoff, nil, err
+        }
+        return items, cutoff, nil, nil
+    }
+
+    rc := Records{items: make(map[string]config.SockTable)}
+    er := Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for _, id := range connections.List() {
+        if _, ok := api.Peers.items[id]; !ok {
+            er.items[id] = fmt.Errorf("peer is not connected")
+        }
+    }
+    for id, client := range api.Peers.items {
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            var items []config.SockTable
+            err := api.call(id, client, "RPC.GetExpiredRecords", cutoff, &items)
+            if err != nil {
+                er.Lock()
+                er.items[id] = err
+                er.Unlock()
+                return
+            }
+
+            rc.Lock()
+            defer rc.Unlock()
+
+            for _, item := range items {
+                if it, ok := rc.items[item.Id]; ok && it.Timestamp >= item.Timestamp {
+                    continue
+                }
+                rc.items[item.Id] = item
+            }
+
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    items := make([]config.SockTable, 0, len(rc.items))
+    for _, item := range rc.items {
+        items = append(items, item)
+    }
+
+    return items, cutoff, er.items, nil
+}
+
+// purgeLocal removes records not refreshed since the cutoff from the database and
+// the in-memory index, status transitions older than the cutoff are dropped as well
+func purgeLocal(client db.DbClient, cutoff int64) (int, error) {
+    items, err := client.LoadExpiredRecords(cutoff)
+    if err != nil {
+        return 0, err
+    }
+
+    if err := client.DelHistory(cutoff); err != nil {
+        return 0, err
+    }
+
+    if len(items) == 0 {
+        return 0, nil
+    }
+
+    var ids []string
+    for _, item := range items {
+        ids = append(ids, item.Id)
+    }
+
+    if err := client.DelRecords(ids); err != nil {
+        return 0, err
+    }
+    hub.Publish(deleteEvents(items))
+    delRelations(items)
+
+    return len(ids), nil
+}
+
+// purgeRecords expires records on every member with the same cutoff,
+// Purged is the sum over the members
+func (api *Api) purgeRecords(days int) (Retention, error) {
+    stat := Retention{Days: days, Cutoff: retentionCutoff(days)}
+
+    er := Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for id, client := range api.Peers.items {
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            var purged int
+            err := api.call(id, client, "RPC.Purge", stat.Cutoff, &purged)
+
+            er.Lock()
+            defer er.Unlock()
+
+            if err != nil {
+                er.items[id] = err
+                return
+            }
+            stat.Purged += purged
+
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    if len(er.items) > 0 {
+        return stat, fmt.Errorf("purge failed: %v", strings.Join(peerErrors(er.items), "; "))
+    }
+
+    return stat, nil
+}
+
+// ApiRetention expires records older than db.history_days, it runs periodically on the leader
+func (api *Api) ApiRetention() {
+    days := api.Conf.DB.HistoryDays
+    if days <= 0 {
+        return
+    }
+
+    stat, err := api.purgeRecords(days)
+    if err != nil {
+        log.Printf("[error] retention: %v", err)
+        return
+    }
+
+    log.Printf("[info] retention: purged records older than %d days (%d)", days, stat.Purged)
+}
+
+func (api *Api) ApiRecordsRetention(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    days := api.Conf.DB.HistoryDays
+
+    if v := r.URL.Query().Get("days"); v != "" {
+        i, err := strconv.Atoi(v)
+        if err != nil || i <= 0 {
+            w.WriteHeader(400)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"executing query: invalid parameter: days"}))
+            return
+        }
+        days = i
+    }
+
+    if days <= 0 {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"retention is disabled, db.history_days is not set"}))
+        return
+    }
+
+    // Dry run, list what would be removed
+    if r.Method == "GET" {
+        items, cutoff, errs, err := api.expiredRecords(days)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        var records []interface{}
+        for _, item := range items {
+            records = append(records, item)
+        }
+
+        warning := fmt.Sprintf("dry run: %d records not refreshed since %d would be removed", len(records), cutoff)
+
+        // Records of members that did not answer are missing from the list
+        warnings := []string{warning}
+        if len(errs) > 0 {
+            warnings = append(warnings, fmt.Sprintf("dry run: incomplete, %d members did not answer", len(errs)))
+            warnings = append(warnings, peerErrors(errs)...)
+        }
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Warnings:warnings, Data:records}))
+        return
+    }
+
+    if r.Method == "POST" {
+        stat, err := api.purgeRecords(days)
+        if err != nil {
+            log.Printf("[error] %v - %s", err, r.URL.Path)
+            w.WriteHeader(500)
+            w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+            return
+        }
+
+        log.Printf("[info] retention: purged records older than %d days (%d), sender - %s", days, stat.Purged, readUserIP(r))
+
+        w.WriteHeader(200)
+        w.Write(encodeResp(&Resp{Status:"success", Data:[]interface{}{stat}}))
+        return
+    }
+
+    w.WriteHeader(405)
+    w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+}
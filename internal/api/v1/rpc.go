@@ -34,18 +34,69 @@ func NewRPC(conf *config.Config, db db.DbClient) (*RPC, error) {
 }
 
 func (rpc *RPC) SetStatus(items []config.SockTable, reply *string) error {
-    err := db.DbClient.SaveStatus(*rpc.DB, items)
-    return err
+    found, err := previous(*rpc.DB, items)
+    if err != nil {
+        return err
+    }
+    // Results of relations in maintenance are not recorded
+    items = checked(found, items)
+    if err := db.DbClient.SaveStatus(*rpc.DB, items); err != nil {
+        return err
+    }
+    hub.Publish(statusEvents(found, items))
+    setRelations(found, items)
+    return nil
 }
 
 func (rpc *RPC) SetNetstat(items []config.SockTable, reply *string) error {
-    err := db.DbClient.SaveNetstat(*rpc.DB, items)
-    return err
+    found, err := previous(*rpc.DB, items)
+    if err != nil {
+        return err
+    }
+    if err := db.DbClient.SaveNetstat(*rpc.DB, items); err != nil {
+        return err
+    }
+    recordTombstones.del(recordIds(items))
+
+    // Stored records only take the labels of the netstat they miss
+    var added, relabeled []config.SockTable
+    for _, item := range items {
+        rec, ok := found[item.Id]
+        if !ok {
+            added = append(added, item)
+            continue
+        }
+        if labels, ok := config.DefaultLabels(rec.Labels, item.Labels); ok {
+            rec.Labels = labels
+            relabeled = append(relabeled, rec)
+        }
+    }
+    hub.Publish(append(recordEvents(found, added, false), recordEvents(found, relabeled, true)...))
+    labelSeries.set(append(added, relabeled...))
+    return nil
 }
 
 func (rpc *RPC) SetTracert(items []config.SockTable, reply *string) error {
-    err := db.DbClient.SaveTracert(*rpc.DB, items)
-    return err
+    found, err := previous(*rpc.DB, items)
+    if err != nil {
+        return err
+    }
+    if err := db.DbClient.SaveTracert(*rpc.DB, items); err != nil {
+        return err
+    }
+    // Only stored records are traced
+    var ids []string
+    for _, item := range items {
+        if _, ok := found[item.Id]; ok {
+            ids = append(ids, item.Id)
+        }
+    }
+    saved, err := loadIds(*rpc.DB, ids)
+    if err != nil {
+        return err
+    }
+    hub.Publish(recordEvents(found, saved, true))
+    return nil
 }
 
 func (rpc *RPC) GetRecords(args config.RecArgs, items *[]config.SockTable) error {
@@ -55,12 +106,66 @@ func (rpc *RPC) GetRecords(args config.RecArgs, items *[]config.SockTable) error
 }
 
 func (rpc *RPC) SetRecords(items []config.SockTable, reply *string) error {
-    err := db.DbClient.SaveRecords(*rpc.DB, items)
-    return err
+    found, err := previous(*rpc.DB, items)
+    if err != nil {
+        return err
+    }
+    if err := db.DbClient.SaveRecords(*rpc.DB, items); err != nil {
+        return err
+    }
+    recordTombstones.del(recordIds(items))
+    hub.Publish(recordEvents(found, items, true))
+    labelSeries.set(items)
+    return nil
+}
+
+// PatchRecords changes the options of the stored records among the ids,
+// records owned by other peers are skipped
+func (rpc *RPC) PatchRecords(args config.PatchArgs, reply *string) error {
+    items, err := loadIds(*rpc.DB, args.Ids)
+    if err != nil {
+        return err
+    }
+
+    found := map[string]config.SockTable{}
+    var changed []config.SockTable
+
+    for _, item := range items {
+        found[item.Id] = item
+        options := item.Options
+        args.Apply(&item.Options)
+        if item.Options != options {
+            changed = append(changed, item)
+        }
+    }
+
+    if len(changed) == 0 {
+        return nil
+    }
+    if err := db.DbClient.SaveRecords(*rpc.DB, changed); err != nil {
+        return err
+    }
+    hub.Publish(recordEvents(found, changed, true))
+    return nil
 }
 
 func (rpc *RPC) DelRecords(ids []string, reply *string) error {
-    err := db.DbClient.DelRecords(*rpc.DB, ids)
+    items, err := loadIds(*rpc.DB, ids)
+    if err != nil {
+        return err
+    }
+    if err := db.DbClient.DelRecords(*rpc.DB, ids); err != nil {
+        return err
+    }
+    recordTombstones.add(ids)
+    hub.Publish(deleteEvents(items))
+    delRelations(items)
+    return nil
+}
+
+func (rpc *RPC) GetHistory(args config.HistArgs, items *[]config.StatusEvent) error {
+    var err error
+    *items, err = db.DbClient.LoadHistory(*rpc.DB, args)
     return err
 }
 
@@ -71,11 +176,103 @@ func (rpc *RPC) GetExceptions(args config.ExpArgs, items *[]config.Exception) er
 }
 
 func (rpc *RPC) SetExceptions(items []config.Exception, reply *string) error {
-    err := db.DbClient.SaveExceptions(*rpc.DB, items)
-    return err
+    if err := db.DbClient.SaveExceptions(*rpc.DB, items); err != nil {
+        return err
+    }
+    var ids []string
+    for _, item := range items {
+        ids = append(ids, item.Id)
+    }
+    exceptionTombstones.del(ids)
+    return nil
 }
 
 func (rpc *RPC) DelExceptions(ids []string, reply *string) error {
-    err := db.DbClient.DelExceptions(*rpc.DB, ids)
+    if err := db.DbClient.DelExceptions(*rpc.DB, ids); err != nil {
+        return err
+    }
+    exceptionTombstones.add(ids)
+    return nil
+}
+
+func (rpc *RPC) GetDigest(args config.DigestArgs, digest *config.Digest) error {
+    var err error
+    *digest, err = getDigest(*rpc.DB, args)
     return err
 }
+
+func (rpc *RPC) GetSyncData(args config.SyncArgs, data *config.SyncData) error {
+    var err error
+    *data, err = getSyncData(*rpc.DB, args)
+    return err
+}
+
+func (rpc *RPC) GetStats(args string, stats *config.Stats) error {
+    var err error
+    *stats, err = getStats(*rpc.DB)
+    return err
+}
+
+func (rpc *RPC) GetExpiredRecords(cutoff int64, items *[]config.SockTable) error {
+    var err error
+    *items, err = db.DbClient.LoadExpiredRecords(*rpc.DB, cutoff)
+    return err
+}
+
+func (rpc *RPC) Purge(cutoff int64, purged *int) error {
+    var err error
+    *purged, err = purgeLocal(*rpc.DB, cutoff)
+    return err
+}
+
+func (rpc *RPC) RequestLease(args config.LeaseArgs, lease *config.Lease) error {
+    *lease = leases.grant(args)
+    return nil
+}
+
+func (rpc *RPC) GetMembers(args string, ids *[]string) error {
+    *ids = connections.List()
+    return nil
+}
+
+func (rpc *RPC) AddMembers(ids []string, reply *string) error {
+    _, err := addMembers(*rpc.DB, ids)
+    return err
+}
+
+func (rpc *RPC) DelMembers(ids []string, reply *string) error {
+    _, err := delMembers(*rpc.DB, ids)
+    return err
+}
+
+func (rpc *RPC) SetTokens(items []config.Token, reply *string) error {
+    if err := db.DbClient.SaveTokens(*rpc.DB, items); err != nil {
+        return err
+    }
+    tokens.set(items)
+    return nil
+}
+
+func (rpc *RPC) DelTokens(ids []string, reply *string) error {
+    if err := db.DbClient.DelTokens(*rpc.DB, ids); err != nil {
+        return err
+    }
+    tokens.del(ids)
+    return nil
+}
+
+func (rpc *RPC) SetMaintenance(items []config.Maintenance, reply *string) error {
+    if err := db.DbClient.SaveMaintenance(*rpc.DB, items); err != nil {
+        return err
+    }
+    maintenances.set(items)
+    return nil
+}
+
+func (rpc *RPC) DelMaintenance(ids []string, reply *string) error {
+    if err := db.DbClient.DelMaintenance(*rpc.DB, ids); err != nil {
+        return err
+    }
+    maintenances.del(ids)
+    return nil
+}
@@ -0,0 +1,326 @@
+package v1
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "net/rpc"
+    "github.com/cespare/xxhash/v2"
+    "github.com/dgryski/go-rendezvous"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+// Ring assigns records to owners with rendezvous hashing. Without
+// sharding every member owns every record.
+type Ring struct {
+    sync.RWMutex
+    enabled      bool
+    factor       int
+    key          string
+    nodes        []string
+}
+
+// Shards holds the records to send to each peer, nil means every peer gets all of them
+type Shards map[string][]config.SockTable
+
+func (r *Ring) configure(conf *config.Cluster) {
+    r.Lock()
+    defer r.Unlock()
+
+    r.enabled = conf.Sharding
+    r.factor = conf.Replication
+    r.key = conf.ShardKey
+
+    if r.factor <= 0 {
+        r.factor = 1
+    }
+    if r.key == "" {
+        r.key = "id"
+    }
+}
+
+func (r *Ring) Enabled() bool {
+    r.RLock()
+    defer r.RUnlock()
+
+    return r.enabled
+}
+
+// Replicas returns how many of n nodes store each record
+func (r *Ring) Replicas(n int) int {
+    r.RLock()
+    defer r.RUnlock()
+
+    if r.factor < n {
+        return r.factor
+    }
+    return n
+}
+
+// update sets the ring nodes, it returns the previous nodes when they changed
+func (r *Ring) update(nodes []string) ([]string, bool) {
+    r.Lock()
+    defer r.Unlock()
+
+    if len(nodes) == len(r.nodes) {
+        same := true
+        for i := range nodes {
+            if nodes[i] != r.nodes[i] {
+                same = false
+                break
+            }
+        }
+        if same {
+            return nil, false
+        }
+    }
+
+    old := r.nodes
+    r.nodes = nodes
+
+    return old, true
+}
+
+// shardKey returns the value records are distributed by
+func shardKey(key string, rec config.SockTable) string {
+    if key == "name" {
+        return rec.LocalAddr.Name
+    }
+    return config.GetIdRec(&rec)
+}
+
+// owners picks the top nodes for a key, repeating the lookup
+// on the remaining nodes until the replication factor is reached
+func owners(nodes []string, factor int, key string) []string {
+    var items []string
+
+    rest := append([]string{}, nodes...)
+    for len(items) < factor && len(rest) > 0 {
+        node := rendezvous.New(rest, xxhash.Sum64String).Lookup(key)
+        items = append(items, node)
+
+        for i, n := range rest {
+            if n == node {
+                rest = append(rest[:i], rest[i+1:]...)
+                break
+            }
+        }
+    }
+
+    return items
+}
+
+// Owners returns the members that store a record
+func (r *Ring) Owners(rec config.SockTable) []string {
+    r.RLock()
+    defer r.RUnlock()
+
+    if !r.enabled {
+        return r.nodes
+    }
+    return owners(r.nodes, r.factor, shardKey(r.key, rec))
+}
+
+// Owns reports whether the node stores a record
+func (r *Ring) Owns(node string, rec config.SockTable) bool {
+    for _, id := range r.Owners(rec) {
+        if id == node {
+            return true
+        }
+    }
+    return false
+}
+
+// NameOwners returns the members that store the records of a host,
+// it is only known when records are sharded by name
+func (r *Ring) NameOwners(name string) ([]string, bool) {
+    r.RLock()
+    defer r.RUnlock()
+
+    if !r.enabled || r.key != "name" || name == "" {
+        return nil, false
+    }
+    return owners(r.nodes, r.factor, name), true
+}
+
+func (r *Ring) shard(items []config.SockTable) Shards {
+    if !r.Enabled() {
+        return nil
+    }
+
+    shards := Shards{}
+    for _, item := range items {
+        for _, id := range r.Owners(item) {
+            shards[id] = append(shards[id], item)
+        }
+    }
+
+    return shards
+}
+
+func (s Shards) get(id string, items []config.SockTable) []config.SockTable {
+    if s == nil {
+        return items
+    }
+    return s[id]
+}
+
+// gatherRecords loads records from the given peers, or from all of them,
+// a record stored by several owners is taken with the latest timestamp
+func (api *Api) gatherRecords(args config.RecArgs, ids []string) ([]config.SockTable, map[string]error) {
+    rc := Records{items: make(map[string]config.SockTable)}
+    er := Errors{items: make(map[string]error)}
+
+    var wg sync.WaitGroup
+
+    api.Peers.RLock()
+    for _, id := range ids {
+        if _, ok := api.Peers.items[id]; !ok {
+            er.items[id] = fmt.Errorf("peer is not connected")
+        }
+    }
+    for id, client := range api.Peers.items {
+
+        if ids != nil && !contains(ids, id) {
+            continue
+        }
+
+        wg.Add(1)
+
+        go func(id string, client *rpc.Client) {
+            defer wg.Done()
+
+            var items []config.SockTable
+            err := api.call(id, client, "RPC.GetRecords", args, &items)
+            if err != nil {
+                log.Printf("[error] %v - %s RPC.GetRecords", err, id)
+                connections.Flag(id)
+                er.Lock()
+                er.items[id] = err
+                er.Unlock()
+                return
+            }
+
+            rc.Lock()
+            defer rc.Unlock()
+
+            for _, item := range items {
+                if it, ok := rc.items[item.Id]; ok && it.Timestamp >= item.Timestamp {
+                    continue
+                }
+                rc.items[item.Id] = item
+            }
+
+        }(id, client)
+    }
+    api.Peers.RUnlock()
+
+    wg.Wait()
+
+    records := make([]config.SockTable, 0, len(rc.items))
+    for _, item := range rc.items {
+        records = append(records, item)
+    }
+
+    return records, er.items
+}
+
+func contains(items []string, s string) bool {
+    for _, item := range items {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// rebalance moves local records after a membership change. For every record
+// the first previous owner that is still a member sends it to the new owners,
+// then nodes that no longer own the record drop it.
+func (api *Api) rebalance(old []string) {
+    api.balance.Lock()
+    defer api.balance.Unlock()
+
+    records, err := db.DbClient.LoadRecords(*api.DB, config.RecArgs{})
+    if err != nil {
+        log.Printf("[error] rebalance: %v", err)
+        return
+    }
+
+    ring.RLock()
+    factor, key, nodes := ring.factor, ring.key, ring.nodes
+    ring.RUnlock()
+
+    shards := Shards{}
+    var drop []string
+    var dropped []config.SockTable
+
+    for _, rec := range records {
+        prev := owners(old, factor, shardKey(key, rec))
+        next := owners(nodes, factor, shardKey(key, rec))
+
+        sender := ""
+        for _, id := range prev {
+            if contains(nodes, id) {
+                sender = id
+                break
+            }
+        }
+
+        if sender == "" || sender == api.Self {
+            for _, id := range next {
+                if id != api.Self && !contains(prev, id) {
+                    shards[id] = append(shards[id], rec)
+                }
+            }
+        }
+
+        if !contains(next, api.Self) {
+            drop = append(drop, rec.Id)
+            dropped = append(dropped, rec)
+        }
+    }
+
+    failed := false
+    for id, items := range shards {
+        api.Peers.RLock()
+        client, ok := api.Peers.items[id]
+        api.Peers.RUnlock()
+
+        if !ok {
+            log.Printf("[error] rebalance: peer is not connected - %s", id)
+            failed = true
+            continue
+        }
+
+        // Queued hints are not an ack, the records stay until the next rebalance
+        if err := api.callPeer(id, client, "RPC.SetRecords", items); err != nil {
+            log.Printf("[error] rebalance: %v - %s", err, id)
+            failed = true
+        }
+    }
+
+    // Records are kept until every new owner stored them
+    if failed || len(drop) == 0 {
+        log.Printf("[info] rebalance: sent records (%d), dropped records (0)", sentCount(shards))
+        return
+    }
+
+    if err := db.DbClient.DelRecords(*api.DB, drop); err != nil {
+        log.Printf("[error] rebalance: %v", err)
+        return
+    }
+    hub.Publish(deleteEvents(dropped))
+    delRelations(dropped)
+
+    log.Printf("[info] rebalance: sent records (%d), dropped records (%d)", sentCount(shards), len(drop))
+}
+
+func sentCount(shards Shards) int {
+    n := 0
+    for _, items := range shards {
+        n += len(items)
+    }
+    return n
+}
@@ -0,0 +1,336 @@
+package v1
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "net/rpc"
+    "encoding/json"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+)
+
+// Deleted ids are not pulled back from peers for this long
+const tombstoneTTL = 7 * 24 * time.Hour
+
+var (
+    recordTombstones    = &Tombstones{items: make(map[string]int64)}
+    exceptionTombstones = &Tombstones{items: make(map[string]int64)}
+)
+
+// Tombstones keeps the ids deleted on this node with the time of deletion,
+// they are held in memory only and forgotten on restart
+type Tombstones struct {
+    sync.Mutex
+    items        map[string]int64
+}
+
+func (t *Tombstones) add(ids []string) {
+    t.Lock()
+    defer t.Unlock()
+
+    now := time.Now().UTC().Unix()
+    for _, id := range ids {
+        t.items[id] = now
+    }
+
+    cutoff := now - int64(tombstoneTTL.Seconds())
+    for id, deleted := range t.items {
+        if deleted < cutoff {
+            delete(t.items, id)
+        }
+    }
+}
+
+// del forgets the ids of items written again
+func (t *Tombstones) del(ids []string) {
+    t.Lock()
+    defer t.Unlock()
+
+    for _, id := range ids {
+        delete(t.items, id)
+    }
+}
+
+func (t *Tombstones) has(id string) bool {
+    t.Lock()
+    defer t.Unlock()
+
+    _, ok := t.items[id]
+    return ok
+}
+
+func recordIds(items []config.SockTable) []string {
+    var ids []string
+    for _, item := range items {
+        ids = append(ids, item.Id)
+    }
+    return ids
+}
+
+// Records and exceptions are split into buckets by the first
+// two hex characters of their id, giving 256 buckets per kind
+func digestBucket(id string) string {
+    if len(id) < 2 {
+        return id
+    }
+    return id[:2]
+}
+
+// recordHash covers the identity and settings of a record, Timestamp and the
+// check state are left out because every node refreshes them independently
+func recordHash(rec config.SockTable) string {
+    rec.Timestamp = 0
+    rec.Relation.Result = 0
+    rec.Relation.Response = 0
+    rec.Relation.Trace = 0
+    rec.Maintenance = nil
+    jsn, err := json.Marshal(rec)
+    if err != nil {
+        return ""
+    }
+    return config.GetHash(string(jsn))
+}
+
+func exceptionHash(exp config.Exception) string {
+    jsn, err := json.Marshal(exp)
+    if err != nil {
+        return ""
+    }
+    return config.GetHash(string(jsn))
+}
+
+// bucketHashes folds the sorted item hashes of every bucket into one hash
+func bucketHashes(items map[string]config.DigestItem) map[string]string {
+    buckets := map[string][]string{}
+    for id, item := range items {
+        b := digestBucket(id)
+        buckets[b] = append(buckets[b], id+":"+item.Hash)
+    }
+
+    hashes := make(map[string]string, len(buckets))
+    for b, list := range buckets {
+        sort.Strings(list)
+        jsn, _ := json.Marshal(list)
+        hashes[b] = config.GetHash(string(jsn))
+    }
+
+    return hashes
+}
+
+func getDigest(client db.DbClient, args config.DigestArgs) (config.Digest, error) {
+    digest := config.Digest{
+        RecordItems:    make(map[string]config.DigestItem),
+        ExceptionItems: make(map[string]config.DigestItem),
+    }
+
+    records, err := client.LoadRecords(config.RecArgs{})
+    if err != nil {
+        return digest, err
+    }
+
+    exceptions, err := client.LoadExceptions(config.ExpArgs{})
+    if err != nil {
+        return digest, err
+    }
+
+    recItems := make(map[string]config.DigestItem, len(records))
+    for _, rec := range records {
+        if args.Owner != "" && !ring.Owns(args.Owner, rec) {
+            continue
+        }
+        recItems[rec.Id] = config.DigestItem{Timestamp: rec.Timestamp, Hash: recordHash(rec)}
+    }
+
+    expItems := make(map[string]config.DigestItem, len(exceptions))
+    for _, exp := range exceptions {
+        expItems[exp.Id] = config.DigestItem{Hash: exceptionHash(exp)}
+    }
+
+    digest.Records = bucketHashes(recItems)
+    digest.Exceptions = bucketHashes(expItems)
+
+    if len(args.Buckets) == 0 {
+        return digest, nil
+    }
+
+    buckets := map[string]bool{}
+    for _, b := range args.Buckets {
+        buckets[b] = true
+    }
+
+    for id, item := range recItems {
+        if buckets[digestBucket(id)] {
+            digest.RecordItems[id] = item
+        }
+    }
+    for id, item := range expItems {
+        if buckets[digestBucket(id)] {
+            digest.ExceptionItems[id] = item
+        }
+    }
+
+    return digest, nil
+}
+
+func getSyncData(client db.DbClient, args config.SyncArgs) (config.SyncData, error) {
+    var data config.SyncData
+
+    if len(args.Records) > 0 {
+        ids := map[string]bool{}
+        for _, id := range args.Records {
+            ids[id] = true
+        }
+
+        records, err := client.LoadRecords(config.RecArgs{})
+        if err != nil {
+            return data, err
+        }
+        for _, rec := range records {
+            if ids[rec.Id] {
+                data.Records = append(data.Records, rec)
+            }
+        }
+    }
+
+    if len(args.Exceptions) > 0 {
+        ids := map[string]bool{}
+        for _, id := range args.Exceptions {
+            ids[id] = true
+        }
+
+        exceptions, err := client.LoadExceptions(config.ExpArgs{})
+        if err != nil {
+            return data, err
+        }
+        for _, exp := range exceptions {
+            if ids[exp.Id] {
+                data.Exceptions = append(data.Exceptions, exp)
+            }
+        }
+    }
+
+    return data, nil
+}
+
+// diffBuckets returns the buckets whose hashes differ or which exist only on the peer
+func diffBuckets(local, remote map[string]string) []string {
+    var buckets []string
+    for b, hash := range remote {
+        if local[b] != hash {
+            buckets = append(buckets, b)
+        }
+    }
+    return buckets
+}
+
+// ApiSync pulls records and exceptions that are missing locally or newer on the peer.
+// Digests of the two nodes are compared per bucket first, then item lists are
+// exchanged only for the buckets that differ. Items deleted here are not pulled
+// back, the deletion is sent to the peer instead. With sharding only the records
+// this node owns are compared.
+func (api *Api) ApiSync(id string, client *rpc.Client) {
+    var owner string
+    if ring.Enabled() {
+        owner = api.Self
+    }
+
+    var remote config.Digest
+    if err := api.call(id, client, "RPC.GetDigest", config.DigestArgs{Owner: owner}, &remote); err != nil {
+        log.Printf("[error] sync: %v - %s", err, id)
+        return
+    }
+
+    local, err := getDigest(*api.DB, config.DigestArgs{Owner: owner})
+    if err != nil {
+        log.Printf("[error] sync: %v", err)
+        return
+    }
+
+    buckets := append(diffBuckets(local.Records, remote.Records), diffBuckets(local.Exceptions, remote.Exceptions)...)
+    if len(buckets) == 0 {
+        return
+    }
+
+    args := config.DigestArgs{Buckets: buckets, Owner: owner}
+
+    if err := api.call(id, client, "RPC.GetDigest", args, &remote); err != nil {
+        log.Printf("[error] sync: %v - %s", err, id)
+        return
+    }
+
+    local, err = getDigest(*api.DB, args)
+    if err != nil {
+        log.Printf("[error] sync: %v", err)
+        return
+    }
+
+    var pull, drop config.SyncArgs
+
+    for rid, item := range remote.RecordItems {
+        if recordTombstones.has(rid) {
+            drop.Records = append(drop.Records, rid)
+            continue
+        }
+        it, ok := local.RecordItems[rid]
+        if !ok || (it.Hash != item.Hash && item.Timestamp > it.Timestamp) {
+            pull.Records = append(pull.Records, rid)
+        }
+    }
+    for eid, item := range remote.ExceptionItems {
+        if exceptionTombstones.has(eid) {
+            drop.Exceptions = append(drop.Exceptions, eid)
+            continue
+        }
+        if it, ok := local.ExceptionItems[eid]; !ok || it.Hash != item.Hash {
+            pull.Exceptions = append(pull.Exceptions, eid)
+        }
+    }
+
+    // The peer missed deletions made here
+    if len(drop.Records) > 0 {
+        if err := api.callPeer(id, client, "RPC.DelRecords", drop.Records); err != nil {
+            log.Printf("[error] sync: %v - %s", err, id)
+        }
+    }
+    if len(drop.Exceptions) > 0 {
+        if err := api.callPeer(id, client, "RPC.DelExceptions", drop.Exceptions); err != nil {
+            log.Printf("[error] sync: %v - %s", err, id)
+        }
+    }
+
+    if len(pull.Records) == 0 && len(pull.Exceptions) == 0 {
+        return
+    }
+
+    var data config.SyncData
+    if err := api.call(id, client, "RPC.GetSyncData", pull, &data); err != nil {
+        log.Printf("[error] sync: %v - %s", err, id)
+        return
+    }
+
+    // Pulled items are applied like the calls of peers
+    handler := &RPC{DB: api.DB}
+
+    if len(data.Records) > 0 {
+        if err := handler.SetRecords(data.Records, nil); err != nil {
+            log.Printf("[error] sync: %v", err)
+            return
+        }
+        // Pulled records carry the results of the peer
+        saved := map[string]config.SockTable{}
+        for _, rec := range data.Records {
+            saved[rec.Id] = rec
+        }
+        setRelations(saved, data.Records)
+    }
+    if len(data.Exceptions) > 0 {
+        if err := handler.SetExceptions(data.Exceptions, nil); err != nil {
+            log.Printf("[error] sync: %v", err)
+            return
+        }
+    }
+
+    log.Printf("[info] sync from %s: records (%d), exceptions (%d)", id, len(data.Records), len(data.Exceptions))
+}
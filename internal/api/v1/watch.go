@@ -0,0 +1,338 @@
+package v1
+
+import (
+    "log"
+    "fmt"
+    "time"
+    "strconv"
+    "net/http"
+    "encoding/json"
+    "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/db"
+    "github.com/ltkh/netmap/internal/watch"
+)
+
+const (
+    // Events kept for watchers that reconnect
+    watchHistory = 10000
+
+    watchPing = 15 * time.Second
+)
+
+var (
+    hub = watch.NewHub(watchHistory)
+)
+
+// previous returns the stored state of the records by id,
+// the records of a batch usually come from a few hosts
+func previous(client db.DbClient, items []config.SockTable) (map[string]config.SockTable, error) {
+    found := map[string]config.SockTable{}
+    names := map[string]bool{}
+
+    for i := range items {
+        items[i].Id = config.GetIdRec(&items[i])
+        names[items[i].LocalAddr.Name] = true
+    }
+
+    for name := range names {
+        recs, err := client.LoadRecords(config.RecArgs{SrcName: name})
+        if err != nil {
+            return nil, err
+        }
+        for _, rec := range recs {
+            found[rec.Id] = rec
+        }
+    }
+
+    return found, nil
+}
+
+// loadIds returns the stored records with the given ids
+func loadIds(client db.DbClient, ids []string) ([]config.SockTable, error) {
+    var items []config.SockTable
+
+    for _, id := range ids {
+        recs, err := client.LoadRecords(config.RecArgs{Id: id})
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, recs...)
+    }
+
+    return items, nil
+}
+
+func sameRecord(a, b config.SockTable) bool {
+    return a.LocalAddr.Name == b.LocalAddr.Name &&
+        a.LocalAddr.IP.Equal(b.LocalAddr.IP) &&
+        a.RemoteAddr.Name == b.RemoteAddr.Name &&
+        a.RemoteAddr.IP.Equal(b.RemoteAddr.IP) &&
+        a.Relation == b.Relation &&
+        a.Options == b.Options &&
+        config.SameLabels(a.Labels, b.Labels)
+}
+
+// statusEvents describes the changed relations of stored records
+func statusEvents(found map[string]config.SockTable, items []config.SockTable) []watch.Event {
+    var events []watch.Event
+    timestamp := time.Now().UTC().Unix()
+
+    for _, item := range items {
+        rec, ok := found[item.Id]
+        if !ok || rec.Relation == item.Relation {
+            continue
+        }
+
+        event := watch.Event{Type: watch.EventStatus, Timestamp: timestamp}
+
+        if rec.Relation.Result != item.Relation.Result {
+            event.Transition = &config.StatusEvent{
+                RecordId:  item.Id,
+                OldResult: rec.Relation.Result,
+                NewResult: item.Relation.Result,
+                Response:  item.Relation.Response,
+                Timestamp: timestamp,
+            }
+        }
+
+        rec.Relation = item.Relation
+        rec.Timestamp = timestamp
+        event.Record = rec
+
+        events = append(events, event)
+    }
+
+    return events
+}
+
+// recordEvents describes the created records and, unless only new ones
+// are saved, the changed ones
+func recordEvents(found map[string]config.SockTable, items []config.SockTable, update bool) []watch.Event {
+    var events []watch.Event
+    timestamp := time.Now().UTC().Unix()
+
+    for _, item := range items {
+        item.Timestamp = timestamp
+
+        rec, ok := found[item.Id]
+        if !ok {
+            events = append(events, watch.Event{Type: watch.EventCreate, Timestamp: timestamp, Record: item})
+            continue
+        }
+        if !update || sameRecord(rec, item) {
+            continue
+        }
+
+        event := watch.Event{Type: watch.EventUpdate, Timestamp: timestamp, Record: item}
+        if rec.Relation.Result != item.Relation.Result {
+            event.Transition = &config.StatusEvent{
+                RecordId:  item.Id,
+                OldResult: rec.Relation.Result,
+                NewResult: item.Relation.Result,
+                Response:  item.Relation.Response,
+                Timestamp: timestamp,
+            }
+        }
+        events = append(events, event)
+    }
+
+    return events
+}
+
+func deleteEvents(items []config.SockTable) []watch.Event {
+    var events []watch.Event
+    timestamp := time.Now().UTC().Unix()
+
+    for _, item := range items {
+        events = append(events, watch.Event{Type: watch.EventDelete, Timestamp: timestamp, Record: item})
+    }
+
+    return events
+}
+
+// watchQuery reads the filter and the cursor to resume from,
+// Last-Event-ID of a reconnecting event source wins over the parameter
+func watchQuery(r *http.Request) (watch.Filter, string, error) {
+    var filter watch.Filter
+    var cursor string
+
+    for k, v := range r.URL.Query() {
+        switch k {
+            case "src_name":
+                filter.SrcName = v[0]
+            case "result_only":
+                b, err := strconv.ParseBool(v[0])
+                if err != nil {
+                    return filter, "", fmt.Errorf("executing query: invalid parameter: %v", k)
+                }
+                filter.ResultOnly = b
+            case "cursor":
+                if _, _, err := watch.ParseCursor(v[0]); err != nil {
+                    return filter, "", fmt.Errorf("executing query: invalid parameter: %v", k)
+                }
+                cursor = v[0]
+        }
+    }
+
+    if id := r.Header.Get("Last-Event-ID"); id != "" {
+        if _, _, err := watch.ParseCursor(id); err != nil {
+            return filter, "", fmt.Errorf("invalid Last-Event-ID: %v", id)
+        }
+        cursor = id
+    }
+
+    return filter, cursor, nil
+}
+
+// ApiWatch streams the record changes applied on this node as Server-Sent Events,
+// or over a WebSocket when the request asks for an upgrade. Cursors are only
+// valid on the node and the start of it that issued them, a client that lands
+// on another node behind a load balancer gets 410 and loads the records again.
+func (api *Api) ApiWatch(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"method not allowed"}))
+        return
+    }
+
+    filter, cursor, err := watchQuery(r)
+    if err != nil {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return
+    }
+
+    account, err := accountParam(r)
+    if err != nil {
+        w.WriteHeader(accountCode(err))
+        w.Write(encodeResp(&Resp{Status:"error", Error:err.Error()}))
+        return
+    }
+    filter.AccountID = account
+
+    websocket := isWebsocket(r)
+    if websocket && r.Header.Get("Sec-WebSocket-Key") == "" {
+        w.WriteHeader(400)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"parameter missing Sec-WebSocket-Key"}))
+        return
+    }
+
+    watcher, backlog, err := hub.Subscribe(cursor, filter)
+    if err != nil {
+        // The client has to load the records again and watch from the current cursor
+        w.WriteHeader(410)
+        w.Write(encodeResp(&Resp{Status:"error", Error:fmt.Sprintf("%v: %v, current cursor %v", err, cursor, hub.Cursor())}))
+        return
+    }
+    defer hub.Unsubscribe(watcher)
+
+    if websocket {
+        api.watchWebsocket(w, r, watcher, backlog)
+        return
+    }
+
+    api.watchEvents(w, r, watcher, backlog)
+}
+
+func (api *Api) watchEvents(w http.ResponseWriter, r *http.Request, watcher *watch.Watcher, backlog []watch.Event) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        w.WriteHeader(500)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"streaming is not supported"}))
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(200)
+
+    send := func(e watch.Event) error {
+        jsn, err := json.Marshal(e)
+        if err != nil {
+            return err
+        }
+        _, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Cursor, e.Type, jsn)
+        return err
+    }
+
+    fmt.Fprintf(w, ": cursor %s\n\n", hub.Cursor())
+    for _, e := range backlog {
+        if err := send(e); err != nil {
+            return
+        }
+    }
+    flusher.Flush()
+
+    ticker := time.NewTicker(watchPing)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case e, ok := <-watcher.Events:
+                if !ok {
+                    // Dropped for being too slow, the client resumes from its last id
+                    return
+                }
+                if err := send(e); err != nil {
+                    log.Printf("[error] %v - %s", err, r.URL.Path)
+                    return
+                }
+                flusher.Flush()
+            case <-ticker.C:
+                if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+                    return
+                }
+                flusher.Flush()
+            case <-r.Context().Done():
+                return
+        }
+    }
+}
+
+func (api *Api) watchWebsocket(w http.ResponseWriter, r *http.Request, watcher *watch.Watcher, backlog []watch.Event) {
+    ws, err := upgradeWebsocket(w, r)
+    if err != nil {
+        log.Printf("[error] %v - %s", err, r.URL.Path)
+        return
+    }
+    defer ws.Close()
+
+    send := func(e watch.Event) error {
+        jsn, err := json.Marshal(e)
+        if err != nil {
+            return err
+        }
+        return ws.WriteText(jsn)
+    }
+
+    for _, e := range backlog {
+        if err := send(e); err != nil {
+            return
+        }
+    }
+
+    ticker := time.NewTicker(watchPing)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case e, ok := <-watcher.Events:
+                if !ok {
+                    ws.WriteClose(closeTryAgain, "watcher too slow")
+                    return
+                }
+                if err := send(e); err != nil {
+                    return
+                }
+            case <-ticker.C:
+                if err := ws.WritePing(); err != nil {
+                    return
+                }
+            case <-ws.Done():
+                return
+        }
+    }
+}
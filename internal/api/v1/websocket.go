@@ -0,0 +1,219 @@
+package v1
+
+import (
+    "io"
+    "fmt"
+    "net"
+    "sync"
+    "bufio"
+    "strings"
+    "net/http"
+    "crypto/sha1"
+    "encoding/binary"
+    "encoding/base64"
+)
+
+// Minimal server side of RFC 6455, enough to push text messages
+// and to answer pings and close frames of the client
+
+const (
+    websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+    opText  = 0x1
+    opClose = 0x8
+    opPing  = 0x9
+    opPong  = 0xA
+
+    closeNormal   = 1000
+    closeTryAgain = 1013
+
+    // Clients only send control frames, larger frames end the connection
+    maxFrameSize = 64 * 1024
+)
+
+type websocketConn struct {
+    sync.Mutex
+    conn         net.Conn
+    reader       *bufio.Reader
+    done         chan struct{}
+}
+
+func headerHas(r *http.Request, name, value string) bool {
+    for _, v := range r.Header[name] {
+        for _, s := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(s), value) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func isWebsocket(r *http.Request) bool {
+    return headerHas(r, "Connection", "upgrade") && headerHas(r, "Upgrade", "websocket")
+}
+
+func websocketAccept(key string) string {
+    h := sha1.New()
+    io.WriteString(h, key+websocketGUID)
+    return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// upgradeWebsocket takes over the connection of a request and completes the handshake
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        w.WriteHeader(426)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"unsupported websocket version"}))
+        return nil, fmt.Errorf("unsupported websocket version")
+    }
+
+    hj, ok := w.(http.Hijacker)
+    if !ok {
+        w.WriteHeader(500)
+        w.Write(encodeResp(&Resp{Status:"error", Error:"websocket is not supported"}))
+        return nil, fmt.Errorf("response writer can not be hijacked")
+    }
+
+    conn, brw, err := hj.Hijack()
+    if err != nil {
+        return nil, err
+    }
+
+    resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+        "Upgrade: websocket\r\n" +
+        "Connection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+
+    if _, err := conn.Write([]byte(resp)); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    ws := &websocketConn{
+        conn:   conn,
+        reader: brw.Reader,
+        done:   make(chan struct{}),
+    }
+    go ws.read()
+
+    return ws, nil
+}
+
+// Done is closed when the client closed the connection
+func (ws *websocketConn) Done() <-chan struct{} {
+    return ws.done
+}
+
+func (ws *websocketConn) Close() error {
+    return ws.conn.Close()
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+    ws.Lock()
+    defer ws.Unlock()
+
+    header := []byte{0x80 | opcode}
+    switch n := len(payload); {
+        case n < 126:
+            header = append(header, byte(n))
+        case n <= 0xFFFF:
+            header = append(header, 126, 0, 0)
+            binary.BigEndian.PutUint16(header[2:], uint16(n))
+        default:
+            header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+            binary.BigEndian.PutUint64(header[2:], uint64(n))
+    }
+
+    if _, err := ws.conn.Write(header); err != nil {
+        return err
+    }
+    _, err := ws.conn.Write(payload)
+    return err
+}
+
+func (ws *websocketConn) WriteText(data []byte) error {
+    return ws.writeFrame(opText, data)
+}
+
+func (ws *websocketConn) WritePing() error {
+    return ws.writeFrame(opPing, nil)
+}
+
+func (ws *websocketConn) WriteClose(code uint16, reason string) error {
+    payload := make([]byte, 2, 2+len(reason))
+    binary.BigEndian.PutUint16(payload, code)
+    return ws.writeFrame(opClose, append(payload, reason...))
+}
+
+// readFrame returns the opcode and the unmasked payload of a client frame
+func (ws *websocketConn) readFrame() (byte, []byte, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(ws.reader, head[:]); err != nil {
+        return 0, nil, err
+    }
+
+    opcode := head[0] & 0x0F
+    masked := head[1]&0x80 != 0
+    size := uint64(head[1] & 0x7F)
+
+    switch size {
+        case 126:
+            var ext [2]byte
+            if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+                return 0, nil, err
+            }
+            size = uint64(binary.BigEndian.Uint16(ext[:]))
+        case 127:
+            var ext [8]byte
+            if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+                return 0, nil, err
+            }
+            size = binary.BigEndian.Uint64(ext[:])
+    }
+
+    if size > maxFrameSize {
+        return 0, nil, fmt.Errorf("websocket frame too large: %d", size)
+    }
+
+    var mask [4]byte
+    if masked {
+        if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+            return 0, nil, err
+        }
+    }
+
+    payload := make([]byte, size)
+    if _, err := io.ReadFull(ws.reader, payload); err != nil {
+        return 0, nil, err
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+    }
+
+    return opcode, payload, nil
+}
+
+// read answers pings and close frames, messages of the client are ignored
+func (ws *websocketConn) read() {
+    defer close(ws.done)
+
+    for {
+        opcode, payload, err := ws.readFrame()
+        if err != nil {
+            return
+        }
+
+        switch opcode {
+            case opPing:
+                if err := ws.writeFrame(opPong, payload); err != nil {
+                    return
+                }
+            case opClose:
+                ws.WriteClose(closeNormal, "")
+                return
+        }
+    }
+}
@@ -115,6 +115,10 @@ func (h *HttpClient) WriteRecords(cfg HttpConfig, path string, data []byte) erro
             req.Header.Set("Content-Encoding", "gzip")
         }
 
+        if cfg.Username != "" || cfg.Password != "" {
+            req.SetBasicAuth(cfg.Username, cfg.Password)
+        }
+
         for name, value := range cfg.Headers {
             req.Header.Set(name, value)
         }
@@ -150,6 +154,10 @@ func (h *HttpClient) ReadRecords(cfg HttpConfig, path string) ([]byte, error) {
             continue
         }
 
+        if cfg.Username != "" || cfg.Password != "" {
+            req.SetBasicAuth(cfg.Username, cfg.Password)
+        }
+
         for name, value := range cfg.Headers {
             req.Header.Set(name, value)
         }
@@ -222,6 +230,10 @@ func (h *HttpClient) DelRecords(cfg HttpConfig, path string, data []byte) error
             req.Header.Set("Content-Encoding", "gzip")
         }
 
+        if cfg.Username != "" || cfg.Password != "" {
+            req.SetBasicAuth(cfg.Username, cfg.Password)
+        }
+
         for name, value := range cfg.Headers {
             req.Header.Set(name, value)
         }
@@ -4,6 +4,7 @@ import (
     "io"
     "fmt"
     "net"
+    "regexp"
     //"time"
     "io/ioutil"
     "crypto/sha1"
@@ -11,12 +12,22 @@ import (
     "gopkg.in/yaml.v2"
 )
 
+// RecArgs selects records, Type is the relation mode
+// and Filter an expression of the filter package
 type RecArgs struct {
     Id             string
     SrcName        string
     Timestamp      int64
     Type           string
     AccountID      string
+    Filter         string
+}
+
+type HistArgs struct {
+    Id             string
+    SrcName        string
+    Start          int64
+    End            int64
 }
 
 type ExpArgs struct {
@@ -25,6 +36,54 @@ type ExpArgs struct {
     AccountID      string
 }
 
+// DigestArgs selects the buckets whose items are listed in a Digest,
+// without buckets only the per-bucket hashes are returned
+type DigestArgs struct {
+    Buckets        []string
+    Owner          string
+}
+
+type Digest struct {
+    Records        map[string]string
+    Exceptions     map[string]string
+    RecordItems    map[string]DigestItem
+    ExceptionItems map[string]DigestItem
+}
+
+type DigestItem struct {
+    Timestamp      int64
+    Hash           string
+}
+
+type LeaseArgs struct {
+    Candidate      string                 `json:"candidate"`
+    Epoch          uint64                 `json:"epoch"`
+    Duration       int64                  `json:"duration"`
+}
+
+type Lease struct {
+    Leader         string                 `json:"leader"`
+    Epoch          uint64                 `json:"epoch"`
+    Expires        int64                  `json:"expires"`
+    Granted        bool                   `json:"granted"`
+}
+
+type Stats struct {
+    Records        int                    `json:"records"`
+    Exceptions     int                    `json:"exceptions"`
+    Hash           string                 `json:"hash"`
+}
+
+type SyncArgs struct {
+    Records        []string
+    Exceptions     []string
+}
+
+type SyncData struct {
+    Records        []SockTable
+    Exceptions     []Exception
+}
+
 type Exception struct {
     Id             string                 `json:"id,omitempty"`
     AccountID      uint32                 `json:"accountID"`
@@ -32,6 +91,54 @@ type Exception struct {
     IgnoreMask     string                 `json:"ignoreMask"`
 }
 
+// Token is an API credential, Id is the hash of the secret
+// which is only shown when the token is created
+type Token struct {
+    Id             string                 `json:"id"`
+    Name           string                 `json:"name"`
+    Role           string                 `json:"role"`
+    AccountID      uint32                 `json:"accountID"`
+    Created        int64                  `json:"created"`
+}
+
+// Maintenance suppresses the checks or notifications of the records it targets.
+// A one-off window lasts from Start to End, a recurring one starts at every
+// time of the cron Schedule in Timezone and lasts Duration. Targets of
+// different kinds must all match, an empty kind matches every record.
+type Maintenance struct {
+    Id             string                 `json:"id"`
+    Name           string                 `json:"name"`
+    Comment        string                 `json:"comment,omitempty"`
+    Hosts          []string               `json:"hosts,omitempty"`
+    Ports          []uint16               `json:"ports,omitempty"`
+    Accounts       []uint32               `json:"accounts,omitempty"`
+    Labels         map[string]string      `json:"labels,omitempty"`
+    Start          int64                  `json:"start,omitempty"`
+    End            int64                  `json:"end,omitempty"`
+    Schedule       string                 `json:"schedule,omitempty"`
+    Duration       string                 `json:"duration,omitempty"`
+    Timezone       string                 `json:"timezone,omitempty"`
+    Suppress       string                 `json:"suppress"`
+    Created        int64                  `json:"created"`
+}
+
+// ActiveMaintenance is a maintenance window in effect until End
+type ActiveMaintenance struct {
+    Id             string                 `json:"id"`
+    Name           string                 `json:"name"`
+    Suppress       string                 `json:"suppress"`
+    End            int64                  `json:"end"`
+}
+
+// StatusEvent is a change of Relation.Result of a record
+type StatusEvent struct {
+    RecordId       string                 `json:"recordId"`
+    OldResult      int                    `json:"oldResult"`
+    NewResult      int                    `json:"newResult"`
+    Response       float64                `json:"response"`
+    Timestamp      int64                  `json:"timestamp"`
+}
+
 // SockTable type represents each line of the /cmd/[tcp|udp]
 type SockTable struct {
     Id             string                 `json:"id,omitempty"`
@@ -40,6 +147,9 @@ type SockTable struct {
     RemoteAddr     SockAddr               `json:"remoteAddr"`
     Relation       Relation               `json:"relation"`
     Options        Options                `json:"options"`
+    Labels         map[string]string      `json:"labels,omitempty"`
+    // Maintenance lists the windows in effect, it is set in API responses only
+    Maintenance    []ActiveMaintenance    `json:"maintenance,omitempty"`
 }
 
 // SockAddr represents
@@ -71,11 +181,16 @@ type Config struct {
     Global         *Global                `yaml:"global"`
     DB             *DB                    `yaml:"db"`
     Notifier       *Notifier              `yaml:"notifier"`
+    Cluster        *Cluster               `yaml:"cluster"`
+    Auth           *Auth                  `yaml:"auth"`
 }
 
 type Global struct {
     CertFile       string                 `yaml:"cert_file"`
     CertKey        string                 `yaml:"cert_key"`
+    CaFile         string                 `yaml:"ca_file"`
+    PeerTLS        bool                   `yaml:"peer_tls"`
+    PeerSecret     string                 `yaml:"peer_secret"`
 }
 
 type DB struct {
@@ -83,9 +198,32 @@ type DB struct {
     ConnString     string                 `yaml:"conn_string"`
     HistoryDays    int                    `yaml:"history_days"`
     Limit          int                    `yaml:"limit"`
+    AccountLimits  map[uint32]int         `yaml:"account_limits"`
     Username       string                 `yaml:"username"`
     Password       string                 `yaml:"password"`
     Bucket         string                 `yaml:"bucket"`
+    QueueSize      int                    `yaml:"queue_size"`
+    BatchSize      int                    `yaml:"batch_size"`
+    FlushInterval  string                 `yaml:"flush_interval"`
+}
+
+type Cluster struct {
+    HandoffDir     string                 `yaml:"handoff_dir"`
+    HandoffLimit   int                    `yaml:"handoff_limit"`
+    Sharding       bool                   `yaml:"sharding"`
+    Replication    int                    `yaml:"replication_factor"`
+    ShardKey       string                 `yaml:"shard_key"`
+    WriteLevel     string                 `yaml:"write_consistency"`
+    ReadLevel      string                 `yaml:"read_consistency"`
+    LeaseDuration  string                 `yaml:"lease_duration"`
+}
+
+// Auth enables tokens, with RequireAccount writes of admin tokens and of
+// requests without auth must name their account_id instead of using account 0
+type Auth struct {
+    Enabled        bool                   `yaml:"enabled"`
+    AdminToken     string                 `yaml:"admin_token"`
+    RequireAccount bool                   `yaml:"require_account"`
 }
 
 type Notifier struct {
@@ -101,16 +239,169 @@ type NetstatData struct {
     Data           []SockTable            `json:"data"`
 }
 
+// RecordsPatch changes the options of every record the selector matches,
+// with DryRun only the ids of these records are returned
+type RecordsPatch struct {
+    Selector       Selector               `json:"selector"`
+    Options        OptionsPatch           `json:"options"`
+    DryRun         bool                   `json:"dryRun"`
+}
+
+// Selector picks records by id, source host, relation mode and filter expression
+type Selector struct {
+    Ids            []string               `json:"ids"`
+    SrcName        string                 `json:"src_name"`
+    Type           string                 `json:"type"`
+    Filter         string                 `json:"filter"`
+}
+
+// OptionsPatch holds the options to change, the options left out are kept
+type OptionsPatch struct {
+    Service        *string                `json:"service"`
+    Status         *string                `json:"status"`
+    Command        *string                `json:"command"`
+    Timeout        *float64               `json:"timeout"`
+    MaxRespTime    *float64               `json:"maxRespTime"`
+}
+
+// PatchArgs sets the listed Fields of Options on the records with the given ids.
+// Fields are named like the JSON keys of Options, so zero values can be set
+type PatchArgs struct {
+    Ids            []string
+    Fields         []string
+    Options        Options
+}
+
+// Empty reports whether the selector has no criteria and would match every record
+func (s Selector) Empty() bool {
+    return len(s.Ids) == 0 && s.SrcName == "" && s.Type == "" && s.Filter == ""
+}
+
+// Args returns the arguments of the patch for the records with the given ids
+func (p OptionsPatch) Args(ids []string) PatchArgs {
+    args := PatchArgs{Ids: ids}
+
+    if p.Service != nil {
+        args.Fields = append(args.Fields, "service")
+        args.Options.Service = *p.Service
+    }
+    if p.Status != nil {
+        args.Fields = append(args.Fields, "status")
+        args.Options.Status = *p.Status
+    }
+    if p.Command != nil {
+        args.Fields = append(args.Fields, "command")
+        args.Options.Command = *p.Command
+    }
+    if p.Timeout != nil {
+        args.Fields = append(args.Fields, "timeout")
+        args.Options.Timeout = *p.Timeout
+    }
+    if p.MaxRespTime != nil {
+        args.Fields = append(args.Fields, "maxRespTime")
+        args.Options.MaxRespTime = *p.MaxRespTime
+    }
+
+    return args
+}
+
+// Apply sets the patched options
+func (a PatchArgs) Apply(o *Options) {
+    for _, field := range a.Fields {
+        switch field {
+            case "service":
+                o.Service = a.Options.Service
+            case "status":
+                o.Status = a.Options.Status
+            case "command":
+                o.Command = a.Options.Command
+            case "timeout":
+                o.Timeout = a.Options.Timeout
+            case "maxRespTime":
+                o.MaxRespTime = a.Options.MaxRespTime
+        }
+    }
+}
+
+var (
+    labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// CheckLabels refuses label names that can not be used as Prometheus
+// and Alertmanager labels
+func CheckLabels(labels map[string]string) error {
+    for name := range labels {
+        if !labelName.MatchString(name) {
+            return fmt.Errorf("invalid label name: %v", name)
+        }
+    }
+    return nil
+}
+
+// SameLabels reports whether two label sets are equal
+func SameLabels(a, b map[string]string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for k, v := range a {
+        if w, ok := b[k]; !ok || w != v {
+            return false
+        }
+    }
+    return true
+}
+
+// DefaultLabels returns the labels with the missing defaults added and
+// whether any was added, labels already set win and are not modified
+func DefaultLabels(labels, defaults map[string]string) (map[string]string, bool) {
+    var merged map[string]string
+    for k, v := range defaults {
+        if _, ok := labels[k]; ok {
+            continue
+        }
+        if merged == nil {
+            merged = make(map[string]string, len(labels)+len(defaults))
+            for name, value := range labels {
+                merged[name] = value
+            }
+        }
+        merged[k] = v
+    }
+    if merged == nil {
+        return labels, false
+    }
+    return merged, true
+}
+
 func GetHash(text string) string {
     h := sha1.New()
     io.WriteString(h, text)
     return hex.EncodeToString(h.Sum(nil))
 }
 
+// GetIdRec returns the record id, records of account 0 keep
+// the id format without account so that stored ids stay valid
 func GetIdRec(i *SockTable) string {
+    if i.Options.AccountID != 0 {
+        return GetHash(fmt.Sprintf("%v:%v:%v:%v:%v", i.Options.AccountID, i.LocalAddr.IP, i.RemoteAddr.IP, i.Relation.Mode, i.Relation.Port))
+    }
     return GetHash(fmt.Sprintf("%v:%v:%v:%v", i.LocalAddr.IP, i.RemoteAddr.IP, i.Relation.Mode, i.Relation.Port))
 }
 
+// AccountLimit returns the maximum number of records of an account,
+// limit applies to accounts without their own value
+func (c *DB) AccountLimit(account uint32) int {
+    if limit, ok := c.AccountLimits[account]; ok && limit > 0 {
+        return limit
+    }
+    return c.Limit
+}
+
+// HasAccount reports whether a record of the account matches the arguments
+func (a RecArgs) HasAccount(account uint32) bool {
+    return a.AccountID == "" || a.AccountID == fmt.Sprint(account)
+}
+
 func GetIdExp(i *Exception) string {
     return GetHash(fmt.Sprintf("%v:%v:%v", i.AccountID, i.HostMask, i.IgnoreMask))
 }
@@ -3,20 +3,33 @@ package cache
 import (
     //"time"
     "sync"
+    "sort"
     //"net"
     //"io"
     "time"
-    "errors"
+    "fmt"
+    "strconv"
     //"crypto/sha1"
     //"encoding/hex"
     "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/filter"
+)
+
+var (
+    // Maximum number of status events kept per record
+    history_limit = 1000
 )
 
 type Client struct {
     sync.RWMutex
     items          map[string]config.SockTable
     index          map[string]map[string]bool
-    limit          int
+    accounts       map[uint32]map[string]bool
+    history        map[string][]config.StatusEvent
+    members        map[string]bool
+    tokens         map[string]config.Token
+    maintenance    map[string]config.Maintenance
+    config         *config.DB
 }
 
 func New(conf *config.DB) (*Client, error) {
@@ -29,11 +42,59 @@ func New(conf *config.DB) (*Client, error) {
     client := Client{
         items: make(map[string]config.SockTable),
         index: make(map[string]map[string]bool),
-        limit: conf.Limit,
+        accounts: make(map[uint32]map[string]bool),
+        history: make(map[string][]config.StatusEvent),
+        members: make(map[string]bool),
+        tokens:  make(map[string]config.Token),
+        maintenance: make(map[string]config.Maintenance),
+        config: conf,
     }
     return &client, nil
 }
 
+// add stores a record and indexes it by LocalAddr.Name and account
+func (db *Client) add(rec config.SockTable) {
+    if _, ok := db.index[rec.LocalAddr.Name]; !ok {
+        db.index[rec.LocalAddr.Name] = make(map[string]bool)
+    }
+    if _, ok := db.accounts[rec.Options.AccountID]; !ok {
+        db.accounts[rec.Options.AccountID] = make(map[string]bool)
+    }
+
+    db.index[rec.LocalAddr.Name][rec.Id] = true
+    db.accounts[rec.Options.AccountID][rec.Id] = true
+    db.items[rec.Id] = rec
+}
+
+// del removes a record and its index entries
+func (db *Client) del(id string) {
+    rec, found := db.items[id]
+    if !found {
+        return
+    }
+
+    if _, ok := db.index[rec.LocalAddr.Name]; ok {
+        delete(db.index[rec.LocalAddr.Name], id)
+        if len(db.index[rec.LocalAddr.Name]) == 0 {
+            delete(db.index, rec.LocalAddr.Name)
+        }
+    }
+
+    if _, ok := db.accounts[rec.Options.AccountID]; ok {
+        delete(db.accounts[rec.Options.AccountID], id)
+        if len(db.accounts[rec.Options.AccountID]) == 0 {
+            delete(db.accounts, rec.Options.AccountID)
+        }
+    }
+
+    delete(db.items, id)
+}
+
+// full reports whether a new record would exceed the limit of its account
+func (db *Client) full(rec config.SockTable) bool {
+    return len(db.accounts[rec.Options.AccountID]) >= db.config.AccountLimit(rec.Options.AccountID)
+}
+
 func (db *Client) Close() error {
     return nil
 }
@@ -52,13 +113,31 @@ func (db *Client) SaveStatus(records []config.SockTable) error {
 
     for _, rec := range records {
 
+        rec.Id = config.GetIdRec(&rec)
+
         item, found := db.items[rec.Id]
         if !found {
             continue
         }
 
+        timestamp := time.Now().UTC().Unix()
+
+        if item.Relation.Result != rec.Relation.Result {
+            events := append(db.history[rec.Id], config.StatusEvent{
+                RecordId:  rec.Id,
+                OldResult: item.Relation.Result,
+                NewResult: rec.Relation.Result,
+                Response:  rec.Relation.Response,
+                Timestamp: timestamp,
+            })
+            if len(events) > history_limit {
+                events = events[len(events)-history_limit:]
+            }
+            db.history[rec.Id] = events
+        }
+
         item.Relation = rec.Relation
-        item.Timestamp = time.Now().UTC().Unix()
+        item.Timestamp = timestamp
 
         db.items[rec.Id]= item
 
@@ -73,18 +152,24 @@ func (db *Client) SaveNetstat(records []config.SockTable) error {
 
     for _, rec := range records {
 
-        _, found := db.items[rec.Id]
+        rec.Id = config.GetIdRec(&rec)
+
+        item, found := db.items[rec.Id]
         if found {
+            // Labels sent with the netstat are defaults, stored labels win
+            if labels, ok := config.DefaultLabels(item.Labels, rec.Labels); ok {
+                item.Labels = labels
+                db.items[rec.Id] = item
+            }
             continue
         }
 
-        if _, ok := db.index[rec.LocalAddr.Name]; !ok {
-            db.index[rec.LocalAddr.Name] = make(map[string]bool)
+        if db.full(rec) {
+            return fmt.Errorf("cache limit exceeded for account %v", rec.Options.AccountID)
         }
 
         rec.Timestamp = time.Now().UTC().Unix()
-        db.index[rec.LocalAddr.Name][rec.Id] = true
-        db.items[rec.Id] = rec
+        db.add(rec)
     }
 
     return nil
@@ -95,24 +180,64 @@ func (db *Client) SaveTracert(records []config.SockTable) error {
 }
 
 func (db *Client) LoadRecords(args config.RecArgs) ([]config.SockTable, error) {
+    match, err := filter.Match(args)
+    if err != nil {
+        return nil, err
+    }
+
     db.RLock()
     defer db.RUnlock()
 
     var items []config.SockTable
 
-    if args.SrcName == "" {
-        for _, val := range db.items {
+    if args.Id != "" {
+        if val, ok := db.items[args.Id]; ok && match(val) {
             items = append(items, val)
         }
         return items, nil
-    } 
-    
-    if _, ok := db.index[args.SrcName]; ok {
+    }
+
+    if args.SrcName != "" {
         for key, _ := range db.index[args.SrcName] {
-            if val, ok := db.items[key]; ok {
+            if val, ok := db.items[key]; ok && match(val) {
+                items = append(items, val)
+            }
+        }
+        return items, nil
+    }
+
+    if args.AccountID != "" {
+        account, err := strconv.ParseUint(args.AccountID, 10, 32)
+        if err != nil {
+            return items, fmt.Errorf("invalid account id: %v", args.AccountID)
+        }
+        for key, _ := range db.accounts[uint32(account)] {
+            if val, ok := db.items[key]; ok && match(val) {
                 items = append(items, val)
             }
         }
+        return items, nil
+    }
+
+    for _, val := range db.items {
+        if match(val) {
+            items = append(items, val)
+        }
+    }
+
+    return items, nil
+}
+
+func (db *Client) LoadExpiredRecords(timestamp int64) ([]config.SockTable, error) {
+    db.RLock()
+    defer db.RUnlock()
+
+    var items []config.SockTable
+
+    for _, val := range db.items {
+        if val.Timestamp < timestamp {
+            items = append(items, val)
+        }
     }
 
     return items, nil
@@ -124,18 +249,17 @@ func (db *Client) SaveRecords(records []config.SockTable) error {
 
     for _, rec := range records {
 
+        rec.Id = config.GetIdRec(&rec)
+
         _, found := db.items[rec.Id]
-        if !found && len(db.items) >= db.limit {
-            return errors.New("cache limit exceeded")
+        if !found && db.full(rec) {
+            return fmt.Errorf("cache limit exceeded for account %v", rec.Options.AccountID)
         }
 
-        if _, ok := db.index[rec.LocalAddr.Name]; !ok {
-            db.index[rec.LocalAddr.Name] = make(map[string]bool)
-        }
+        db.del(rec.Id)
 
         rec.Timestamp = time.Now().UTC().Unix()
-        db.index[rec.LocalAddr.Name][rec.Id] = true
-        db.items[rec.Id] = rec
+        db.add(rec)
         
     }
 
@@ -147,23 +271,66 @@ func (db *Client) DelRecords(ids []string) error {
     defer db.Unlock()
 
     for _, id := range ids {
-        rec, found := db.items[id]
-        if !found {
-            continue
-        }
+        db.del(id)
+        delete(db.history, id)
+    }
+    
+    return nil
+}
+
+func (db *Client) LoadHistory(args config.HistArgs) ([]config.StatusEvent, error) {
+    db.RLock()
+    defer db.RUnlock()
+
+    var items []config.StatusEvent
+
+    ids := map[string]bool{}
+    switch {
+        case args.Id != "":
+            ids[args.Id] = true
+        case args.SrcName != "":
+            ids = db.index[args.SrcName]
+        default:
+            for id := range db.history {
+                ids[id] = true
+            }
+    }
 
-        if _, ok := db.index[rec.LocalAddr.Name]; ok {
-            if _, ok := db.index[rec.LocalAddr.Name][id]; ok {
-                delete(db.index[rec.LocalAddr.Name], id)
+    for id := range ids {
+        for _, event := range db.history[id] {
+            if event.Timestamp < args.Start {
+                continue
             }
-            if len(db.index[rec.LocalAddr.Name]) == 0 {
-                delete(db.index, rec.LocalAddr.Name)
+            if args.End > 0 && event.Timestamp > args.End {
+                continue
             }
+            items = append(items, event)
         }
-    
-        delete(db.items, id)
     }
-    
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Timestamp < items[j].Timestamp
+    })
+
+    return items, nil
+}
+
+func (db *Client) DelHistory(timestamp int64) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for id, events := range db.history {
+        i := 0
+        for i < len(events) && events[i].Timestamp < timestamp {
+            i++
+        }
+        if i == len(events) {
+            delete(db.history, id)
+            continue
+        }
+        db.history[id] = events[i:]
+    }
+
     return nil
 }
 
@@ -179,3 +346,106 @@ func (db *Client) SaveExceptions(records []config.Exception) error {
 func (db *Client) DelExceptions(ids []string) error {
     return nil
 }
+
+func (db *Client) LoadMembers() ([]string, error) {
+    db.RLock()
+    defer db.RUnlock()
+
+    var items []string
+    for id := range db.members {
+        items = append(items, id)
+    }
+    sort.Strings(items)
+
+    return items, nil
+}
+
+func (db *Client) SaveMembers(ids []string) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, id := range ids {
+        db.members[id] = true
+    }
+
+    return nil
+}
+
+func (db *Client) DelMembers(ids []string) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, id := range ids {
+        delete(db.members, id)
+    }
+
+    return nil
+}
+
+func (db *Client) LoadTokens() ([]config.Token, error) {
+    db.RLock()
+    defer db.RUnlock()
+
+    var items []config.Token
+    for _, tok := range db.tokens {
+        items = append(items, tok)
+    }
+
+    return items, nil
+}
+
+func (db *Client) SaveTokens(tokens []config.Token) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, tok := range tokens {
+        db.tokens[tok.Id] = tok
+    }
+
+    return nil
+}
+
+func (db *Client) DelTokens(ids []string) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, id := range ids {
+        delete(db.tokens, id)
+    }
+
+    return nil
+}
+
+func (db *Client) LoadMaintenance() ([]config.Maintenance, error) {
+    db.RLock()
+    defer db.RUnlock()
+
+    var items []config.Maintenance
+    for _, item := range db.maintenance {
+        items = append(items, item)
+    }
+
+    return items, nil
+}
+
+func (db *Client) SaveMaintenance(items []config.Maintenance) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, item := range items {
+        db.maintenance[item.Id] = item
+    }
+
+    return nil
+}
+
+func (db *Client) DelMaintenance(ids []string) error {
+    db.Lock()
+    defer db.Unlock()
+
+    for _, id := range ids {
+        delete(db.maintenance, id)
+    }
+
+    return nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+    "fmt"
     "errors"
     "github.com/ltkh/netmap/internal/config"
     "github.com/ltkh/netmap/internal/db/cache"
@@ -18,12 +19,28 @@ type DbClient interface {
     SaveTracert(records []config.SockTable) error
 
     LoadRecords(args config.RecArgs) ([]config.SockTable, error)
+    LoadExpiredRecords(timestamp int64) ([]config.SockTable, error)
     SaveRecords(records []config.SockTable) error
     DelRecords(ids []string) error
 
+    LoadHistory(args config.HistArgs) ([]config.StatusEvent, error)
+    DelHistory(timestamp int64) error
+
     LoadExceptions(args config.ExpArgs) ([]config.Exception, error)
     SaveExceptions(records []config.Exception) error
     DelExceptions(ids []string) error
+
+    LoadMembers() ([]string, error)
+    SaveMembers(ids []string) error
+    DelMembers(ids []string) error
+
+    LoadTokens() ([]config.Token, error)
+    SaveTokens(tokens []config.Token) error
+    DelTokens(ids []string) error
+
+    LoadMaintenance() ([]config.Maintenance, error)
+    SaveMaintenance(items []config.Maintenance) error
+    DelMaintenance(ids []string) error
     
     //Healthy() error
     //LoadUser(login string) (cache.User, error)
@@ -36,6 +53,21 @@ type DbClient interface {
     //DeleteOldAlerts() (int64, error)
 }
 
+// Migrator is implemented by clients with a versioned schema
+type Migrator interface {
+    Migrate(dryRun bool) ([]string, error)
+}
+
+// PendingMigrations returns the migrations a database needs, it is checked
+// without creating or changing the database
+func PendingMigrations(config *config.DB) ([]string, error) {
+    switch config.Client {
+        case "sqlite3":
+            return sqlite3.Pending(config)
+    }
+    return nil, fmt.Errorf("db client %v does not support migrations", config.Client)
+}
+
 func NewClient(config *config.DB) (DbClient, error) {
     switch config.Client {
         case "sqlite3":
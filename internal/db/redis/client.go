@@ -1,113 +1,929 @@
 package redis
 
 import (
-    //"fmt"
+    "fmt"
     "log"
     "time"
-	//"context"
-    //"regexp"
-    //"strings"
-    //"encoding/json"
-    //"database/sql"
-    //
-    //"context"
-    //"encoding/json"
-	"github.com/gomodule/redigo/redis"
-	//goredis "github.com/redis/go-redis/v9"
-	"github.com/nitishm/go-rejson/v4"
-	//"github.com/ltkh/netmap/internal/client"
+    "sort"
+    "strconv"
+    "errors"
+    "encoding/json"
+    "github.com/gomodule/redigo/redis"
     "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/filter"
+)
+
+var (
+    // Number of keys requested in one JSON.MGET
+    chunk_size = 1000
+    // Maximum number of status events kept per record
+    history_limit = 1000
+    // Attempts of a write whose watched keys were changed by another client
+    watch_retries = 10
+)
+
+const (
+    recordKey     = "record:"
+    recordsKey    = "records"
+    indexKey      = "index:"
+    accountKey    = "account:"
+    historyKey    = "history:"
+    exceptionKey  = "exception:"
+    exceptionsKey = "exceptions"
+    membersKey    = "members"
+    tokenKey      = "token:"
+    tokensKey     = "tokens"
+    windowKey     = "maintenance:"
+    windowsKey    = "maintenance"
 )
 
 type Client struct {
-    client redis.Conn
+    pool   *redis.Pool
     config *config.DB
-	rh *rejson.Handler
 }
 
-type Records struct {
-    Records     config.SockTable
-}
+func New(conf *config.DB) (*Client, error) {
 
-type Exceptions struct {
-    Exceptions  config.Exception
-}
+    // Set CacheLimit
+    if conf.Limit == 0 {
+        conf.Limit = 1000000
+    }
 
-func New(conf *config.DB) (*Client, error) {
-	conn, err := redis.Dial("tcp", conf.ConnString)
-    if err != nil {
+    pool := &redis.Pool{
+        MaxIdle:     16,
+        MaxActive:   128,
+        IdleTimeout: 240 * time.Second,
+        Wait:        true,
+        Dial: func() (redis.Conn, error) {
+            return redis.Dial(
+                "tcp",
+                conf.ConnString,
+                redis.DialUsername(conf.Username),
+                redis.DialPassword(conf.Password),
+                redis.DialConnectTimeout(5 * time.Second),
+                redis.DialReadTimeout(10 * time.Second),
+                redis.DialWriteTimeout(10 * time.Second),
+            )
+        },
+        TestOnBorrow: func(c redis.Conn, t time.Time) error {
+            if time.Since(t) < time.Minute {
+                return nil
+            }
+            _, err := c.Do("PING")
+            return err
+        },
+    }
+
+    conn := pool.Get()
+    defer conn.Close()
+
+    if _, err := conn.Do("PING"); err != nil {
+        pool.Close()
         return &Client{}, err
     }
-	//cli := redis.NewClient(&redis.Options{
-    //    Addr:     conf.ConnString,
-    //    Password: conf.Password,
-    //    DB:       0,
-    //})
-	//rh := rejson.NewReJSONHandler()
-	//rh.SetGoRedisClient(cli)
-    //return &Client{ client: cli, config: conf, rh: rh }, nil
-	rh := rejson.NewReJSONHandler()
-	rh.SetRedigoClient(conn)
-    return &Client{ client: conn, config: conf, rh: rh }, nil
+
+    return &Client{ pool: pool, config: conf }, nil
 }
 
 func (db *Client) Close() error {
-    return db.client.Close()
+    return db.pool.Close()
 }
 
 func (db *Client) CreateTables() error {
-    return nil
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    _, err := conn.Do("PING")
+    return err
 }
 
+// LoadTables rebuilds the id sets, the LocalAddr.Name and the account
+// indexes from the stored documents, so that keys written by older versions
+// or by hand become visible to LoadRecords and LoadExceptions
 func (db *Client) LoadTables() error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    records, err := db.scanIds(conn, recordKey)
+    if err != nil {
+        return err
+    }
+
+    for i := 0; i < len(records); i += chunk_size {
+        end := i + chunk_size
+        if end > len(records) {
+            end = len(records)
+        }
+
+        items, err := db.getRecords(conn, records[i:end])
+        if err != nil {
+            return err
+        }
+
+        conn.Send("MULTI")
+        for _, rec := range items {
+            // Records of other accounts stored before the account was part of the id
+            if id := config.GetIdRec(&rec); id != rec.Id {
+                conn.Send("DEL", recordKey+rec.Id)
+                conn.Send("SREM", recordsKey, rec.Id)
+                conn.Send("SREM", indexKey+rec.LocalAddr.Name, rec.Id)
+                rec.Id = id
+                jsn, err := json.Marshal(rec)
+                if err != nil {
+                    conn.Do("DISCARD")
+                    return err
+                }
+                conn.Send("JSON.SET", recordKey+rec.Id, ".", jsn)
+            }
+            conn.Send("SADD", recordsKey, rec.Id)
+            conn.Send("SADD", indexKey+rec.LocalAddr.Name, rec.Id)
+            conn.Send("SADD", accountKey+fmt.Sprint(rec.Options.AccountID), rec.Id)
+        }
+        if _, err := conn.Do("EXEC"); err != nil {
+            return err
+        }
+    }
+
+    exceptions, err := db.scanIds(conn, exceptionKey)
+    if err != nil {
+        return err
+    }
+
+    if len(exceptions) > 0 {
+        if _, err := conn.Do("SADD", redis.Args{}.Add(exceptionsKey).AddFlat(exceptions)...); err != nil {
+            return err
+        }
+    }
+
+    log.Printf("[info] loaded from redis: records (%d), exceptions (%d)", len(records), len(exceptions))
+
     return nil
 }
 
-func (db *Client) SaveStatus(records []config.SockTable) error {
+// scanIds returns the ids of all keys with the given prefix
+func (db *Client) scanIds(conn redis.Conn, prefix string) ([]string, error) {
+    var keys []string
+    var ids []string
+
+    cursor := 0
+    for {
+        values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", chunk_size))
+        if err != nil {
+            return nil, err
+        }
+        if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+            return nil, err
+        }
+        for _, key := range keys {
+            ids = append(ids, key[len(prefix):])
+        }
+        if cursor == 0 {
+            break
+        }
+    }
+
+    return ids, nil
+}
+
+// jsonMGet reads the root of every prefix+id document, missing keys are skipped
+func (db *Client) jsonMGet(conn redis.Conn, prefix string, ids []string) ([][]byte, error) {
+    var result [][]byte
+
+    for i := 0; i < len(ids); i += chunk_size {
+        end := i + chunk_size
+        if end > len(ids) {
+            end = len(ids)
+        }
+
+        args := redis.Args{}
+        for _, id := range ids[i:end] {
+            args = args.Add(prefix+id)
+        }
+        args = args.Add(".")
+
+        values, err := redis.ByteSlices(conn.Do("JSON.MGET", args...))
+        if err != nil {
+            return nil, err
+        }
+
+        for _, val := range values {
+            if val != nil {
+                result = append(result, val)
+            }
+        }
+    }
+
+    return result, nil
+}
+
+func (db *Client) getRecords(conn redis.Conn, ids []string) ([]config.SockTable, error) {
+    var items []config.SockTable
+
+    values, err := db.jsonMGet(conn, recordKey, ids)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, val := range values {
+        var rec config.SockTable
+        if err := json.Unmarshal(val, &rec); err != nil {
+            log.Printf("[error] %v", err)
+            continue
+        }
+        items = append(items, rec)
+    }
+
+    return items, nil
+}
+
+func (db *Client) getRecordMap(conn redis.Conn, records []config.SockTable) (map[string]config.SockTable, error) {
+    var ids []string
+
+    for _, rec := range records {
+        ids = append(ids, rec.Id)
+    }
+
+    items, err := db.getRecords(conn, ids)
+    if err != nil {
+        return nil, err
+    }
+
+    found := make(map[string]config.SockTable, len(items))
+    for _, item := range items {
+        found[item.Id] = item
+    }
+
+    return found, nil
+}
+
+// update reads the stored records and writes what change returns in one transaction.
+// The record keys, and with limited the sets of their accounts, are watched, so when
+// another client changes them in between the transaction is dropped and change runs
+// again on the new data.
+func (db *Client) update(conn redis.Conn, records []config.SockTable, limited bool, change func(found map[string]config.SockTable) ([]config.SockTable, []config.StatusEvent, error)) error {
+    keys := redis.Args{}
+    accounts := map[uint32]bool{}
+    for _, rec := range records {
+        keys = keys.Add(recordKey+rec.Id)
+        if limited && !accounts[rec.Options.AccountID] {
+            accounts[rec.Options.AccountID] = true
+            keys = keys.Add(accountKey+fmt.Sprint(rec.Options.AccountID))
+        }
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+
+    for i := 0; i < watch_retries; i++ {
+        if _, err := conn.Do("WATCH", keys...); err != nil {
+            return err
+        }
+
+        found, err := db.getRecordMap(conn, records)
+        if err != nil {
+            conn.Do("UNWATCH")
+            return err
+        }
+
+        items, events, err := change(found)
+        if err != nil {
+            conn.Do("UNWATCH")
+            return err
+        }
+        if len(items) == 0 && len(events) == 0 {
+            _, err := conn.Do("UNWATCH")
+            return err
+        }
+
+        conn.Send("MULTI")
+        if err := putRecords(conn, items, found); err != nil {
+            conn.Do("DISCARD")
+            return err
+        }
+        if err := putEvents(conn, events); err != nil {
+            conn.Do("DISCARD")
+            return err
+        }
+
+        // A nil reply means that a watched key changed
+        reply, err := conn.Do("EXEC")
+        if err != nil {
+            return err
+        }
+        if reply != nil {
+            return nil
+        }
+    }
+
+    return fmt.Errorf("records changed by other clients, gave up after %d attempts", watch_retries)
+}
+
+// putRecords queues the documents and their index entries of a transaction,
+// old holds the stored versions used to move records between name indexes
+func putRecords(conn redis.Conn, records []config.SockTable, old map[string]config.SockTable) error {
+    for _, rec := range records {
+        jsn, err := json.Marshal(rec)
+        if err != nil {
+            return err
+        }
+        if item, ok := old[rec.Id]; ok && item.LocalAddr.Name != rec.LocalAddr.Name {
+            conn.Send("SREM", indexKey+item.LocalAddr.Name, rec.Id)
+        }
+        conn.Send("JSON.SET", recordKey+rec.Id, ".", jsn)
+        conn.Send("SADD", recordsKey, rec.Id)
+        conn.Send("SADD", indexKey+rec.LocalAddr.Name, rec.Id)
+        conn.Send("SADD", accountKey+fmt.Sprint(rec.Options.AccountID), rec.Id)
+    }
+
     return nil
 }
 
-func (db *Client) SaveNetstat(records []config.SockTable) error {
+// checkLimit verifies that the new records of every account fit into its limit,
+// the account sets have to be watched by the caller
+func (db *Client) checkLimit(conn redis.Conn, adding map[uint32]int) error {
+    for account, n := range adding {
+        if n == 0 {
+            continue
+        }
+
+        count, err := redis.Int(conn.Do("SCARD", accountKey+fmt.Sprint(account)))
+        if err != nil {
+            return err
+        }
+        if count + n > db.config.AccountLimit(account) {
+            return fmt.Errorf("cache limit exceeded for account %v", account)
+        }
+    }
+
     return nil
 }
 
+func (db *Client) SaveStatus(records []config.SockTable) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    for i := range records {
+        records[i].Id = config.GetIdRec(&records[i])
+    }
+
+    return db.update(conn, records, false, func(found map[string]config.SockTable) ([]config.SockTable, []config.StatusEvent, error) {
+        var items []config.SockTable
+        var events []config.StatusEvent
+
+        for _, rec := range records {
+            item, ok := found[rec.Id]
+            if !ok {
+                continue
+            }
+
+            timestamp := time.Now().UTC().Unix()
+
+            if item.Relation.Result != rec.Relation.Result {
+                events = append(events, config.StatusEvent{
+                    RecordId:  rec.Id,
+                    OldResult: item.Relation.Result,
+                    NewResult: rec.Relation.Result,
+                    Response:  rec.Relation.Response,
+                    Timestamp: timestamp,
+                })
+            }
+
+            item.Relation = rec.Relation
+            item.Timestamp = timestamp
+            items = append(items, item)
+        }
+
+        return items, events, nil
+    })
+}
+
+func (db *Client) SaveNetstat(records []config.SockTable) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    for i := range records {
+        records[i].Id = config.GetIdRec(&records[i])
+    }
+
+    return db.update(conn, records, true, func(found map[string]config.SockTable) ([]config.SockTable, []config.StatusEvent, error) {
+        var items []config.SockTable
+        added := map[string]bool{}
+        accounts := map[uint32]int{}
+
+        for _, rec := range records {
+            if added[rec.Id] {
+                continue
+            }
+            if item, ok := found[rec.Id]; ok {
+                // Labels sent with the netstat are defaults, stored labels win
+                if labels, ok := config.DefaultLabels(item.Labels, rec.Labels); ok {
+                    item.Labels = labels
+                    added[rec.Id] = true
+                    items = append(items, item)
+                }
+                continue
+            }
+
+            rec.Timestamp = time.Now().UTC().Unix()
+            added[rec.Id] = true
+            accounts[rec.Options.AccountID]++
+            items = append(items, rec)
+        }
+
+        if err := db.checkLimit(conn, accounts); err != nil {
+            return nil, nil, err
+        }
+
+        return items, nil, nil
+    })
+}
+
 func (db *Client) SaveTracert(records []config.SockTable) error {
-    return nil
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    for i := range records {
+        records[i].Id = config.GetIdRec(&records[i])
+    }
+
+    return db.update(conn, records, false, func(found map[string]config.SockTable) ([]config.SockTable, []config.StatusEvent, error) {
+        var items []config.SockTable
+
+        for _, rec := range records {
+            item, ok := found[rec.Id]
+            if !ok {
+                continue
+            }
+
+            item.Relation.Trace = 2
+
+            if rec.Options.Command != "" {
+                item.Options.Command = rec.Options.Command
+            }
+
+            item.Timestamp = time.Now().UTC().Unix()
+            items = append(items, item)
+        }
+
+        return items, nil, nil
+    })
 }
 
 func (db *Client) LoadRecords(args config.RecArgs) ([]config.SockTable, error) {
-    result := []config.SockTable{}
+    match, err := filter.Match(args)
+    if err != nil {
+        return nil, err
+    }
+
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    var ids []string
+
+    key := recordsKey
+    switch {
+        case args.Id != "":
+            ids = []string{args.Id}
+        case args.SrcName != "":
+            key = indexKey+args.SrcName
+        case args.AccountID != "":
+            if _, err := strconv.ParseUint(args.AccountID, 10, 32); err != nil {
+                return nil, fmt.Errorf("invalid account id: %v", args.AccountID)
+            }
+            key = accountKey+args.AccountID
+    }
+
+    if ids == nil {
+        ids, err = redis.Strings(conn.Do("SMEMBERS", key))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    items, err := db.getRecords(conn, ids)
+    if err != nil {
+        return nil, err
+    }
+
+    var result []config.SockTable
+    for _, item := range items {
+        if match(item) {
+            result = append(result, item)
+        }
+    }
+
     return result, nil
 }
 
+func (db *Client) LoadExpiredRecords(timestamp int64) ([]config.SockTable, error) {
+    items, err := db.LoadRecords(config.RecArgs{})
+    if err != nil {
+        return nil, err
+    }
+
+    var expired []config.SockTable
+
+    for _, val := range items {
+        if val.Timestamp < timestamp {
+            expired = append(expired, val)
+        }
+    }
+
+    return expired, nil
+}
+
 func (db *Client) SaveRecords(records []config.SockTable) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    for i := range records {
+        records[i].Id = config.GetIdRec(&records[i])
+    }
+
+    return db.update(conn, records, true, func(found map[string]config.SockTable) ([]config.SockTable, []config.StatusEvent, error) {
+        var items []config.SockTable
+        added := map[uint32]int{}
+
+        for _, rec := range records {
+            if _, ok := found[rec.Id]; !ok {
+                added[rec.Options.AccountID]++
+            }
+
+            rec.Timestamp = time.Now().UTC().Unix()
+            items = append(items, rec)
+        }
+
+        if err := db.checkLimit(conn, added); err != nil {
+            return nil, nil, err
+        }
+
+        return items, nil, nil
+    })
+}
+
+func (db *Client) DelRecords(ids []string) error {
+    conn := db.pool.Get()
+    defer conn.Close()
 
-	for _, rec := range records {
-		rec.Timestamp = time.Now().UTC().Unix()
+    items, err := db.getRecords(conn, ids)
+    if err != nil {
+        return err
+    }
 
-		_, err := db.rh.JSONSet("record:"+rec.Id, ".", rec)
+    found := make(map[string]config.SockTable, len(items))
+    for _, item := range items {
+        found[item.Id] = item
+    }
+
+    conn.Send("MULTI")
+    for _, id := range ids {
+        conn.Send("DEL", recordKey+id)
+        conn.Send("DEL", historyKey+id)
+        conn.Send("SREM", recordsKey, id)
+        if item, ok := found[id]; ok {
+            conn.Send("SREM", indexKey+item.LocalAddr.Name, id)
+            conn.Send("SREM", accountKey+fmt.Sprint(item.Options.AccountID), id)
+        }
+    }
+    _, err = conn.Do("EXEC")
+
+    return err
+}
+
+// putEvents queues the status events of a transaction
+func putEvents(conn redis.Conn, events []config.StatusEvent) error {
+    for _, event := range events {
+        jsn, err := json.Marshal(event)
         if err != nil {
-			log.Printf("Failed to JSONSet: %v", err)
-			continue
-		}
+            return err
+        }
+        conn.Send("RPUSH", historyKey+event.RecordId, jsn)
+        conn.Send("LTRIM", historyKey+event.RecordId, -history_limit, -1)
     }
 
     return nil
 }
 
-func (db *Client) DelRecords(ids []string) error {
+func (db *Client) LoadHistory(args config.HistArgs) ([]config.StatusEvent, error) {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    var items []config.StatusEvent
+    var ids []string
+    var err error
+
+    switch {
+        case args.Id != "":
+            ids = []string{args.Id}
+        case args.SrcName != "":
+            ids, err = redis.Strings(conn.Do("SMEMBERS", indexKey+args.SrcName))
+        default:
+            ids, err = db.scanIds(conn, historyKey)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    for _, id := range ids {
+        values, err := redis.ByteSlices(conn.Do("LRANGE", historyKey+id, 0, -1))
+        if err != nil {
+            return nil, err
+        }
+        for _, val := range values {
+            var event config.StatusEvent
+            if err := json.Unmarshal(val, &event); err != nil {
+                log.Printf("[error] %v", err)
+                continue
+            }
+            if event.Timestamp < args.Start {
+                continue
+            }
+            if args.End > 0 && event.Timestamp > args.End {
+                continue
+            }
+            items = append(items, event)
+        }
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Timestamp < items[j].Timestamp
+    })
+
+    return items, nil
+}
+
+// DelHistory drops events older than timestamp, the lists are ordered by time
+func (db *Client) DelHistory(timestamp int64) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    ids, err := db.scanIds(conn, historyKey)
+    if err != nil {
+        return err
+    }
+
+    for _, id := range ids {
+        values, err := redis.ByteSlices(conn.Do("LRANGE", historyKey+id, 0, -1))
+        if err != nil {
+            return err
+        }
+
+        i := 0
+        for ; i < len(values); i++ {
+            var event config.StatusEvent
+            if err := json.Unmarshal(values[i], &event); err == nil && event.Timestamp >= timestamp {
+                break
+            }
+        }
+        if i == 0 {
+            continue
+        }
+
+        if _, err := conn.Do("LTRIM", historyKey+id, i, -1); err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 
 func (db *Client) LoadExceptions(args config.ExpArgs) ([]config.Exception, error) {
-    result := []config.Exception{}
-    return result, nil
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    var items []config.Exception
+
+    if args.Id != "" {
+        val, err := redis.Bytes(conn.Do("JSON.GET", exceptionKey+args.Id, "."))
+        if err == redis.ErrNil {
+            return items, errors.New("object not found")
+        }
+        if err != nil {
+            return items, err
+        }
+        var exp config.Exception
+        if err := json.Unmarshal(val, &exp); err != nil {
+            return items, err
+        }
+        items = append(items, exp)
+        return items, nil
+    }
+
+    ids, err := redis.Strings(conn.Do("SMEMBERS", exceptionsKey))
+    if err != nil {
+        return items, err
+    }
+
+    values, err := db.jsonMGet(conn, exceptionKey, ids)
+    if err != nil {
+        return items, err
+    }
+
+    for _, val := range values {
+        var exp config.Exception
+        if err := json.Unmarshal(val, &exp); err != nil {
+            log.Printf("[error] %v", err)
+            continue
+        }
+        if args.AccountID != "" {
+            if fmt.Sprint(exp.AccountID) != args.AccountID {
+                continue
+            }
+        }
+        items = append(items, exp)
+    }
+
+    return items, nil
 }
 
 func (db *Client) SaveExceptions(records []config.Exception) error {
-    return nil
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, rec := range records {
+        jsn, err := json.Marshal(rec)
+        if err != nil {
+            conn.Do("DISCARD")
+            return err
+        }
+        conn.Send("JSON.SET", exceptionKey+rec.Id, ".", jsn)
+        conn.Send("SADD", exceptionsKey, rec.Id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
 }
 
 func (db *Client) DelExceptions(ids []string) error {
-    return nil
-}
\ No newline at end of file
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, id := range ids {
+        conn.Send("DEL", exceptionKey+id)
+        conn.Send("SREM", exceptionsKey, id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
+}
+
+func (db *Client) LoadMembers() ([]string, error) {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    items, err := redis.Strings(conn.Do("SMEMBERS", membersKey))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(items)
+
+    return items, nil
+}
+
+func (db *Client) SaveMembers(ids []string) error {
+    if len(ids) == 0 {
+        return nil
+    }
+
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    _, err := conn.Do("SADD", redis.Args{}.Add(membersKey).AddFlat(ids)...)
+    return err
+}
+
+func (db *Client) DelMembers(ids []string) error {
+    if len(ids) == 0 {
+        return nil
+    }
+
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    _, err := conn.Do("SREM", redis.Args{}.Add(membersKey).AddFlat(ids)...)
+    return err
+}
+
+func (db *Client) LoadTokens() ([]config.Token, error) {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    var items []config.Token
+
+    ids, err := redis.Strings(conn.Do("SMEMBERS", tokensKey))
+    if err != nil {
+        return items, err
+    }
+
+    values, err := db.jsonMGet(conn, tokenKey, ids)
+    if err != nil {
+        return items, err
+    }
+
+    for _, val := range values {
+        var tok config.Token
+        if err := json.Unmarshal(val, &tok); err != nil {
+            log.Printf("[error] %v", err)
+            continue
+        }
+        items = append(items, tok)
+    }
+
+    return items, nil
+}
+
+func (db *Client) SaveTokens(tokens []config.Token) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, tok := range tokens {
+        jsn, err := json.Marshal(tok)
+        if err != nil {
+            conn.Do("DISCARD")
+            return err
+        }
+        conn.Send("JSON.SET", tokenKey+tok.Id, ".", jsn)
+        conn.Send("SADD", tokensKey, tok.Id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
+}
+
+func (db *Client) DelTokens(ids []string) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, id := range ids {
+        conn.Send("DEL", tokenKey+id)
+        conn.Send("SREM", tokensKey, id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
+}
+
+func (db *Client) LoadMaintenance() ([]config.Maintenance, error) {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    var items []config.Maintenance
+
+    ids, err := redis.Strings(conn.Do("SMEMBERS", windowsKey))
+    if err != nil {
+        return items, err
+    }
+
+    values, err := db.jsonMGet(conn, windowKey, ids)
+    if err != nil {
+        return items, err
+    }
+
+    for _, val := range values {
+        var item config.Maintenance
+        if err := json.Unmarshal(val, &item); err != nil {
+            log.Printf("[error] %v", err)
+            continue
+        }
+        items = append(items, item)
+    }
+
+    return items, nil
+}
+
+func (db *Client) SaveMaintenance(items []config.Maintenance) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, item := range items {
+        jsn, err := json.Marshal(item)
+        if err != nil {
+            conn.Do("DISCARD")
+            return err
+        }
+        conn.Send("JSON.SET", windowKey+item.Id, ".", jsn)
+        conn.Send("SADD", windowsKey, item.Id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
+}
+
+func (db *Client) DelMaintenance(ids []string) error {
+    conn := db.pool.Get()
+    defer conn.Close()
+
+    conn.Send("MULTI")
+    for _, id := range ids {
+        conn.Send("DEL", windowKey+id)
+        conn.Send("SREM", windowsKey, id)
+    }
+    _, err := conn.Do("EXEC")
+
+    return err
+}
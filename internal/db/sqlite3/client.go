@@ -11,23 +11,33 @@ import (
     "time"
     "errors"
     //"regexp"
-    //"strings"
+    "strings"
+    "strconv"
     //"crypto/sha1"
     //"encoding/hex"
     "encoding/json"
     "database/sql"
     _ "github.com/mattn/go-sqlite3"
+    "github.com/prometheus/client_golang/prometheus"
     "github.com/ltkh/netmap/internal/config"
+    "github.com/ltkh/netmap/internal/filter"
 )
 
 var (
     queue_limit = 100000
+    batch_size = 1000
+    flush_interval = time.Second
+
+    // Number of attempts to commit a batch before it is dropped
+    flush_retries = 3
 )
 
 type Client struct {
     records    Records 
     exceptions Exceptions
-    queue      chan config.SockTable
+    queue      chan interface{}
+    closed     bool
+    done       chan struct{}
     client     *sql.DB
     config     *config.DB
 }
@@ -36,6 +46,7 @@ type Records struct {
     sync.RWMutex
     items      map[string]config.SockTable
     index      map[string]map[string]bool
+    accounts   map[uint32]map[string]bool
 }
 
 type Exceptions struct {
@@ -43,6 +54,57 @@ type Exceptions struct {
     items      map[string]config.Exception
 }
 
+// add stores a record and indexes it by LocalAddr.Name and account
+func (r *Records) add(rec config.SockTable) {
+    if _, ok := r.index[rec.LocalAddr.Name]; !ok {
+        r.index[rec.LocalAddr.Name] = make(map[string]bool)
+    }
+    if _, ok := r.accounts[rec.Options.AccountID]; !ok {
+        r.accounts[rec.Options.AccountID] = make(map[string]bool)
+    }
+
+    r.index[rec.LocalAddr.Name][rec.Id] = true
+    r.accounts[rec.Options.AccountID][rec.Id] = true
+    r.items[rec.Id] = rec
+}
+
+// del removes a record and its index entries
+func (r *Records) del(id string) {
+    rec, found := r.items[id]
+    if !found {
+        return
+    }
+
+    if _, ok := r.index[rec.LocalAddr.Name]; ok {
+        delete(r.index[rec.LocalAddr.Name], id)
+        if len(r.index[rec.LocalAddr.Name]) == 0 {
+            delete(r.index, rec.LocalAddr.Name)
+        }
+    }
+
+    if _, ok := r.accounts[rec.Options.AccountID]; ok {
+        delete(r.accounts[rec.Options.AccountID], id)
+        if len(r.accounts[rec.Options.AccountID]) == 0 {
+            delete(r.accounts, rec.Options.AccountID)
+        }
+    }
+
+    delete(r.items, id)
+}
+
+// full reports whether a new record would exceed the limit of its account
+func (db *Client) full(rec config.SockTable) bool {
+    return len(db.records.accounts[rec.Options.AccountID]) >= db.config.AccountLimit(rec.Options.AccountID)
+}
+
+// recordDel is a queued removal of a record and its history, it keeps deletes
+// ordered with pending writes
+type recordDel string
+
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 func New(conf *config.DB) (*Client, error) {
 
     if _, err := os.Stat(conf.ConnString); errors.Is(err, os.ErrNotExist) {
@@ -51,7 +113,14 @@ func New(conf *config.DB) (*Client, error) {
             return nil, err
         }
     }
-    conn, err := sql.Open("sqlite3", conf.ConnString)
+
+    // WAL lets readers work while the batch writer holds a transaction
+    dsn := conf.ConnString
+    if !strings.Contains(dsn, "?") {
+        dsn = dsn + "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000"
+    }
+
+    conn, err := sql.Open("sqlite3", dsn)
     if err != nil {
         return nil, err
     }
@@ -61,74 +130,178 @@ func New(conf *config.DB) (*Client, error) {
         conf.Limit = 1000000
     }
 
+    // Set write queue settings
+    if conf.QueueSize == 0 {
+        conf.QueueSize = queue_limit
+    }
+    if conf.BatchSize == 0 {
+        conf.BatchSize = batch_size
+    }
+    flush := flush_interval
+    if conf.FlushInterval != "" {
+        flush, err = time.ParseDuration(conf.FlushInterval)
+        if err != nil || flush <= 0 {
+            return nil, fmt.Errorf("invalid flush_interval: %v", conf.FlushInterval)
+        }
+    }
+
     db := Client{
         records: Records{
             items: make(map[string]config.SockTable),
             index: make(map[string]map[string]bool),
+            accounts: make(map[uint32]map[string]bool),
         },
         exceptions: Exceptions{
             items: make(map[string]config.Exception),
         },
-        queue: make(chan config.SockTable, queue_limit),
+        queue: make(chan interface{}, conf.QueueSize),
+        done: make(chan struct{}),
         client: conn, 
         config: conf,
     }
 
-    go func(){
-        for {
-            rec := <- db.queue
-            db.SaveRecord(rec)
-        }
-    }()
+    err = prometheus.Register(prometheus.NewGaugeFunc(
+        prometheus.GaugeOpts{
+            Namespace: "netmap",
+            Name:      "db_queue_depth",
+            Help:      "Number of writes waiting in the sqlite write-behind queue",
+        },
+        func() float64 { return float64(len(db.queue)) },
+    ))
+    if err != nil {
+        log.Printf("[warning] %v", err)
+    }
+
+    go db.writer(flush)
 
     return &db, nil
 }
 
-func (db *Client) Close() error {
-    return nil
+// writer drains the queue in batches, a batch is committed when it is full
+// or when the flush interval expires, whichever comes first
+func (db *Client) writer(flush time.Duration) {
+    defer close(db.done)
+
+    ticker := time.NewTicker(flush)
+    defer ticker.Stop()
+
+    batch := make([]interface{}, 0, db.config.BatchSize)
+
+    for {
+        select {
+            case item, ok := <- db.queue:
+                if !ok {
+                    db.flushBatch(batch)
+                    return
+                }
+                batch = append(batch, item)
+                if len(batch) >= db.config.BatchSize {
+                    db.flushBatch(batch)
+                    batch = batch[:0]
+                }
+            case <- ticker.C:
+                if len(batch) > 0 {
+                    db.flushBatch(batch)
+                    batch = batch[:0]
+                }
+        }
+    }
 }
 
-func (db *Client) CreateTables() error {
-    _, err := db.client.Exec(
-      `create table if not exists records (
-        id            varchar(50) primary key,
-        timestamp     bigint(20) default 0,
-        localName     varchar(50) not null,
-        localIP       varchar(20) not null,
-        remoteName    varchar(50) not null,
-        remoteIP      varchar(20) not null,
-        relation      json,
-        options       json
-      );
-      create index if not exists localNameIdx 
-        ON records (localName);
-      create table if not exists exceptions (
-        id            varchar(50) primary key,
-        accountId     int default 0,
-        hostMask      varchar(50) not null,
-        ignoreMask    varchar(50) not null
-      );`)
+func (db *Client) flushBatch(batch []interface{}) {
+    if len(batch) == 0 {
+        return
+    }
+
+    var err error
+    for i := 0; i < flush_retries; i++ {
+        if err = db.writeBatch(batch); err == nil {
+            return
+        }
+        log.Printf("[error] DB batch write (attempt %d): %v", i+1, err)
+        time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+    }
+
+    log.Printf("[error] DB batch dropped (%d): %v", len(batch), err)
+}
+
+func (db *Client) writeBatch(batch []interface{}) error {
+    tx, err := db.client.Begin()
     if err != nil {
         return err
     }
 
-    return nil
+    for _, item := range batch {
+        switch item := item.(type) {
+            case config.SockTable:
+                err = db.saveRecord(tx, item)
+            case config.StatusEvent:
+                err = db.saveEvent(tx, item)
+            case recordDel:
+                if _, err = tx.Exec("delete from records where id = ?", string(item)); err == nil {
+                    _, err = tx.Exec("delete from history where recordId = ?", string(item))
+                }
+        }
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+// pushQueue schedules an asynchronous write, callers hold the records lock
+func (db *Client) pushQueue(item interface{}) {
+    if db.closed {
+        log.Print("[error] DB write queue is closed")
+        return
+    }
+    if len(db.queue) < cap(db.queue) {
+        db.queue <- item
+    } else {
+        log.Print("[error] DB write queue is full")
+    }
+}
+
+// Close stops accepting writes, flushes the queue and closes the database
+func (db *Client) Close() error {
+    db.records.Lock()
+    if !db.closed {
+        db.closed = true
+        close(db.queue)
+    }
+    db.records.Unlock()
+
+    <- db.done
+
+    return db.client.Close()
+}
+
+// CreateTables brings the schema up to date with the embedded migrations
+func (db *Client) CreateTables() error {
+    _, err := db.Migrate(false)
+    return err
 }
 
 func (db *Client) LoadTableRecords() error {
     db.records.Lock()
     defer db.records.Unlock()
 
-    sql := "select id,timestamp,localName,localIP,remoteName,remoteIP,relation,options from records order by id"
+    sql := "select id,timestamp,localName,localIP,remoteName,remoteIP,relation,options,labels from records order by id"
 
     rows, err := db.client.Query(sql, nil)
     if err != nil { return err }
     defer rows.Close()
 
+    // Records of other accounts stored before the account was part of the id
+    moved := map[string]string{}
+
     for rows.Next() {
         var rec config.SockTable
         var relation []uint8
         var options []uint8
+        var labels []uint8
         err := rows.Scan(
             &rec.Id, 
             &rec.Timestamp,
@@ -138,17 +311,51 @@ func (db *Client) LoadTableRecords() error {
             &rec.RemoteAddr.IP,
             &relation, 
             &options, 
+            &labels,
         )
         if err != nil { return err }
         err = json.Unmarshal(relation, &rec.Relation)
         if err != nil { continue }
         err = json.Unmarshal(options, &rec.Options)
         if err != nil { continue }
+        // Records stored before labels have none
+        if len(labels) > 0 {
+            err = json.Unmarshal(labels, &rec.Labels)
+            if err != nil { continue }
+        }
+
+        if id := config.GetIdRec(&rec); id != rec.Id {
+            moved[rec.Id] = id
+            rec.Id = id
+        }
 
-        db.records.items[rec.Id] = rec 
+        db.records.add(rec)
     }
+    rows.Close()
 
-    return nil
+    if len(moved) == 0 {
+        return nil
+    }
+
+    tx, err := db.client.Begin()
+    if err != nil {
+        return err
+    }
+
+    for from, to := range moved {
+        if _, err := tx.Exec("update records set id = ? where id = ?", to, from); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if _, err := tx.Exec("update history set recordId = ? where recordId = ?", to, from); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    log.Printf("[info] records moved to account ids (%d)", len(moved))
+
+    return tx.Commit()
 }
 
 func (db *Client) LoadTableExceptions() error {
@@ -202,15 +409,25 @@ func (db *Client) SaveStatus(records []config.SockTable) error {
             continue
         }
 
-        item.Timestamp = time.Now().UTC().Unix()
-        if item.Relation != rec.Relation {
+        timestamp := time.Now().UTC().Unix()
+
+        if item.Relation.Result != rec.Relation.Result {
+            db.pushQueue(config.StatusEvent{
+                RecordId:  rec.Id,
+                OldResult: item.Relation.Result,
+                NewResult: rec.Relation.Result,
+                Response:  rec.Relation.Response,
+                Timestamp: timestamp,
+            })
+        }
+
+        // The stored timestamp is refreshed once a day, which is enough
+        // for history_days to survive a restart
+        if item.Relation != rec.Relation || item.Timestamp / 86400 != timestamp / 86400 {
             item.Relation = rec.Relation
-            if len(db.queue) < queue_limit {
-                db.queue <- rec
-            } else {
-                log.Print("[error] DB write queue is full")
-            }
+            db.pushQueue(item)
         }
+        item.Timestamp = timestamp
         db.records.items[rec.Id] = item
     }
 
@@ -225,28 +442,25 @@ func (db *Client) SaveNetstat(records []config.SockTable) error {
 
         rec.Id = config.GetIdRec(&rec)
 
-        _, found := db.records.items[rec.Id]
-        if !found && len(db.records.items) >= db.config.Limit {
-            return errors.New("cache limit exceeded")
+        item, found := db.records.items[rec.Id]
+        if !found && db.full(rec) {
+            return fmt.Errorf("cache limit exceeded for account %v", rec.Options.AccountID)
         }
 
         if found {
+            // Labels sent with the netstat are defaults, stored labels win
+            if labels, ok := config.DefaultLabels(item.Labels, rec.Labels); ok {
+                item.Labels = labels
+                db.pushQueue(item)
+                db.records.items[rec.Id] = item
+            }
             continue
         }
 
-        if len(db.queue) < queue_limit {
-            db.queue <- rec
-        } else {
-            log.Print("[error] DB write queue is full")
-        }
-
-        if _, ok := db.records.index[rec.LocalAddr.Name]; !ok {
-            db.records.index[rec.LocalAddr.Name] = make(map[string]bool)
-        }
+        db.pushQueue(rec)
 
         rec.Timestamp = time.Now().UTC().Unix()
-        db.records.index[rec.LocalAddr.Name][rec.Id] = true
-        db.records.items[rec.Id] = rec
+        db.records.add(rec)
     }
 
     return nil
@@ -283,31 +497,71 @@ func (db *Client) SaveTracert(records []config.SockTable) error {
 }
 
 func (db *Client) LoadRecords(args config.RecArgs) ([]config.SockTable, error) {
+    match, err := filter.Match(args)
+    if err != nil {
+        return nil, err
+    }
+
     db.records.RLock()
     defer db.records.RUnlock()
 
     var items []config.SockTable
 
-    if args.SrcName == "" {
-        for _, val := range db.records.items {
+    if args.Id != "" {
+        if val, ok := db.records.items[args.Id]; ok && match(val) {
             items = append(items, val)
         }
         return items, nil
-    } 
-    
-    if _, ok := db.records.index[args.SrcName]; ok {
+    }
+
+    if args.SrcName != "" {
         for key, _ := range db.records.index[args.SrcName] {
-            if val, ok := db.records.items[key]; ok {
+            if val, ok := db.records.items[key]; ok && match(val) {
                 items = append(items, val)
             }
         }
+        return items, nil
+    }
+
+    if args.AccountID != "" {
+        account, err := strconv.ParseUint(args.AccountID, 10, 32)
+        if err != nil {
+            return items, fmt.Errorf("invalid account id: %v", args.AccountID)
+        }
+        for key, _ := range db.records.accounts[uint32(account)] {
+            if val, ok := db.records.items[key]; ok && match(val) {
+                items = append(items, val)
+            }
+        }
+        return items, nil
+    }
+
+    for _, val := range db.records.items {
+        if match(val) {
+            items = append(items, val)
+        }
     }
 
     return items, nil
 }
 
-func (db *Client) SaveRecord(rec config.SockTable) error {
-    sql := "replace into records (id,timestamp,localName,localIP,remoteName,remoteIP,relation,options) values (?,?,?,?,?,?,?,?)"
+func (db *Client) LoadExpiredRecords(timestamp int64) ([]config.SockTable, error) {
+    db.records.RLock()
+    defer db.records.RUnlock()
+
+    var items []config.SockTable
+
+    for _, val := range db.records.items {
+        if val.Timestamp < timestamp {
+            items = append(items, val)
+        }
+    }
+
+    return items, nil
+}
+
+func (db *Client) saveRecord(tx execer, rec config.SockTable) error {
+    sql := "replace into records (id,timestamp,localName,localIP,remoteName,remoteIP,relation,options,accountId,labels) values (?,?,?,?,?,?,?,?,?,?)"
 
     relation, err := json.Marshal(rec.Relation)
     if err != nil {
@@ -318,8 +572,17 @@ func (db *Client) SaveRecord(rec config.SockTable) error {
     if err != nil {
         return err
     }
+
+    var labels interface{}
+    if len(rec.Labels) > 0 {
+        jsn, err := json.Marshal(rec.Labels)
+        if err != nil {
+            return err
+        }
+        labels = jsn
+    }
         
-    _, err = db.client.Exec(
+    _, err = tx.Exec(
         sql, 
         rec.Id, 
         time.Now().UTC().Unix(),
@@ -329,6 +592,8 @@ func (db *Client) SaveRecord(rec config.SockTable) error {
         rec.RemoteAddr.IP,
         relation, 
         options, 
+        rec.Options.AccountID,
+        labels,
     )
 
     if err != nil {
@@ -347,25 +612,21 @@ func (db *Client) SaveRecords(records []config.SockTable) error {
         rec.Id = config.GetIdRec(&rec)
 
         item, found := db.records.items[rec.Id]
-        if !found && len(db.records.items) >= db.config.Limit {
-            return errors.New("cache limit exceeded")
+        if !found && db.full(rec) {
+            return fmt.Errorf("cache limit exceeded for account %v", rec.Options.AccountID)
         }
 
-        if !found || (item.Relation != rec.Relation || item.Options != rec.Options) {
-            if len(db.queue) < queue_limit {
-                db.queue <- rec
-            } else {
-                log.Print("[error] DB write queue is full")
-            }
+        if !found || (item.Relation != rec.Relation || item.Options != rec.Options || !config.SameLabels(item.Labels, rec.Labels)) {
+            db.pushQueue(rec)
         }
 
-        if _, ok := db.records.index[rec.LocalAddr.Name]; !ok {
-            db.records.index[rec.LocalAddr.Name] = make(map[string]bool)
+        // A record that moved to another host leaves its old name index
+        if found && item.LocalAddr.Name != rec.LocalAddr.Name {
+            db.records.del(rec.Id)
         }
 
         rec.Timestamp = time.Now().UTC().Unix()
-        db.records.index[rec.LocalAddr.Name][rec.Id] = true
-        db.records.items[rec.Id] = rec
+        db.records.add(rec)
         
     }
 
@@ -376,28 +637,84 @@ func (db *Client) DelRecords(ids []string) error {
     db.records.Lock()
     defer db.records.Unlock()
 
-    sql := "delete from records where id = ?"
-
     for _, id := range ids {
-        _, err := db.client.Exec(sql, id)
-        if err != nil { return err }
+        db.pushQueue(recordDel(id))
+        db.records.del(id)
+    }
+    
+    return nil
+}
 
-        rec, found := db.records.items[id]
-        if !found { continue }
+func (db *Client) saveEvent(tx execer, event config.StatusEvent) error {
+    sql := "insert into history (recordId,oldResult,newResult,response,timestamp) values (?,?,?,?,?)"
 
-        if _, ok := db.records.index[rec.LocalAddr.Name]; ok {
-            if _, ok := db.records.index[rec.LocalAddr.Name][id]; ok {
-                delete(db.records.index[rec.LocalAddr.Name], id)
-            }
-            if len(db.records.index[rec.LocalAddr.Name]) == 0 {
-                delete(db.records.index, rec.LocalAddr.Name)
-            }
+    _, err := tx.Exec(
+        sql,
+        event.RecordId,
+        event.OldResult,
+        event.NewResult,
+        event.Response,
+        event.Timestamp,
+    )
+
+    return err
+}
+
+func (db *Client) LoadHistory(args config.HistArgs) ([]config.StatusEvent, error) {
+    var items []config.StatusEvent
+
+    query := "select recordId,oldResult,newResult,response,timestamp from history where timestamp >= ?"
+    params := []interface{}{args.Start}
+
+    if args.End > 0 {
+        query = query + " and timestamp <= ?"
+        params = append(params, args.End)
+    }
+
+    if args.Id != "" {
+        query = query + " and recordId = ?"
+        params = append(params, args.Id)
+    } else if args.SrcName != "" {
+        db.records.RLock()
+        ids := []string{}
+        for id := range db.records.index[args.SrcName] {
+            ids = append(ids, id)
+        }
+        db.records.RUnlock()
+
+        if len(ids) == 0 {
+            return items, nil
+        }
+
+        query = query + " and recordId in (?" + strings.Repeat(",?", len(ids)-1) + ")"
+        for _, id := range ids {
+            params = append(params, id)
         }
-    
-        delete(db.records.items, id)
     }
-    
-    return nil
+
+    rows, err := db.client.Query(query + " order by timestamp", params...)
+    if err != nil { return items, err }
+    defer rows.Close()
+
+    for rows.Next() {
+        var event config.StatusEvent
+        err := rows.Scan(
+            &event.RecordId,
+            &event.OldResult,
+            &event.NewResult,
+            &event.Response,
+            &event.Timestamp,
+        )
+        if err != nil { return items, err }
+        items = append(items, event)
+    }
+
+    return items, rows.Err()
+}
+
+func (db *Client) DelHistory(timestamp int64) error {
+    _, err := db.client.Exec("delete from history where timestamp < ?", timestamp)
+    return err
 }
 
 func (db *Client) LoadExceptions(args config.ExpArgs) ([]config.Exception, error) {
@@ -467,4 +784,131 @@ func (db *Client) DelExceptions(ids []string) error {
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+func (db *Client) LoadMembers() ([]string, error) {
+    var items []string
+
+    rows, err := db.client.Query("select address from members order by address")
+    if err != nil { return items, err }
+    defer rows.Close()
+
+    for rows.Next() {
+        var address string
+        if err := rows.Scan(&address); err != nil {
+            return items, err
+        }
+        items = append(items, address)
+    }
+
+    return items, rows.Err()
+}
+
+func (db *Client) SaveMembers(ids []string) error {
+    sql := "replace into members (address,timestamp) values (?,?)"
+
+    for _, id := range ids {
+        _, err := db.client.Exec(sql, id, time.Now().UTC().Unix())
+        if err != nil { return err }
+    }
+
+    return nil
+}
+
+func (db *Client) DelMembers(ids []string) error {
+    sql := "delete from members where address = ?"
+
+    for _, id := range ids {
+        _, err := db.client.Exec(sql, id)
+        if err != nil { return err }
+    }
+
+    return nil
+}
+
+func (db *Client) LoadTokens() ([]config.Token, error) {
+    var items []config.Token
+
+    rows, err := db.client.Query("select id,name,role,accountId,created from tokens order by name")
+    if err != nil { return items, err }
+    defer rows.Close()
+
+    for rows.Next() {
+        var tok config.Token
+        if err := rows.Scan(&tok.Id, &tok.Name, &tok.Role, &tok.AccountID, &tok.Created); err != nil {
+            return items, err
+        }
+        items = append(items, tok)
+    }
+
+    return items, rows.Err()
+}
+
+func (db *Client) SaveTokens(tokens []config.Token) error {
+    sql := "replace into tokens (id,name,role,accountId,created) values (?,?,?,?,?)"
+
+    for _, tok := range tokens {
+        _, err := db.client.Exec(sql, tok.Id, tok.Name, tok.Role, tok.AccountID, tok.Created)
+        if err != nil { return err }
+    }
+
+    return nil
+}
+
+func (db *Client) DelTokens(ids []string) error {
+    sql := "delete from tokens where id = ?"
+
+    for _, id := range ids {
+        _, err := db.client.Exec(sql, id)
+        if err != nil { return err }
+    }
+
+    return nil
+}
+
+func (db *Client) LoadMaintenance() ([]config.Maintenance, error) {
+    var items []config.Maintenance
+
+    rows, err := db.client.Query("select data from maintenance order by name")
+    if err != nil { return items, err }
+    defer rows.Close()
+
+    for rows.Next() {
+        var data []uint8
+        if err := rows.Scan(&data); err != nil {
+            return items, err
+        }
+        var item config.Maintenance
+        if err := json.Unmarshal(data, &item); err != nil {
+            log.Printf("[error] %v", err)
+            continue
+        }
+        items = append(items, item)
+    }
+
+    return items, rows.Err()
+}
+
+func (db *Client) SaveMaintenance(items []config.Maintenance) error {
+    sql := "replace into maintenance (id,name,data) values (?,?,?)"
+
+    for _, item := range items {
+        data, err := json.Marshal(item)
+        if err != nil { return err }
+        _, err = db.client.Exec(sql, item.Id, item.Name, data)
+        if err != nil { return err }
+    }
+
+    return nil
+}
+
+func (db *Client) DelMaintenance(ids []string) error {
+    sql := "delete from maintenance where id = ?"
+
+    for _, id := range ids {
+        _, err := db.client.Exec(sql, id)
+        if err != nil { return err }
+    }
+
+    return nil
+}
@@ -0,0 +1,208 @@
+package sqlite3
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+    "embed"
+    "errors"
+    "strconv"
+    "strings"
+    "database/sql"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+type Migration struct {
+    Version    int
+    Name       string
+    Script     string
+}
+
+// loadMigrations returns the embedded scripts ordered by version,
+// file names have the form <version>_<name>.sql
+func loadMigrations() ([]Migration, error) {
+    var items []Migration
+
+    files, err := migrations.ReadDir("migrations")
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range files {
+        name := strings.TrimSuffix(file.Name(), ".sql")
+        parts := strings.SplitN(name, "_", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid migration name: %v", file.Name())
+        }
+        version, err := strconv.Atoi(parts[0])
+        if err != nil {
+            return nil, fmt.Errorf("invalid migration version: %v", file.Name())
+        }
+        script, err := migrations.ReadFile("migrations/" + file.Name())
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, Migration{Version: version, Name: name, Script: string(script)})
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Version < items[j].Version
+    })
+
+    for i := 1; i < len(items); i++ {
+        if items[i].Version == items[i-1].Version {
+            return nil, fmt.Errorf("duplicate migration version: %v", items[i].Name)
+        }
+    }
+
+    return items, nil
+}
+
+func (db *Client) createSchemaVersion() error {
+    _, err := db.client.Exec(
+      `create table if not exists schema_version (
+        version       int primary key,
+        name          varchar(100) not null,
+        applied       bigint(20) default 0
+      );`)
+    return err
+}
+
+// SchemaVersion returns the version of the last applied migration, it only reads,
+// a database without the schema_version table has version 0
+func (db *Client) SchemaVersion() (int, error) {
+    var tables int
+    if err := db.client.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'schema_version'").Scan(&tables); err != nil {
+        return 0, err
+    }
+    if tables == 0 {
+        return 0, nil
+    }
+
+    var version int
+    if err := db.client.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version); err != nil {
+        return 0, err
+    }
+
+    return version, nil
+}
+
+// pending returns the migrations newer than version, a database created
+// by a newer binary is refused
+func pending(items []Migration, version int) ([]Migration, error) {
+    latest := 0
+    if len(items) > 0 {
+        latest = items[len(items)-1].Version
+    }
+    if version > latest {
+        return nil, fmt.Errorf("database schema version %d is newer than supported %d", version, latest)
+    }
+
+    var list []Migration
+    for _, m := range items {
+        if m.Version > version {
+            list = append(list, m)
+        }
+    }
+    return list, nil
+}
+
+// Pending returns the names of the migrations the database needs without
+// changing it. The file is opened read-only, a missing file needs them all.
+func Pending(conf *config.DB) ([]string, error) {
+    var names []string
+
+    items, err := loadMigrations()
+    if err != nil {
+        return names, err
+    }
+
+    version := 0
+    path := strings.SplitN(conf.ConnString, "?", 2)[0]
+
+    if _, err := os.Stat(path); err == nil {
+        conn, err := sql.Open("sqlite3", "file:" + path + "?mode=ro")
+        if err != nil {
+            return names, err
+        }
+        defer conn.Close()
+
+        db := Client{client: conn}
+        version, err = db.SchemaVersion()
+        if err != nil {
+            return names, err
+        }
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return names, err
+    }
+
+    list, err := pending(items, version)
+    if err != nil {
+        return names, err
+    }
+    for _, m := range list {
+        names = append(names, m.Name)
+    }
+
+    return names, nil
+}
+
+// Migrate applies pending migrations in order, each one in its own transaction,
+// and returns their names. With dryRun nothing is changed. A database created
+// by a newer binary is refused.
+func (db *Client) Migrate(dryRun bool) ([]string, error) {
+    var names []string
+
+    items, err := loadMigrations()
+    if err != nil {
+        return names, err
+    }
+
+    if !dryRun {
+        if err := db.createSchemaVersion(); err != nil {
+            return names, err
+        }
+    }
+
+    version, err := db.SchemaVersion()
+    if err != nil {
+        return names, err
+    }
+
+    list, err := pending(items, version)
+    if err != nil {
+        return names, err
+    }
+
+    for _, m := range list {
+        names = append(names, m.Name)
+        if dryRun {
+            continue
+        }
+
+        tx, err := db.client.Begin()
+        if err != nil {
+            return names, err
+        }
+        if _, err := tx.Exec(m.Script); err != nil {
+            tx.Rollback()
+            return names, fmt.Errorf("migration %v: %v", m.Name, err)
+        }
+        if _, err := tx.Exec("insert into schema_version (version,name,applied) values (?,?,?)", m.Version, m.Name, time.Now().UTC().Unix()); err != nil {
+            tx.Rollback()
+            return names, fmt.Errorf("migration %v: %v", m.Name, err)
+        }
+        if err := tx.Commit(); err != nil {
+            return names, fmt.Errorf("migration %v: %v", m.Name, err)
+        }
+
+        log.Printf("[info] applied migration: %v", m.Name)
+    }
+
+    return names, nil
+}
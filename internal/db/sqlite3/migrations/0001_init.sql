@@ -0,0 +1,18 @@
+create table if not exists records (
+  id            varchar(50) primary key,
+  timestamp     bigint(20) default 0,
+  localName     varchar(50) not null,
+  localIP       varchar(20) not null,
+  remoteName    varchar(50) not null,
+  remoteIP      varchar(20) not null,
+  relation      json,
+  options       json
+);
+create index if not exists localNameIdx
+  ON records (localName);
+create table if not exists exceptions (
+  id            varchar(50) primary key,
+  accountId     int default 0,
+  hostMask      varchar(50) not null,
+  ignoreMask    varchar(50) not null
+);
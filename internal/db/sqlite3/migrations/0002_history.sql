@@ -0,0 +1,9 @@
+create table if not exists history (
+  recordId      varchar(50) not null,
+  oldResult     int default 0,
+  newResult     int default 0,
+  response      real default 0,
+  timestamp     bigint(20) default 0
+);
+create index if not exists historyIdx
+  ON history (recordId, timestamp);
@@ -0,0 +1,4 @@
+create table if not exists members (
+  address       varchar(100) primary key,
+  timestamp     bigint(20) default 0
+);
@@ -0,0 +1,7 @@
+create table if not exists tokens (
+  id            varchar(100) primary key,
+  name          varchar(100) not null,
+  role          varchar(20) not null,
+  accountId     int default 0,
+  created       bigint(20) default 0
+);
@@ -0,0 +1,4 @@
+alter table records add column accountId int default 0;
+update records set accountId = coalesce(json_extract(options, '$.accountID'), 0);
+create index if not exists accountIdx
+  ON records (accountId);
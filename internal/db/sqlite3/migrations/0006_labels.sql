@@ -0,0 +1 @@
+alter table records add column labels json;
@@ -0,0 +1,5 @@
+create table if not exists maintenance (
+  id            varchar(50) primary key,
+  name          varchar(100) not null,
+  data          json
+);
@@ -0,0 +1,336 @@
+// Package filter implements the expression language of the records API.
+//
+// An expression compares record fields with literals and combines the
+// comparisons with &&, || and !, for example
+//
+//     mode == "tcp" && result != 0 && remote.name =~ "db.*" && response > 2
+//
+// String fields support ==, !=, <, <=, >, >=, =~ and !~, regular expressions
+// are anchored at both ends. Number fields support the ordering operators.
+// Record labels are string fields named labels.<name>, a missing label
+// compares as an empty string.
+package filter
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+type kind int
+
+const (
+    labelPrefix = "labels."
+)
+
+const (
+    kindString kind = iota
+    kindNumber
+)
+
+type field struct {
+    kind           kind
+    str            func(config.SockTable) string
+    num            func(config.SockTable) float64
+}
+
+var (
+    fields = map[string]field{
+        "id":              {kind: kindString, str: func(r config.SockTable) string { return r.Id }},
+        "timestamp":       {kind: kindNumber, num: func(r config.SockTable) float64 { return float64(r.Timestamp) }},
+        "local.name":      {kind: kindString, str: func(r config.SockTable) string { return r.LocalAddr.Name }},
+        "local.ip":        {kind: kindString, str: func(r config.SockTable) string { return ipString(r.LocalAddr) }},
+        "remote.name":     {kind: kindString, str: func(r config.SockTable) string { return r.RemoteAddr.Name }},
+        "remote.ip":       {kind: kindString, str: func(r config.SockTable) string { return ipString(r.RemoteAddr) }},
+        "mode":            {kind: kindString, str: func(r config.SockTable) string { return r.Relation.Mode }},
+        "port":            {kind: kindNumber, num: func(r config.SockTable) float64 { return float64(r.Relation.Port) }},
+        "result":          {kind: kindNumber, num: func(r config.SockTable) float64 { return float64(r.Relation.Result) }},
+        "response":        {kind: kindNumber, num: func(r config.SockTable) float64 { return r.Relation.Response }},
+        "trace":           {kind: kindNumber, num: func(r config.SockTable) float64 { return float64(r.Relation.Trace) }},
+        "command":         {kind: kindString, str: func(r config.SockTable) string { return r.Relation.Command }},
+        "service":         {kind: kindString, str: func(r config.SockTable) string { return r.Options.Service }},
+        "status":          {kind: kindString, str: func(r config.SockTable) string { return r.Options.Status }},
+        "timeout":         {kind: kindNumber, num: func(r config.SockTable) float64 { return r.Options.Timeout }},
+        "max_resp_time":   {kind: kindNumber, num: func(r config.SockTable) float64 { return r.Options.MaxRespTime }},
+        "account_id":      {kind: kindNumber, num: func(r config.SockTable) float64 { return float64(r.Options.AccountID) }},
+    }
+
+    // Alternative names following the JSON layout of a record
+    aliases = map[string]string{
+        "localAddr.name":      "local.name",
+        "localAddr.ip":        "local.ip",
+        "remoteAddr.name":     "remote.name",
+        "remoteAddr.ip":       "remote.ip",
+        "src_name":            "local.name",
+        "dst_name":            "remote.name",
+        "relation.mode":       "mode",
+        "relation.port":       "port",
+        "relation.result":     "result",
+        "relation.response":   "response",
+        "relation.trace":      "trace",
+        "relation.command":    "command",
+        "options.service":     "service",
+        "options.status":      "status",
+        "options.timeout":     "timeout",
+        "options.maxRespTime": "max_resp_time",
+        "options.accountID":   "account_id",
+    }
+)
+
+func ipString(addr config.SockAddr) string {
+    if addr.IP == nil {
+        return ""
+    }
+    return addr.IP.String()
+}
+
+func lookup(name string) (field, string, bool) {
+    if alias, ok := aliases[name]; ok {
+        name = alias
+    }
+    if strings.HasPrefix(name, labelPrefix) && len(name) > len(labelPrefix) {
+        label := name[len(labelPrefix):]
+        return field{kind: kindString, str: func(r config.SockTable) string { return r.Labels[label] }}, name, true
+    }
+    f, ok := fields[name]
+    return f, name, ok
+}
+
+// Expr is a parsed expression
+type Expr interface {
+    Eval(rec config.SockTable) bool
+}
+
+type and struct {
+    left, right    Expr
+}
+
+func (e and) Eval(rec config.SockTable) bool {
+    return e.left.Eval(rec) && e.right.Eval(rec)
+}
+
+type or struct {
+    left, right    Expr
+}
+
+func (e or) Eval(rec config.SockTable) bool {
+    return e.left.Eval(rec) || e.right.Eval(rec)
+}
+
+type not struct {
+    expr           Expr
+}
+
+func (e not) Eval(rec config.SockTable) bool {
+    return !e.expr.Eval(rec)
+}
+
+type compare struct {
+    field          field
+    op             string
+    str            string
+    num            float64
+    re             *regexp.Regexp
+}
+
+func (e compare) Eval(rec config.SockTable) bool {
+    if e.field.kind == kindNumber {
+        v := e.field.num(rec)
+        switch e.op {
+            case "==": return v == e.num
+            case "!=": return v != e.num
+            case "<":  return v < e.num
+            case "<=": return v <= e.num
+            case ">":  return v > e.num
+            case ">=": return v >= e.num
+        }
+        return false
+    }
+
+    v := e.field.str(rec)
+    switch e.op {
+        case "==": return v == e.str
+        case "!=": return v != e.str
+        case "<":  return v < e.str
+        case "<=": return v <= e.str
+        case ">":  return v > e.str
+        case ">=": return v >= e.str
+        case "=~": return e.re.MatchString(v)
+        case "!~": return !e.re.MatchString(v)
+    }
+    return false
+}
+
+// Parse compiles an expression, an empty one matches every record
+func Parse(s string) (Expr, error) {
+    if strings.TrimSpace(s) == "" {
+        return nil, nil
+    }
+
+    tokens, err := lex(s)
+    if err != nil {
+        return nil, err
+    }
+
+    p := &parser{tokens: tokens}
+    expr, err := p.or()
+    if err != nil {
+        return nil, err
+    }
+    if tok := p.peek(); tok.typ != tokEOF {
+        return nil, fmt.Errorf("filter: unexpected %q at %d", tok.text, tok.pos)
+    }
+
+    return expr, nil
+}
+
+// Match returns the selection of records by the arguments every backend has
+// to honor: id, type (the relation mode), account and the filter expression
+func Match(args config.RecArgs) (func(config.SockTable) bool, error) {
+    expr, err := Parse(args.Filter)
+    if err != nil {
+        return nil, err
+    }
+
+    return func(rec config.SockTable) bool {
+        if args.Id != "" && rec.Id != args.Id {
+            return false
+        }
+        if args.Type != "" && rec.Relation.Mode != args.Type {
+            return false
+        }
+        if args.SrcName != "" && rec.LocalAddr.Name != args.SrcName {
+            return false
+        }
+        if !args.HasAccount(rec.Options.AccountID) {
+            return false
+        }
+        return expr == nil || expr.Eval(rec)
+    }, nil
+}
+
+type parser struct {
+    tokens         []token
+    pos            int
+}
+
+func (p *parser) peek() token {
+    return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+    tok := p.tokens[p.pos]
+    if tok.typ != tokEOF {
+        p.pos++
+    }
+    return tok
+}
+
+func (p *parser) or() (Expr, error) {
+    left, err := p.and()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek().text == "||" {
+        p.next()
+        right, err := p.and()
+        if err != nil {
+            return nil, err
+        }
+        left = or{left, right}
+    }
+    return left, nil
+}
+
+func (p *parser) and() (Expr, error) {
+    left, err := p.unary()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek().text == "&&" {
+        p.next()
+        right, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        left = and{left, right}
+    }
+    return left, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+    tok := p.peek()
+
+    if tok.typ == tokOp && tok.text == "!" {
+        p.next()
+        expr, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        return not{expr}, nil
+    }
+
+    if tok.typ == tokOp && tok.text == "(" {
+        p.next()
+        expr, err := p.or()
+        if err != nil {
+            return nil, err
+        }
+        if end := p.next(); end.text != ")" {
+            return nil, fmt.Errorf("filter: expected \")\" at %d", end.pos)
+        }
+        return expr, nil
+    }
+
+    return p.comparison()
+}
+
+func (p *parser) comparison() (Expr, error) {
+    name := p.next()
+    if name.typ != tokIdent {
+        return nil, fmt.Errorf("filter: expected field at %d", name.pos)
+    }
+
+    f, _, ok := lookup(name.text)
+    if !ok {
+        return nil, fmt.Errorf("filter: unknown field %q at %d", name.text, name.pos)
+    }
+
+    op := p.next()
+    switch op.text {
+        case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+        default:
+            return nil, fmt.Errorf("filter: expected operator at %d", op.pos)
+    }
+
+    value := p.next()
+    expr := compare{field: f, op: op.text}
+
+    if f.kind == kindNumber {
+        if value.typ != tokNumber {
+            return nil, fmt.Errorf("filter: field %q needs a number at %d", name.text, value.pos)
+        }
+        if op.text == "=~" || op.text == "!~" {
+            return nil, fmt.Errorf("filter: operator %v needs a string field at %d", op.text, op.pos)
+        }
+        expr.num, _ = strconv.ParseFloat(value.text, 64)
+        return expr, nil
+    }
+
+    if value.typ != tokString {
+        return nil, fmt.Errorf("filter: field %q needs a string at %d", name.text, value.pos)
+    }
+    expr.str = value.text
+
+    if op.text == "=~" || op.text == "!~" {
+        re, err := regexp.Compile("^(?:" + value.text + ")$")
+        if err != nil {
+            return nil, fmt.Errorf("filter: %v", err)
+        }
+        expr.re = re
+    }
+
+    return expr, nil
+}
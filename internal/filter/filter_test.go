@@ -0,0 +1,119 @@
+package filter
+
+import (
+    "net"
+    "testing"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+var testRecord = config.SockTable{
+    Id:         "abc",
+    Timestamp:  1700000000,
+    LocalAddr:  config.SockAddr{IP: net.ParseIP("10.0.0.1"), Name: "app1"},
+    RemoteAddr: config.SockAddr{IP: net.ParseIP("10.0.1.1"), Name: "db1"},
+    Relation:   config.Relation{Mode: "tcp", Port: 5432, Result: 2, Response: 2.5},
+    Options:    config.Options{Service: "postgres", Timeout: 1, AccountID: 7},
+    Labels:     map[string]string{"team": "core"},
+}
+
+func TestParseErrors(t *testing.T) {
+    tests := []struct {
+        expr       string
+        valid      bool
+    }{
+        {"", true},
+        {"   ", true},
+        {`mode == "tcp"`, true},
+        {`(mode == "tcp" || mode == "udp") && !(port < 1024)`, true},
+        {`labels.team == "core"`, true},
+        {`localAddr.name =~ "app.*"`, true},
+        {`mode`, false},
+        {`mode ==`, false},
+        {`mode == tcp`, false},
+        {`port == "5432"`, false},
+        {`port =~ "54.*"`, false},
+        {`unknown == "x"`, false},
+        {`labels. == "x"`, false},
+        {`mode == "tcp" &&`, false},
+        {`(mode == "tcp"`, false},
+        {`mode == "tcp")`, false},
+        {`remote.name =~ "("`, false},
+    }
+
+    for _, tt := range tests {
+        _, err := Parse(tt.expr)
+        if (err == nil) != tt.valid {
+            t.Errorf("Parse(%q) error = %v, want valid %v", tt.expr, err, tt.valid)
+        }
+    }
+}
+
+func TestEval(t *testing.T) {
+    tests := []struct {
+        expr       string
+        match      bool
+    }{
+        {`mode == "tcp"`, true},
+        {`mode != "tcp"`, false},
+        {`port == 5432`, true},
+        {`port >= 5432 && port < 5433`, true},
+        {`result != 0 && response > 2`, true},
+        {`response <= 2`, false},
+        {`remote.name =~ "db.*"`, true},
+        {`remote.name =~ "db"`, false},
+        {`remote.name !~ "web.*"`, true},
+        {`local.ip == "10.0.0.1"`, true},
+        {`src_name == "app1" && dst_name == "db1"`, true},
+        {`options.accountID == 7`, true},
+        {`labels.team == "core"`, true},
+        {`labels.env == ""`, true},
+        {`!(mode == "tcp")`, false},
+        {`mode == "udp" || service == "postgres"`, true},
+        {`mode == "udp" || mode == "tcp" && port == 80`, false},
+        {`(mode == "udp" || mode == "tcp") && port == 5432`, true},
+    }
+
+    for _, tt := range tests {
+        expr, err := Parse(tt.expr)
+        if err != nil {
+            t.Fatalf("Parse(%q): %v", tt.expr, err)
+        }
+        if got := expr.Eval(testRecord); got != tt.match {
+            t.Errorf("Parse(%q).Eval() = %v, want %v", tt.expr, got, tt.match)
+        }
+    }
+}
+
+func TestMatch(t *testing.T) {
+    tests := []struct {
+        name       string
+        args       config.RecArgs
+        match      bool
+    }{
+        {"empty", config.RecArgs{}, true},
+        {"id", config.RecArgs{Id: "abc"}, true},
+        {"other id", config.RecArgs{Id: "abd"}, false},
+        {"type", config.RecArgs{Type: "tcp"}, true},
+        {"other type", config.RecArgs{Type: "udp"}, false},
+        {"src_name", config.RecArgs{SrcName: "app1"}, true},
+        {"other src_name", config.RecArgs{SrcName: "app2"}, false},
+        {"account", config.RecArgs{AccountID: "7"}, true},
+        {"other account", config.RecArgs{AccountID: "0"}, false},
+        {"filter", config.RecArgs{Filter: `port == 5432`}, true},
+        {"filter and type", config.RecArgs{Type: "tcp", Filter: `port == 80`}, false},
+    }
+
+    for _, tt := range tests {
+        match, err := Match(tt.args)
+        if err != nil {
+            t.Fatalf("%v: %v", tt.name, err)
+        }
+        if got := match(testRecord); got != tt.match {
+            t.Errorf("%v: Match() = %v, want %v", tt.name, got, tt.match)
+        }
+    }
+
+    if _, err := Match(config.RecArgs{Filter: `port ==`}); err == nil {
+        t.Errorf("Match() with an invalid filter returned no error")
+    }
+}
@@ -0,0 +1,114 @@
+package filter
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+type tokenType int
+
+const (
+    tokEOF tokenType = iota
+    tokIdent
+    tokString
+    tokNumber
+    tokOp
+)
+
+type token struct {
+    typ            tokenType
+    text           string
+    pos            int
+}
+
+var (
+    // Longer operators first so that "<=" is not read as "<"
+    operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")"}
+)
+
+func isIdent(c byte, first bool) bool {
+    switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+            return true
+        case c >= '0' && c <= '9', c == '.':
+            return !first
+    }
+    return false
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func lex(s string) ([]token, error) {
+    var tokens []token
+
+    for i := 0; i < len(s); {
+        c := s[i]
+
+        switch {
+            case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+                i++
+
+            case isIdent(c, true):
+                start := i
+                for i < len(s) && isIdent(s[i], false) {
+                    i++
+                }
+                tokens = append(tokens, token{tokIdent, s[start:i], start})
+
+            case isDigit(c) || (c == '-' && i+1 < len(s) && isDigit(s[i+1])):
+                start := i
+                i++
+                for i < len(s) && (isDigit(s[i]) || s[i] == '.' || s[i] == 'e' || s[i] == 'E') {
+                    i++
+                }
+                if _, err := strconv.ParseFloat(s[start:i], 64); err != nil {
+                    return nil, fmt.Errorf("filter: invalid number %q at %d", s[start:i], start)
+                }
+                tokens = append(tokens, token{tokNumber, s[start:i], start})
+
+            case c == '"' || c == '\'':
+                start := i
+                i++
+                for i < len(s) && s[i] != c {
+                    if s[i] == '\\' {
+                        i++
+                    }
+                    i++
+                }
+                if i >= len(s) {
+                    return nil, fmt.Errorf("filter: unterminated string at %d", start)
+                }
+                i++
+                text := s[start:i]
+                if c == '\'' {
+                    // Single quoted strings only escape the quote
+                    text = strings.ReplaceAll(text[1:len(text)-1], "\\'", "'")
+                } else {
+                    var err error
+                    if text, err = strconv.Unquote(text); err != nil {
+                        return nil, fmt.Errorf("filter: invalid string at %d", start)
+                    }
+                }
+                tokens = append(tokens, token{tokString, text, start})
+
+            default:
+                found := false
+                for _, op := range operators {
+                    if strings.HasPrefix(s[i:], op) {
+                        tokens = append(tokens, token{tokOp, op, i})
+                        i += len(op)
+                        found = true
+                        break
+                    }
+                }
+                if !found {
+                    return nil, fmt.Errorf("filter: unexpected %q at %d", c, i)
+                }
+        }
+    }
+
+    return append(tokens, token{tokEOF, "", len(s)}), nil
+}
@@ -0,0 +1,166 @@
+package filter
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "encoding/json"
+    "encoding/base64"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+// SortKey orders records by a field, records with equal keys are ordered by id
+type SortKey struct {
+    Field          string
+    Desc           bool
+}
+
+// cursor is the position after the last record of a page
+type cursor struct {
+    Sort           string                 `json:"s"`
+    Values         []interface{}          `json:"v"`
+    Id             string                 `json:"id"`
+}
+
+// ParseSort reads a comma separated list of fields, a leading "-" sorts descending
+func ParseSort(s string) ([]SortKey, error) {
+    var keys []SortKey
+
+    for _, name := range strings.Split(s, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        key := SortKey{}
+        if strings.HasPrefix(name, "-") {
+            key.Desc = true
+            name = name[1:]
+        }
+        _, canonical, ok := lookup(name)
+        if !ok {
+            return nil, fmt.Errorf("unknown sort field: %v", name)
+        }
+        key.Field = canonical
+        keys = append(keys, key)
+    }
+
+    return keys, nil
+}
+
+func sortSpec(keys []SortKey) string {
+    var items []string
+    for _, key := range keys {
+        if key.Desc {
+            items = append(items, "-"+key.Field)
+        } else {
+            items = append(items, key.Field)
+        }
+    }
+    return strings.Join(items, ",")
+}
+
+func values(rec config.SockTable, keys []SortKey) []interface{} {
+    items := make([]interface{}, 0, len(keys))
+    for _, key := range keys {
+        f, _, _ := lookup(key.Field)
+        if f.kind == kindNumber {
+            items = append(items, f.num(rec))
+        } else {
+            items = append(items, f.str(rec))
+        }
+    }
+    return items
+}
+
+func compareValue(a, b interface{}) int {
+    switch a := a.(type) {
+        case float64:
+            b, _ := b.(float64)
+            switch {
+                case a < b: return -1
+                case a > b: return 1
+            }
+        case string:
+            b, _ := b.(string)
+            return strings.Compare(a, b)
+    }
+    return 0
+}
+
+// comparePos orders two positions given by their key values and ids
+func comparePos(keys []SortKey, a []interface{}, aid string, b []interface{}, bid string) int {
+    for i, key := range keys {
+        if i >= len(a) || i >= len(b) {
+            break
+        }
+        if c := compareValue(a[i], b[i]); c != 0 {
+            if key.Desc {
+                return -c
+            }
+            return c
+        }
+    }
+    return strings.Compare(aid, bid)
+}
+
+// Page sorts the records and returns up to limit of them after the cursor
+// with the cursor of the next page, which is empty on the last page.
+// A limit of zero returns all remaining records.
+func Page(items []config.SockTable, keys []SortKey, limit int, after string) ([]config.SockTable, string, error) {
+    spec := sortSpec(keys)
+
+    keyed := make([][]interface{}, len(items))
+    for i, item := range items {
+        keyed[i] = values(item, keys)
+    }
+
+    index := make([]int, len(items))
+    for i := range index {
+        index[i] = i
+    }
+    sort.Slice(index, func(i, j int) bool {
+        a, b := index[i], index[j]
+        return comparePos(keys, keyed[a], items[a].Id, keyed[b], items[b].Id) < 0
+    })
+
+    start := 0
+    if after != "" {
+        data, err := base64.RawURLEncoding.DecodeString(after)
+        if err != nil {
+            return nil, "", fmt.Errorf("invalid cursor")
+        }
+        var pos cursor
+        if err := json.Unmarshal(data, &pos); err != nil {
+            return nil, "", fmt.Errorf("invalid cursor")
+        }
+        if pos.Sort != spec || len(pos.Values) != len(keys) {
+            return nil, "", fmt.Errorf("cursor does not match sort: %v", spec)
+        }
+        start = sort.Search(len(index), func(i int) bool {
+            n := index[i]
+            return comparePos(keys, keyed[n], items[n].Id, pos.Values, pos.Id) > 0
+        })
+    }
+
+    end := len(index)
+    if limit > 0 && start+limit < end {
+        end = start + limit
+    }
+
+    page := make([]config.SockTable, 0, end-start)
+    for _, n := range index[start:end] {
+        page = append(page, items[n])
+    }
+
+    if end == len(index) || len(page) == 0 {
+        return page, "", nil
+    }
+
+    last := page[len(page)-1]
+    data, err := json.Marshal(cursor{Sort: spec, Values: values(last, keys), Id: last.Id})
+    if err != nil {
+        return nil, "", err
+    }
+
+    return page, base64.RawURLEncoding.EncodeToString(data), nil
+}
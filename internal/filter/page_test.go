@@ -0,0 +1,112 @@
+package filter
+
+import (
+    "fmt"
+    "testing"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+func pageRecords() []config.SockTable {
+    var items []config.SockTable
+    for i := 0; i < 7; i++ {
+        items = append(items, config.SockTable{
+            Id:        fmt.Sprintf("id%d", i),
+            LocalAddr: config.SockAddr{Name: fmt.Sprintf("host%d", i%3)},
+            Relation:  config.Relation{Port: uint16(100 - i)},
+        })
+    }
+    return items
+}
+
+func pageIds(items []config.SockTable) string {
+    var s string
+    for _, item := range items {
+        s += item.Id + " "
+    }
+    return s
+}
+
+func TestParseSort(t *testing.T) {
+    tests := []struct {
+        spec       string
+        keys       []SortKey
+        valid      bool
+    }{
+        {"", nil, true},
+        {"port", []SortKey{{"port", false}}, true},
+        {"-port, src_name", []SortKey{{"port", true}, {"local.name", false}}, true},
+        {"labels.team", []SortKey{{"labels.team", false}}, true},
+        {"unknown", nil, false},
+    }
+
+    for _, tt := range tests {
+        keys, err := ParseSort(tt.spec)
+        if (err == nil) != tt.valid {
+            t.Errorf("ParseSort(%q) error = %v, want valid %v", tt.spec, err, tt.valid)
+            continue
+        }
+        if fmt.Sprint(keys) != fmt.Sprint(tt.keys) {
+            t.Errorf("ParseSort(%q) = %v, want %v", tt.spec, keys, tt.keys)
+        }
+    }
+}
+
+func TestPage(t *testing.T) {
+    tests := []struct {
+        spec       string
+        limit      int
+        want       string
+    }{
+        {"", 0, "id0 id1 id2 id3 id4 id5 id6 "},
+        {"", 3, "id0 id1 id2 id3 id4 id5 id6 "},
+        {"port", 2, "id6 id5 id4 id3 id2 id1 id0 "},
+        {"-port", 4, "id0 id1 id2 id3 id4 id5 id6 "},
+        {"src_name", 3, "id0 id3 id6 id1 id4 id2 id5 "},
+        {"-src_name,-port", 5, "id2 id5 id1 id4 id0 id3 id6 "},
+    }
+
+    for _, tt := range tests {
+        keys, err := ParseSort(tt.spec)
+        if err != nil {
+            t.Fatalf("ParseSort(%q): %v", tt.spec, err)
+        }
+
+        // Walk the pages until the cursor is empty
+        var got string
+        var cursor string
+        for n := 0; n < 10; n++ {
+            var page []config.SockTable
+            page, cursor, err = Page(pageRecords(), keys, tt.limit, cursor)
+            if err != nil {
+                t.Fatalf("Page(%q): %v", tt.spec, err)
+            }
+            if tt.limit > 0 && len(page) > tt.limit {
+                t.Errorf("Page(%q) returned %d records, limit %d", tt.spec, len(page), tt.limit)
+            }
+            got += pageIds(page)
+            if cursor == "" {
+                break
+            }
+        }
+
+        if got != tt.want {
+            t.Errorf("Page(%q, %d) = %q, want %q", tt.spec, tt.limit, got, tt.want)
+        }
+    }
+}
+
+func TestPageCursor(t *testing.T) {
+    keys, _ := ParseSort("port")
+    _, cursor, err := Page(pageRecords(), keys, 2, "")
+    if err != nil || cursor == "" {
+        t.Fatalf("Page() cursor = %q, error = %v", cursor, err)
+    }
+
+    other, _ := ParseSort("-port")
+    if _, _, err := Page(pageRecords(), other, 2, cursor); err == nil {
+        t.Errorf("Page() accepted a cursor of another sort")
+    }
+    if _, _, err := Page(pageRecords(), keys, 2, "not a cursor"); err == nil {
+        t.Errorf("Page() accepted an invalid cursor")
+    }
+}
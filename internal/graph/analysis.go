@@ -0,0 +1,311 @@
+package graph
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+const (
+    // Default length of the fan-in and fan-out rankings
+    rankLimit = 10
+)
+
+// Bridge is a connection between two hosts whose loss splits the map,
+// Edges lists the relations between them in either direction
+type Bridge struct {
+    Hosts          []string               `json:"hosts"`
+    Edges          []string               `json:"edges"`
+}
+
+// Rank is the number of distinct hosts a host is connected to
+type Rank struct {
+    Host           string                 `json:"host"`
+    Count          int                    `json:"count"`
+}
+
+// Analysis describes the structure of the graph. Articulation points and
+// bridges treat relations as undirected, cycles are strongly connected
+// components of the directed graph with more than one host.
+type Analysis struct {
+    Nodes          int                    `json:"nodes"`
+    Edges          int                    `json:"edges"`
+    Articulation   []string               `json:"articulationPoints"`
+    Bridges        []Bridge               `json:"bridges"`
+    Cycles         [][]string             `json:"cycles"`
+    FanIn          []Rank                 `json:"fanIn"`
+    FanOut         []Rank                 `json:"fanOut"`
+}
+
+// Analyze returns the single points of failure, the circular dependencies
+// and the hosts with the most clients and servers, top limits the rankings
+func (g *Graph) Analyze(top int) *Analysis {
+    if top <= 0 {
+        top = rankLimit
+    }
+
+    points, bridges := g.cuts()
+
+    return &Analysis{
+        Nodes:        len(g.Nodes),
+        Edges:        len(g.Edges),
+        Articulation: points,
+        Bridges:      bridges,
+        Cycles:       g.cycles(),
+        FanIn:        g.ranks(Upstream, top),
+        FanOut:       g.ranks(Downstream, top),
+    }
+}
+
+// neighbors returns the distinct hosts connected to every host, ignoring direction
+func (g *Graph) neighbors() map[string][]string {
+    seen := map[string]map[string]bool{}
+    for _, n := range g.Nodes {
+        seen[n.Id] = map[string]bool{}
+    }
+    for _, e := range g.Edges {
+        if e.Source == e.Target {
+            continue
+        }
+        seen[e.Source][e.Target] = true
+        seen[e.Target][e.Source] = true
+    }
+
+    adj := make(map[string][]string, len(seen))
+    for id, items := range seen {
+        adj[id] = []string{}
+        for n := range items {
+            adj[id] = append(adj[id], n)
+        }
+        sort.Strings(adj[id])
+    }
+    return adj
+}
+
+func pairKey(a, b string) string {
+    if a > b {
+        a, b = b, a
+    }
+    return a + "\x00" + b
+}
+
+// cuts finds the articulation points and bridges with the low-link algorithm
+// of Hopcroft and Tarjan, the relations between two hosts form one connection
+func (g *Graph) cuts() ([]string, []Bridge) {
+    adj := g.neighbors()
+
+    order := map[string]int{}
+    low := map[string]int{}
+    points := map[string]bool{}
+    pairs := map[string][]string{}
+    counter := 0
+
+    var visit func(id, parent string)
+    visit = func(id, parent string) {
+        counter++
+        order[id] = counter
+        low[id] = counter
+        children := 0
+
+        for _, n := range adj[id] {
+            if n == parent {
+                continue
+            }
+            if _, ok := order[n]; ok {
+                if order[n] < low[id] {
+                    low[id] = order[n]
+                }
+                continue
+            }
+
+            children++
+            visit(n, id)
+
+            if low[n] < low[id] {
+                low[id] = low[n]
+            }
+            if parent != "" && low[n] >= order[id] {
+                points[id] = true
+            }
+            if low[n] > order[id] {
+                pairs[pairKey(id, n)] = []string{id, n}
+            }
+        }
+
+        if parent == "" && children > 1 {
+            points[id] = true
+        }
+    }
+
+    for _, n := range g.Nodes {
+        if _, ok := order[n.Id]; !ok {
+            visit(n.Id, "")
+        }
+    }
+
+    result := []string{}
+    for id := range points {
+        result = append(result, id)
+    }
+    sort.Strings(result)
+
+    edges := map[string][]string{}
+    for _, e := range g.Edges {
+        key := pairKey(e.Source, e.Target)
+        if _, ok := pairs[key]; ok {
+            edges[key] = append(edges[key], e.Id)
+        }
+    }
+
+    bridges := []Bridge{}
+    for key, hosts := range pairs {
+        sort.Strings(hosts)
+        bridges = append(bridges, Bridge{Hosts: hosts, Edges: edges[key]})
+    }
+    sort.Slice(bridges, func(i, j int) bool {
+        if bridges[i].Hosts[0] != bridges[j].Hosts[0] {
+            return bridges[i].Hosts[0] < bridges[j].Hosts[0]
+        }
+        return bridges[i].Hosts[1] < bridges[j].Hosts[1]
+    })
+
+    return result, bridges
+}
+
+// cycles returns the strongly connected components with more than one host,
+// found with the algorithm of Tarjan, hosts and components are sorted
+func (g *Graph) cycles() [][]string {
+    adj := map[string][]string{}
+    for _, e := range g.Edges {
+        if e.Source != e.Target {
+            adj[e.Source] = append(adj[e.Source], e.Target)
+        }
+    }
+
+    order := map[string]int{}
+    low := map[string]int{}
+    stacked := map[string]bool{}
+    var stack []string
+    counter := 0
+    items := [][]string{}
+
+    var visit func(id string)
+    visit = func(id string) {
+        counter++
+        order[id] = counter
+        low[id] = counter
+        stack = append(stack, id)
+        stacked[id] = true
+
+        for _, n := range adj[id] {
+            if _, ok := order[n]; !ok {
+                visit(n)
+                if low[n] < low[id] {
+                    low[id] = low[n]
+                }
+            } else if stacked[n] && order[n] < low[id] {
+                low[id] = order[n]
+            }
+        }
+
+        if low[id] != order[id] {
+            return
+        }
+
+        var component []string
+        for {
+            n := stack[len(stack)-1]
+            stack = stack[:len(stack)-1]
+            stacked[n] = false
+            component = append(component, n)
+            if n == id {
+                break
+            }
+        }
+        if len(component) > 1 {
+            sort.Strings(component)
+            items = append(items, component)
+        }
+    }
+
+    for _, n := range g.Nodes {
+        if _, ok := order[n.Id]; !ok {
+            visit(n.Id)
+        }
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        if len(items[i]) != len(items[j]) {
+            return len(items[i]) > len(items[j])
+        }
+        return items[i][0] < items[j][0]
+    })
+
+    return items
+}
+
+// ranks counts the distinct clients (upstream) or servers (downstream)
+// of every host and returns the top hosts
+func (g *Graph) ranks(direction string, top int) []Rank {
+    seen := map[string]map[string]bool{}
+    for _, e := range g.Edges {
+        host, peer := e.Source, e.Target
+        if direction == Upstream {
+            host, peer = e.Target, e.Source
+        }
+        if seen[host] == nil {
+            seen[host] = map[string]bool{}
+        }
+        seen[host][peer] = true
+    }
+
+    items := []Rank{}
+    for host, peers := range seen {
+        items = append(items, Rank{Host: host, Count: len(peers)})
+    }
+    sort.Slice(items, func(i, j int) bool {
+        if items[i].Count != items[j].Count {
+            return items[i].Count > items[j].Count
+        }
+        return items[i].Host < items[j].Host
+    })
+
+    if len(items) > top {
+        items = items[:top]
+    }
+    return items
+}
+
+// Report writes the analysis as plain text
+func (a *Analysis) Report() string {
+    var b strings.Builder
+
+    fmt.Fprintf(&b, "hosts: %d, relations: %d\n", a.Nodes, a.Edges)
+
+    fmt.Fprintf(&b, "\narticulation points (%d):\n", len(a.Articulation))
+    for _, id := range a.Articulation {
+        fmt.Fprintf(&b, "  %s\n", id)
+    }
+
+    fmt.Fprintf(&b, "\nbridges (%d):\n", len(a.Bridges))
+    for _, item := range a.Bridges {
+        fmt.Fprintf(&b, "  %s -- %s (%s)\n", item.Hosts[0], item.Hosts[1], strings.Join(item.Edges, ", "))
+    }
+
+    fmt.Fprintf(&b, "\ncycles (%d):\n", len(a.Cycles))
+    for _, items := range a.Cycles {
+        fmt.Fprintf(&b, "  %s\n", strings.Join(items, ", "))
+    }
+
+    b.WriteString("\nfan-in:\n")
+    for _, item := range a.FanIn {
+        fmt.Fprintf(&b, "  %-30s %d\n", item.Host, item.Count)
+    }
+
+    b.WriteString("\nfan-out:\n")
+    for _, item := range a.FanOut {
+        fmt.Fprintf(&b, "  %-30s %d\n", item.Host, item.Count)
+    }
+
+    return b.String()
+}
@@ -0,0 +1,234 @@
+package graph
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+)
+
+const (
+    FormatDOT      = "dot"
+    FormatMermaid  = "mermaid"
+    FormatPlantUML = "plantuml"
+
+    ClusterService = "service"
+    ClusterSubnet  = "subnet"
+)
+
+var (
+    statusColor = map[string]string{
+        StatusDisabled: "gray",
+        StatusOk:       "green",
+        StatusSlow:     "orange",
+        StatusFailed:   "red",
+    }
+)
+
+// Render writes the graph as diagram text, cluster groups the nodes
+// by the service they provide or by the subnet of their address
+func Render(g *Graph, format, cluster string) (string, error) {
+    switch cluster {
+        case "", ClusterService, ClusterSubnet:
+        default:
+            return "", fmt.Errorf("unknown cluster: %v", cluster)
+    }
+
+    switch format {
+        case FormatDOT:
+            return g.dot(cluster), nil
+        case FormatMermaid:
+            return g.mermaid(cluster), nil
+        case FormatPlantUML:
+            return g.plantuml(cluster), nil
+    }
+
+    return "", fmt.Errorf("unknown format: %v", format)
+}
+
+// edgeLabel describes an edge by mode, ports, response time and failed result
+func edgeLabel(e Edge) string {
+    var ports []string
+    for _, port := range e.Ports {
+        ports = append(ports, fmt.Sprint(port))
+    }
+
+    label := e.Mode
+    if len(ports) > 0 {
+        label += " " + strings.Join(ports, ",")
+    }
+    if e.Response > 0 {
+        label += fmt.Sprintf(" %.0fms", e.Response * 1000)
+    }
+    if e.Result != 0 {
+        label += fmt.Sprintf(" result %d", e.Result)
+    }
+
+    return label
+}
+
+// subnet returns the /24 network of an IPv4 address or the /64 of an IPv6 one
+func subnet(ip string) string {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return ""
+    }
+    if v4 := addr.To4(); v4 != nil {
+        return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+    }
+    return (&net.IPNet{IP: addr.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// groups assigns nodes to clusters, nodes without a cluster are left out.
+// A node belongs to the first service of the edges leading to it.
+func (g *Graph) groups(cluster string) map[string]string {
+    groups := map[string]string{}
+
+    switch cluster {
+        case ClusterService:
+            for _, e := range g.Edges {
+                if len(e.Services) == 0 {
+                    continue
+                }
+                if s, ok := groups[e.Target]; !ok || e.Services[0] < s {
+                    groups[e.Target] = e.Services[0]
+                }
+            }
+        case ClusterSubnet:
+            for _, n := range g.Nodes {
+                if len(n.IPs) > 0 {
+                    if s := subnet(n.IPs[0]); s != "" {
+                        groups[n.Id] = s
+                    }
+                }
+            }
+    }
+
+    return groups
+}
+
+// clusters returns the cluster names in order with their nodes
+func (g *Graph) clusters(cluster string) ([]string, map[string][]Node) {
+    groups := g.groups(cluster)
+    members := map[string][]Node{}
+
+    for _, n := range g.Nodes {
+        members[groups[n.Id]] = append(members[groups[n.Id]], n)
+    }
+
+    var names []string
+    for name := range members {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    return names, members
+}
+
+func (g *Graph) dot(cluster string) string {
+    var b strings.Builder
+
+    b.WriteString("digraph netmap {\n")
+    b.WriteString("  rankdir=LR;\n")
+    b.WriteString("  node [shape=box];\n")
+
+    names, members := g.clusters(cluster)
+    for i, name := range names {
+        indent := "  "
+        if name != "" {
+            fmt.Fprintf(&b, "  subgraph \"cluster_%d\" {\n", i)
+            fmt.Fprintf(&b, "    label=%q;\n", name)
+            indent = "    "
+        }
+        for _, n := range members[name] {
+            fmt.Fprintf(&b, "%s%q [color=%q];\n", indent, n.Id, statusColor[n.Status])
+        }
+        if name != "" {
+            b.WriteString("  }\n")
+        }
+    }
+
+    for _, e := range g.Edges {
+        fmt.Fprintf(&b, "  %q -> %q [label=%q, color=%q];\n", e.Source, e.Target, edgeLabel(e), statusColor[e.Status])
+    }
+
+    b.WriteString("}\n")
+
+    return b.String()
+}
+
+// mermaidText escapes quotes, which end a Mermaid label
+func mermaidText(s string) string {
+    return strings.ReplaceAll(s, "\"", "#quot;")
+}
+
+func (g *Graph) mermaid(cluster string) string {
+    var b strings.Builder
+
+    // Host names may contain characters Mermaid does not allow in ids
+    ids := map[string]string{}
+    for i, n := range g.Nodes {
+        ids[n.Id] = fmt.Sprintf("n%d", i)
+    }
+
+    b.WriteString("flowchart LR\n")
+
+    names, members := g.clusters(cluster)
+    for i, name := range names {
+        indent := "  "
+        if name != "" {
+            fmt.Fprintf(&b, "  subgraph c%d [\"%s\"]\n", i, mermaidText(name))
+            indent = "    "
+        }
+        for _, n := range members[name] {
+            fmt.Fprintf(&b, "%s%s[\"%s\"]\n", indent, ids[n.Id], mermaidText(n.Name))
+        }
+        if name != "" {
+            b.WriteString("  end\n")
+        }
+    }
+
+    for _, e := range g.Edges {
+        fmt.Fprintf(&b, "  %s -->|\"%s\"| %s\n", ids[e.Source], mermaidText(edgeLabel(e)), ids[e.Target])
+    }
+    for i, e := range g.Edges {
+        fmt.Fprintf(&b, "  linkStyle %d stroke:%s\n", i, statusColor[e.Status])
+    }
+
+    return b.String()
+}
+
+func (g *Graph) plantuml(cluster string) string {
+    var b strings.Builder
+
+    ids := map[string]string{}
+    for i, n := range g.Nodes {
+        ids[n.Id] = fmt.Sprintf("n%d", i)
+    }
+
+    b.WriteString("@startuml\n")
+    b.WriteString("left to right direction\n")
+
+    names, members := g.clusters(cluster)
+    for _, name := range names {
+        indent := ""
+        if name != "" {
+            fmt.Fprintf(&b, "package %q {\n", name)
+            indent = "  "
+        }
+        for _, n := range members[name] {
+            fmt.Fprintf(&b, "%snode %q as %s #line:%s\n", indent, n.Name, ids[n.Id], statusColor[n.Status])
+        }
+        if name != "" {
+            b.WriteString("}\n")
+        }
+    }
+
+    for _, e := range g.Edges {
+        fmt.Fprintf(&b, "%s -[#%s]-> %s : %s\n", ids[e.Source], statusColor[e.Status], ids[e.Target], edgeLabel(e))
+    }
+
+    b.WriteString("@enduml\n")
+
+    return b.String()
+}
@@ -0,0 +1,297 @@
+package graph
+
+import (
+    "sort"
+    "strings"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+const (
+    StatusDisabled = "disabled"
+    StatusOk       = "ok"
+    StatusSlow     = "slow"
+    StatusFailed   = "failed"
+)
+
+var (
+    // Higher ranks are worse, the worst status of the records wins
+    statusRank = map[string]int{
+        StatusDisabled: 0,
+        StatusOk:       1,
+        StatusSlow:     2,
+        StatusFailed:   3,
+    }
+)
+
+// Node is a host, it is identified by LocalAddr.Name or RemoteAddr.Name
+type Node struct {
+    Id             string                 `json:"id"`
+    Name           string                 `json:"name"`
+    IPs            []string               `json:"ips"`
+    Accounts       []uint32               `json:"accounts"`
+    In             int                    `json:"in"`
+    Out            int                    `json:"out"`
+    Status         string                 `json:"status"`
+}
+
+// Edge aggregates the records from one host to another with the same mode
+type Edge struct {
+    Id             string                 `json:"id"`
+    Source         string                 `json:"source"`
+    Target         string                 `json:"target"`
+    Mode           string                 `json:"mode"`
+    Ports          []uint16               `json:"ports"`
+    Result         int                    `json:"result"`
+    Response       float64                `json:"response"`
+    Services       []string               `json:"services"`
+    Records        int                    `json:"records"`
+    Status         string                 `json:"status"`
+}
+
+type Graph struct {
+    Nodes          []Node                 `json:"nodes"`
+    Edges          []Edge                 `json:"edges"`
+}
+
+// Filter selects a part of the graph, an empty filter keeps everything
+type Filter struct {
+    Host           string
+    Depth          int
+    Status         []string
+}
+
+// Status returns the state of a record
+func Status(rec config.SockTable) string {
+    switch {
+        case rec.Options.Status == StatusDisabled:
+            return StatusDisabled
+        case rec.Relation.Result != 0:
+            return StatusFailed
+        case rec.Options.MaxRespTime > 0 && rec.Relation.Response >= rec.Options.MaxRespTime:
+            return StatusSlow
+    }
+    return StatusOk
+}
+
+func worse(a, b string) bool {
+    return statusRank[a] > statusRank[b]
+}
+
+func edgeId(source, target, mode string) string {
+    return source + "->" + target + ":" + mode
+}
+
+// New aggregates records into host nodes and directed edges,
+// nodes and edges are sorted by id so the output is stable
+func New(records []config.SockTable) *Graph {
+    nodes := map[string]*Node{}
+    edges := map[string]*Edge{}
+    ips := map[string]map[string]bool{}
+    accounts := map[string]map[uint32]bool{}
+    services := map[string]map[string]bool{}
+    ports := map[string]map[uint16]bool{}
+
+    node := func(addr config.SockAddr, account uint32) *Node {
+        n, ok := nodes[addr.Name]
+        if !ok {
+            n = &Node{Id: addr.Name, Name: addr.Name, IPs: []string{}, Status: StatusOk}
+            nodes[addr.Name] = n
+            ips[addr.Name] = map[string]bool{}
+            accounts[addr.Name] = map[uint32]bool{}
+        }
+        if addr.IP != nil {
+            ips[addr.Name][addr.IP.String()] = true
+        }
+        accounts[addr.Name][account] = true
+        return n
+    }
+
+    for _, rec := range records {
+        if rec.LocalAddr.Name == "" || rec.RemoteAddr.Name == "" {
+            continue
+        }
+
+        node(rec.LocalAddr, rec.Options.AccountID)
+        node(rec.RemoteAddr, rec.Options.AccountID)
+
+        id := edgeId(rec.LocalAddr.Name, rec.RemoteAddr.Name, rec.Relation.Mode)
+        e, ok := edges[id]
+        if !ok {
+            e = &Edge{
+                Id:       id,
+                Source:   rec.LocalAddr.Name,
+                Target:   rec.RemoteAddr.Name,
+                Mode:     rec.Relation.Mode,
+                Ports:    []uint16{},
+                Services: []string{},
+                Status:   StatusDisabled,
+            }
+            edges[id] = e
+            services[id] = map[string]bool{}
+            ports[id] = map[uint16]bool{}
+        }
+
+        e.Records++
+        if rec.Relation.Result > e.Result {
+            e.Result = rec.Relation.Result
+        }
+        if rec.Relation.Response > e.Response {
+            e.Response = rec.Relation.Response
+        }
+        if status := Status(rec); worse(status, e.Status) {
+            e.Status = status
+        }
+        if rec.Options.Service != "" {
+            services[id][rec.Options.Service] = true
+        }
+        if rec.Relation.Port != 0 {
+            ports[id][rec.Relation.Port] = true
+        }
+    }
+
+    g := &Graph{
+        Nodes: make([]Node, 0, len(nodes)),
+        Edges: make([]Edge, 0, len(edges)),
+    }
+
+    for id, e := range edges {
+        for port := range ports[id] {
+            e.Ports = append(e.Ports, port)
+        }
+        sort.Slice(e.Ports, func(i, j int) bool { return e.Ports[i] < e.Ports[j] })
+
+        for service := range services[id] {
+            e.Services = append(e.Services, service)
+        }
+        sort.Strings(e.Services)
+
+        g.Edges = append(g.Edges, *e)
+    }
+
+    for name, n := range nodes {
+        for ip := range ips[name] {
+            n.IPs = append(n.IPs, ip)
+        }
+        sort.Strings(n.IPs)
+
+        for account := range accounts[name] {
+            n.Accounts = append(n.Accounts, account)
+        }
+        sort.Slice(n.Accounts, func(i, j int) bool { return n.Accounts[i] < n.Accounts[j] })
+
+        g.Nodes = append(g.Nodes, *n)
+    }
+
+    g.sort()
+    g.count()
+
+    return g
+}
+
+func (g *Graph) sort() {
+    sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Id < g.Nodes[j].Id })
+    sort.Slice(g.Edges, func(i, j int) bool { return g.Edges[i].Id < g.Edges[j].Id })
+}
+
+// count sets the degrees of the nodes and their status,
+// a node takes the worst status of the edges that lead to it
+func (g *Graph) count() {
+    index := make(map[string]int, len(g.Nodes))
+    for i := range g.Nodes {
+        g.Nodes[i].In = 0
+        g.Nodes[i].Out = 0
+        g.Nodes[i].Status = StatusOk
+        index[g.Nodes[i].Id] = i
+    }
+
+    for _, e := range g.Edges {
+        if i, ok := index[e.Source]; ok {
+            g.Nodes[i].Out++
+        }
+        if i, ok := index[e.Target]; ok {
+            g.Nodes[i].In++
+            if e.Status != StatusDisabled && worse(e.Status, g.Nodes[i].Status) {
+                g.Nodes[i].Status = e.Status
+            }
+        }
+    }
+}
+
+// Filter returns the part of the graph selected by f. Edges are kept when
+// their status matches, nodes when an edge is left or when they are the host.
+// With a host only nodes within depth hops in either direction are kept.
+func (g *Graph) Filter(f Filter) *Graph {
+    status := map[string]bool{}
+    for _, s := range f.Status {
+        if s = strings.TrimSpace(s); s != "" {
+            status[s] = true
+        }
+    }
+
+    var edges []Edge
+    for _, e := range g.Edges {
+        if len(status) > 0 && !status[e.Status] {
+            continue
+        }
+        edges = append(edges, e)
+    }
+
+    keep := map[string]bool{}
+    if f.Host != "" {
+        keep = Neighbors(edges, f.Host, f.Depth)
+    } else {
+        for _, e := range edges {
+            keep[e.Source] = true
+            keep[e.Target] = true
+        }
+    }
+
+    result := &Graph{
+        Nodes: make([]Node, 0, len(keep)),
+        Edges: make([]Edge, 0, len(edges)),
+    }
+
+    for _, e := range edges {
+        if keep[e.Source] && keep[e.Target] {
+            result.Edges = append(result.Edges, e)
+        }
+    }
+
+    for _, n := range g.Nodes {
+        if keep[n.Id] {
+            result.Nodes = append(result.Nodes, n)
+        }
+    }
+
+    result.count()
+
+    return result
+}
+
+// Neighbors returns the hosts reachable from host within depth hops,
+// edges are followed in both directions, a negative depth has no limit
+func Neighbors(edges []Edge, host string, depth int) map[string]bool {
+    adj := map[string][]string{}
+    for _, e := range edges {
+        adj[e.Source] = append(adj[e.Source], e.Target)
+        adj[e.Target] = append(adj[e.Target], e.Source)
+    }
+
+    seen := map[string]bool{host: true}
+    level := []string{host}
+
+    for d := 0; len(level) > 0 && (depth < 0 || d < depth); d++ {
+        var next []string
+        for _, id := range level {
+            for _, n := range adj[id] {
+                if !seen[n] {
+                    seen[n] = true
+                    next = append(next, n)
+                }
+            }
+        }
+        level = next
+    }
+
+    return seen
+}
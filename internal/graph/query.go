@@ -0,0 +1,258 @@
+package graph
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+)
+
+const (
+    Downstream = "downstream"
+    Upstream   = "upstream"
+
+    // Limits the search of all paths between two hosts
+    pathLimit = 100
+)
+
+// Dependency is a host reached from the start of a query,
+// Path lists the hosts on a shortest way from the start to it
+type Dependency struct {
+    Host           string                 `json:"host"`
+    Depth          int                    `json:"depth"`
+    Path           []string               `json:"path"`
+}
+
+type Path struct {
+    Hosts          []string               `json:"hosts"`
+    Edges          []string               `json:"edges"`
+}
+
+// Impact is a failing relation with the hosts that depend on it,
+// the source of the relation is the first impacted host
+type Impact struct {
+    Edge           string                 `json:"edge"`
+    Source         string                 `json:"source"`
+    Target         string                 `json:"target"`
+    Ports          []uint16               `json:"ports"`
+    Impacted       []Dependency           `json:"impacted"`
+}
+
+// ParseHost splits host:port, the host may be a name or an address
+func ParseHost(s string) (string, uint16) {
+    host, port, err := net.SplitHostPort(s)
+    if err != nil {
+        return s, 0
+    }
+    p, err := strconv.ParseUint(port, 10, 16)
+    if err != nil {
+        return s, 0
+    }
+    return host, uint16(p)
+}
+
+// Resolve returns the node of a host name or address
+func (g *Graph) Resolve(host string) (string, error) {
+    for _, n := range g.Nodes {
+        if n.Id == host {
+            return n.Id, nil
+        }
+    }
+    for _, n := range g.Nodes {
+        for _, ip := range n.IPs {
+            if ip == host {
+                return n.Id, nil
+            }
+        }
+    }
+    return "", fmt.Errorf("host not found: %v", host)
+}
+
+func hasPort(e Edge, port uint16) bool {
+    if port == 0 {
+        return true
+    }
+    for _, p := range e.Ports {
+        if p == port {
+            return true
+        }
+    }
+    return false
+}
+
+// next returns the edges leaving every host in a direction,
+// downstream follows connections and upstream goes back to the clients
+func (g *Graph) next(direction string) map[string][]Edge {
+    adj := map[string][]Edge{}
+    for _, e := range g.Edges {
+        if direction == Upstream {
+            adj[e.Target] = append(adj[e.Target], e)
+        } else {
+            adj[e.Source] = append(adj[e.Source], e)
+        }
+    }
+    return adj
+}
+
+func other(e Edge, direction string) string {
+    if direction == Upstream {
+        return e.Source
+    }
+    return e.Target
+}
+
+// Dependencies returns the hosts transitively reached from host in a direction
+// within depth hops, a negative depth has no limit. A port restricts the
+// first hop to relations on that port.
+func (g *Graph) Dependencies(host string, port uint16, direction string, depth int) []Dependency {
+    adj := g.next(direction)
+
+    paths := map[string][]string{host: {host}}
+    level := []string{host}
+    items := []Dependency{}
+
+    for d := 1; len(level) > 0 && (depth < 0 || d <= depth); d++ {
+        var next []string
+        for _, id := range level {
+            for _, e := range adj[id] {
+                if d == 1 && !hasPort(e, port) {
+                    continue
+                }
+                n := other(e, direction)
+                if _, ok := paths[n]; ok {
+                    continue
+                }
+                paths[n] = append(append([]string{}, paths[id]...), n)
+                next = append(next, n)
+                items = append(items, Dependency{Host: n, Depth: d, Path: paths[n]})
+            }
+        }
+        sort.Strings(next)
+        level = next
+    }
+
+    sort.SliceStable(items, func(i, j int) bool {
+        if items[i].Depth != items[j].Depth {
+            return items[i].Depth < items[j].Depth
+        }
+        return items[i].Host < items[j].Host
+    })
+
+    return items
+}
+
+// ShortestPath returns one of the shortest paths from one host to another
+func (g *Graph) ShortestPath(from, to string, depth int) []Path {
+    adj := g.next(Downstream)
+
+    prev := map[string]Edge{}
+    seen := map[string]bool{from: true}
+    level := []string{from}
+
+    for d := 0; len(level) > 0 && !seen[to] && (depth < 0 || d < depth); d++ {
+        var next []string
+        for _, id := range level {
+            for _, e := range adj[id] {
+                if seen[e.Target] {
+                    continue
+                }
+                seen[e.Target] = true
+                prev[e.Target] = e
+                next = append(next, e.Target)
+            }
+        }
+        level = next
+    }
+
+    if !seen[to] || from == to {
+        return []Path{}
+    }
+
+    path := Path{Hosts: []string{to}}
+    for id := to; id != from; {
+        e := prev[id]
+        path.Hosts = append([]string{e.Source}, path.Hosts...)
+        path.Edges = append([]string{e.Id}, path.Edges...)
+        id = e.Source
+    }
+
+    return []Path{path}
+}
+
+// AllPaths returns the simple paths from one host to another within depth hops,
+// shorter paths first, at most pathLimit of them
+func (g *Graph) AllPaths(from, to string, depth int) []Path {
+    adj := g.next(Downstream)
+
+    var paths []Path
+    visited := map[string]bool{from: true}
+    hosts := []string{from}
+    var edges []string
+
+    var walk func(id string)
+    walk = func(id string) {
+        if len(paths) >= pathLimit {
+            return
+        }
+        if id == to {
+            paths = append(paths, Path{
+                Hosts: append([]string{}, hosts...),
+                Edges: append([]string{}, edges...),
+            })
+            return
+        }
+        if depth >= 0 && len(edges) >= depth {
+            return
+        }
+        for _, e := range adj[id] {
+            if visited[e.Target] {
+                continue
+            }
+            visited[e.Target] = true
+            hosts = append(hosts, e.Target)
+            edges = append(edges, e.Id)
+            walk(e.Target)
+            hosts = hosts[:len(hosts)-1]
+            edges = edges[:len(edges)-1]
+            visited[e.Target] = false
+        }
+    }
+
+    if from != to {
+        walk(from)
+    }
+
+    sort.SliceStable(paths, func(i, j int) bool {
+        return len(paths[i].Edges) < len(paths[j].Edges)
+    })
+
+    if paths == nil {
+        return []Path{}
+    }
+    return paths
+}
+
+// Impacts lists the failing relations, the source of a relation can not reach
+// its target and every host depending on the source within depth is impacted
+func (g *Graph) Impacts(depth int) []Impact {
+    items := []Impact{}
+
+    for _, e := range g.Edges {
+        if e.Status != StatusFailed {
+            continue
+        }
+
+        impacted := []Dependency{{Host: e.Source, Depth: 0, Path: []string{e.Source}}}
+        impacted = append(impacted, g.Dependencies(e.Source, 0, Upstream, depth)...)
+
+        items = append(items, Impact{
+            Edge:     e.Id,
+            Source:   e.Source,
+            Target:   e.Target,
+            Ports:    e.Ports,
+            Impacted: impacted,
+        })
+    }
+
+    return items
+}
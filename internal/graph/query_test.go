@@ -0,0 +1,186 @@
+package graph
+
+import (
+    "fmt"
+    "net"
+    "testing"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+var testIPs = map[string]string{"a": "10.0.0.1", "b": "10.0.0.2", "c": "10.0.0.3", "d": "10.0.0.4", "e": "10.0.0.5"}
+
+func testRecord(src, dst string, port uint16, result int) config.SockTable {
+    return config.SockTable{
+        LocalAddr:  config.SockAddr{Name: src, IP: net.ParseIP(testIPs[src])},
+        RemoteAddr: config.SockAddr{Name: dst, IP: net.ParseIP(testIPs[dst])},
+        Relation:   config.Relation{Mode: "tcp", Port: port, Result: result},
+    }
+}
+
+// a -> b -> c -> e, a -> d -> c, the relation from c to e fails
+func testGraph() *Graph {
+    return New([]config.SockTable{
+        testRecord("a", "b", 5432, 0),
+        testRecord("b", "c", 80, 0),
+        testRecord("a", "d", 443, 0),
+        testRecord("d", "c", 80, 0),
+        testRecord("c", "e", 22, 1),
+    })
+}
+
+func dependencies(items []Dependency) string {
+    var s string
+    for _, item := range items {
+        s += fmt.Sprintf("%v:%d:%v ", item.Host, item.Depth, item.Path)
+    }
+    return s
+}
+
+func paths(items []Path) string {
+    var s string
+    for _, item := range items {
+        s += fmt.Sprintf("%v%v ", item.Hosts, item.Edges)
+    }
+    return s
+}
+
+func TestParseHost(t *testing.T) {
+    tests := []struct {
+        s          string
+        host       string
+        port       uint16
+    }{
+        {"b", "b", 0},
+        {"b:80", "b", 80},
+        {"10.0.0.2:5432", "10.0.0.2", 5432},
+        {"[::1]:22", "::1", 22},
+        {"b:http", "b:http", 0},
+        {"b:70000", "b:70000", 0},
+    }
+
+    for _, tt := range tests {
+        host, port := ParseHost(tt.s)
+        if host != tt.host || port != tt.port {
+            t.Errorf("ParseHost(%q) = %q, %d, want %q, %d", tt.s, host, port, tt.host, tt.port)
+        }
+    }
+}
+
+func TestResolve(t *testing.T) {
+    g := testGraph()
+
+    tests := []struct {
+        host       string
+        want       string
+        valid      bool
+    }{
+        {"b", "b", true},
+        {"10.0.0.4", "d", true},
+        {"x", "", false},
+        {"10.0.0.9", "", false},
+    }
+
+    for _, tt := range tests {
+        got, err := g.Resolve(tt.host)
+        if (err == nil) != tt.valid || got != tt.want {
+            t.Errorf("Resolve(%q) = %q, %v, want %q, valid %v", tt.host, got, err, tt.want, tt.valid)
+        }
+    }
+}
+
+func TestDependencies(t *testing.T) {
+    g := testGraph()
+
+    tests := []struct {
+        host       string
+        port       uint16
+        direction  string
+        depth      int
+        want       string
+    }{
+        {"a", 0, Downstream, -1, "b:1:[a b] d:1:[a d] c:2:[a b c] e:3:[a b c e] "},
+        {"a", 0, Downstream, 1, "b:1:[a b] d:1:[a d] "},
+        {"a", 443, Downstream, -1, "d:1:[a d] c:2:[a d c] e:3:[a d c e] "},
+        {"a", 22, Downstream, -1, ""},
+        {"c", 0, Upstream, -1, "b:1:[c b] d:1:[c d] a:2:[c b a] "},
+        {"c", 0, Upstream, 0, ""},
+        {"e", 0, Downstream, -1, ""},
+    }
+
+    for _, tt := range tests {
+        got := dependencies(g.Dependencies(tt.host, tt.port, tt.direction, tt.depth))
+        if got != tt.want {
+            t.Errorf("Dependencies(%q, %d, %v, %d) = %q, want %q", tt.host, tt.port, tt.direction, tt.depth, got, tt.want)
+        }
+    }
+}
+
+func TestShortestPath(t *testing.T) {
+    g := testGraph()
+
+    tests := []struct {
+        from, to   string
+        depth      int
+        want       string
+    }{
+        {"a", "e", -1, "[a b c e][a->b:tcp b->c:tcp c->e:tcp] "},
+        {"a", "e", 3, "[a b c e][a->b:tcp b->c:tcp c->e:tcp] "},
+        {"a", "e", 2, ""},
+        {"d", "e", -1, "[d c e][d->c:tcp c->e:tcp] "},
+        {"e", "a", -1, ""},
+        {"a", "a", -1, ""},
+    }
+
+    for _, tt := range tests {
+        got := paths(g.ShortestPath(tt.from, tt.to, tt.depth))
+        if got != tt.want {
+            t.Errorf("ShortestPath(%q, %q, %d) = %q, want %q", tt.from, tt.to, tt.depth, got, tt.want)
+        }
+    }
+}
+
+func TestAllPaths(t *testing.T) {
+    g := testGraph()
+
+    tests := []struct {
+        from, to   string
+        depth      int
+        want       string
+    }{
+        {"a", "c", -1, "[a b c][a->b:tcp b->c:tcp] [a d c][a->d:tcp d->c:tcp] "},
+        {"a", "e", -1, "[a b c e][a->b:tcp b->c:tcp c->e:tcp] [a d c e][a->d:tcp d->c:tcp c->e:tcp] "},
+        {"a", "e", 2, ""},
+        {"c", "a", -1, ""},
+        {"a", "a", -1, ""},
+    }
+
+    for _, tt := range tests {
+        got := paths(g.AllPaths(tt.from, tt.to, tt.depth))
+        if got != tt.want {
+            t.Errorf("AllPaths(%q, %q, %d) = %q, want %q", tt.from, tt.to, tt.depth, got, tt.want)
+        }
+    }
+}
+
+func TestImpacts(t *testing.T) {
+    g := testGraph()
+
+    tests := []struct {
+        depth      int
+        want       string
+    }{
+        {-1, "c->e:tcp c e [22] c:0:[c] b:1:[c b] d:1:[c d] a:2:[c b a] "},
+        {1, "c->e:tcp c e [22] c:0:[c] b:1:[c b] d:1:[c d] "},
+        {0, "c->e:tcp c e [22] c:0:[c] "},
+    }
+
+    for _, tt := range tests {
+        var got string
+        for _, item := range g.Impacts(tt.depth) {
+            got += fmt.Sprintf("%v %v %v %v ", item.Edge, item.Source, item.Target, item.Ports) + dependencies(item.Impacted)
+        }
+        if got != tt.want {
+            t.Errorf("Impacts(%d) = %q, want %q", tt.depth, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,155 @@
+package maintenance
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    // Shortcuts of common schedules
+    descriptors = map[string]string{
+        "@yearly":   "0 0 1 1 *",
+        "@annually": "0 0 1 1 *",
+        "@monthly":  "0 0 1 * *",
+        "@weekly":   "0 0 * * 0",
+        "@daily":    "0 0 * * *",
+        "@midnight": "0 0 * * *",
+        "@hourly":   "0 * * * *",
+    }
+)
+
+// Schedule is a cron expression with the fields minute, hour, day of month,
+// month and day of week. Fields hold numbers, ranges "a-b", steps "*/n"
+// or "a-b/n" and lists of them, day of week 0 and 7 are Sunday.
+type Schedule struct {
+    minute         uint64
+    hour           uint64
+    dom            uint64
+    month          uint64
+    dow            uint64
+    // Restricted day fields, those not starting with "*",
+    // with both a day matches either of them
+    domSet         bool
+    dowSet         bool
+}
+
+type bounds struct {
+    name           string
+    min, max       int
+}
+
+var (
+    fieldBounds = []bounds{
+        {"minute", 0, 59},
+        {"hour", 0, 23},
+        {"day of month", 1, 31},
+        {"month", 1, 12},
+        {"day of week", 0, 7},
+    }
+)
+
+// ParseSchedule reads a cron expression
+func ParseSchedule(s string) (*Schedule, error) {
+    s = strings.TrimSpace(s)
+    if expr, ok := descriptors[s]; ok {
+        s = expr
+    }
+
+    parts := strings.Fields(s)
+    if len(parts) != len(fieldBounds) {
+        return nil, fmt.Errorf("invalid schedule %q: expected %d fields", s, len(fieldBounds))
+    }
+
+    var bits [5]uint64
+    for i, part := range parts {
+        b, err := parseField(part, fieldBounds[i])
+        if err != nil {
+            return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+        }
+        bits[i] = b
+    }
+
+    // Sunday is 0 and 7
+    if bits[4] & (1 << 7) != 0 {
+        bits[4] |= 1
+    }
+
+    return &Schedule{
+        minute: bits[0],
+        hour:   bits[1],
+        dom:    bits[2],
+        month:  bits[3],
+        dow:    bits[4],
+        domSet: !strings.HasPrefix(parts[2], "*"),
+        dowSet: !strings.HasPrefix(parts[4], "*"),
+    }, nil
+}
+
+func parseField(s string, b bounds) (uint64, error) {
+    var bits uint64
+
+    for _, item := range strings.Split(s, ",") {
+        step := 1
+        if i := strings.Index(item, "/"); i >= 0 {
+            n, err := strconv.Atoi(item[i+1:])
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step in %v: %q", b.name, item)
+            }
+            step = n
+            item = item[:i]
+        }
+
+        lo, hi := b.min, b.max
+        switch {
+            case item == "*":
+            case strings.Contains(item, "-"):
+                r := strings.SplitN(item, "-", 2)
+                var err error
+                if lo, err = strconv.Atoi(r[0]); err != nil {
+                    return 0, fmt.Errorf("invalid %v: %q", b.name, item)
+                }
+                if hi, err = strconv.Atoi(r[1]); err != nil {
+                    return 0, fmt.Errorf("invalid %v: %q", b.name, item)
+                }
+            default:
+                n, err := strconv.Atoi(item)
+                if err != nil {
+                    return 0, fmt.Errorf("invalid %v: %q", b.name, item)
+                }
+                lo, hi = n, n
+                // "a/n" runs from a to the end of the range
+                if step > 1 {
+                    hi = b.max
+                }
+        }
+
+        if lo < b.min || hi > b.max || lo > hi {
+            return 0, fmt.Errorf("%v out of range %d-%d: %q", b.name, b.min, b.max, item)
+        }
+
+        for n := lo; n <= hi; n += step {
+            bits |= 1 << uint(n)
+        }
+    }
+
+    return bits, nil
+}
+
+// Match reports whether the schedule starts at the minute of t
+func (s *Schedule) Match(t time.Time) bool {
+    if s.minute & (1 << uint(t.Minute())) == 0 ||
+        s.hour & (1 << uint(t.Hour())) == 0 ||
+        s.month & (1 << uint(t.Month())) == 0 {
+        return false
+    }
+
+    dom := s.dom & (1 << uint(t.Day())) != 0
+    dow := s.dow & (1 << uint(t.Weekday())) != 0
+
+    if s.domSet && s.dowSet {
+        return dom || dow
+    }
+    return dom && dow
+}
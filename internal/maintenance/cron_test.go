@@ -0,0 +1,87 @@
+package maintenance
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseSchedule(t *testing.T) {
+    tests := []struct {
+        expr       string
+        valid      bool
+    }{
+        {"* * * * *", true},
+        {"*/15 9-17 * * 1-5", true},
+        {"0 0 1,15 * *", true},
+        {"5/20 * * * *", true},
+        {"0 0 * * 7", true},
+        {"@daily", true},
+        {" @hourly ", true},
+        {"* * * *", false},
+        {"* * * * * *", false},
+        {"60 * * * *", false},
+        {"* 24 * * *", false},
+        {"* * 0 * *", false},
+        {"* * * 13 *", false},
+        {"* * * * 8", false},
+        {"*/0 * * * *", false},
+        {"5-1 * * * *", false},
+        {"a * * * *", false},
+        {"@never", false},
+    }
+
+    for _, tt := range tests {
+        _, err := ParseSchedule(tt.expr)
+        if (err == nil) != tt.valid {
+            t.Errorf("ParseSchedule(%q) error = %v, want valid %v", tt.expr, err, tt.valid)
+        }
+    }
+}
+
+func TestScheduleMatch(t *testing.T) {
+    at := func(s string) time.Time {
+        tm, err := time.Parse("2006-01-02 15:04", s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return tm
+    }
+
+    tests := []struct {
+        expr       string
+        time       string
+        match      bool
+    }{
+        {"*/15 * * * *", "2026-10-01 10:30", true},
+        {"*/15 * * * *", "2026-10-01 10:31", false},
+        {"5/20 * * * *", "2026-10-01 10:45", true},
+        {"5/20 * * * *", "2026-10-01 10:00", false},
+        {"0 9 * * 1-5", "2026-10-05 09:00", true},
+        {"0 9 * * 1-5", "2026-10-04 09:00", false},
+        {"0 0 * * 7", "2026-10-04 00:00", true},
+        {"0 0 * * 0", "2026-10-11 00:00", true},
+        {"@daily", "2026-10-07 00:00", true},
+        {"@daily", "2026-10-07 00:01", false},
+        {"0 0 1 1 *", "2026-10-01 00:00", false},
+        // Both day fields restricted, either of them matches
+        {"0 0 1 * 0", "2026-10-01 00:00", true},
+        {"0 0 1 * 0", "2026-10-04 00:00", true},
+        {"0 0 1 * 0", "2026-10-05 00:00", false},
+        // A step over "*" does not restrict the day, both have to match
+        {"0 0 */2 * 1", "2026-10-05 00:00", true},
+        {"0 0 */2 * 1", "2026-10-07 00:00", false},
+        {"0 0 */2 * 1", "2026-10-12 00:00", false},
+        {"0 0 1 * */2", "2027-02-01 00:00", false},
+        {"0 0 1 * */2", "2026-11-01 00:00", true},
+    }
+
+    for _, tt := range tests {
+        s, err := ParseSchedule(tt.expr)
+        if err != nil {
+            t.Fatalf("ParseSchedule(%q): %v", tt.expr, err)
+        }
+        if got := s.Match(at(tt.time)); got != tt.match {
+            t.Errorf("%q.Match(%v) = %v, want %v", tt.expr, tt.time, got, tt.match)
+        }
+    }
+}
@@ -0,0 +1,188 @@
+// Package maintenance decides which records are in a maintenance window
+// and whether their checks or notifications are suppressed.
+package maintenance
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "strconv"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+const (
+    SuppressChecks        = "checks"
+    SuppressNotifications = "notifications"
+    SuppressAll           = "all"
+
+    // Longest recurring window, running ones are searched back this far
+    maxDuration = 7 * 24 * time.Hour
+)
+
+// Window is a validated maintenance window
+type Window struct {
+    config.Maintenance
+    schedule       *Schedule
+    duration       time.Duration
+    location       *time.Location
+    hosts          map[string]bool
+    ports          map[uint16]bool
+    accounts       map[uint32]bool
+}
+
+// Compile checks a maintenance window, Suppress defaults to all.
+// Start and End of a recurring window limit the period it repeats in.
+func Compile(m config.Maintenance) (*Window, error) {
+    if m.Suppress == "" {
+        m.Suppress = SuppressAll
+    }
+    switch m.Suppress {
+        case SuppressChecks, SuppressNotifications, SuppressAll:
+        default:
+            return nil, fmt.Errorf("invalid suppress: %v", m.Suppress)
+    }
+
+    // A window without targets would silence everything
+    if len(m.Hosts) == 0 && len(m.Ports) == 0 && len(m.Accounts) == 0 && len(m.Labels) == 0 {
+        return nil, fmt.Errorf("parameter missing hosts, ports, accounts or labels")
+    }
+
+    w := &Window{Maintenance: m, location: time.UTC}
+
+    if m.Schedule == "" {
+        if m.End <= m.Start {
+            return nil, fmt.Errorf("invalid window: end must be after start")
+        }
+    } else {
+        schedule, err := ParseSchedule(m.Schedule)
+        if err != nil {
+            return nil, err
+        }
+        duration, err := time.ParseDuration(m.Duration)
+        if err != nil || duration < time.Minute || duration > maxDuration {
+            return nil, fmt.Errorf("invalid duration: %q, from 1m to %v", m.Duration, maxDuration)
+        }
+        if m.End != 0 && m.End <= m.Start {
+            return nil, fmt.Errorf("invalid window: end must be after start")
+        }
+        if m.Timezone != "" {
+            location, err := time.LoadLocation(m.Timezone)
+            if err != nil {
+                return nil, fmt.Errorf("invalid timezone: %v", m.Timezone)
+            }
+            w.location = location
+        }
+        w.schedule = schedule
+        w.duration = duration
+    }
+
+    w.hosts = map[string]bool{}
+    for _, host := range m.Hosts {
+        w.hosts[host] = true
+    }
+    w.ports = map[uint16]bool{}
+    for _, port := range m.Ports {
+        w.ports[port] = true
+    }
+    w.accounts = map[uint32]bool{}
+    for _, account := range m.Accounts {
+        w.accounts[account] = true
+    }
+
+    return w, nil
+}
+
+// Active returns the end of the running occurrence when the window is in effect at now
+func (w *Window) Active(now time.Time) (int64, bool) {
+    unix := now.Unix()
+
+    if w.schedule == nil {
+        return w.End, w.Start <= unix && unix < w.End
+    }
+
+    if unix < w.Start || (w.End != 0 && unix >= w.End) {
+        return 0, false
+    }
+
+    // The latest start within the duration ends last
+    for start := now.In(w.location).Truncate(time.Minute); now.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+        if !w.schedule.Match(start) {
+            continue
+        }
+        end := start.Add(w.duration).Unix()
+        if w.End != 0 && end > w.End {
+            end = w.End
+        }
+        return end, true
+    }
+
+    return 0, false
+}
+
+func (w *Window) host(addr config.SockAddr) bool {
+    if w.hosts[addr.Name] {
+        return true
+    }
+    return addr.IP != nil && w.hosts[addr.IP.String()]
+}
+
+// Match reports whether the window targets the record, hosts are the names
+// or addresses of either end of the relation
+func (w *Window) Match(rec config.SockTable) bool {
+    if len(w.hosts) > 0 && !w.host(rec.LocalAddr) && !w.host(rec.RemoteAddr) {
+        return false
+    }
+    if len(w.ports) > 0 && !w.ports[rec.Relation.Port] {
+        return false
+    }
+    if len(w.accounts) > 0 && !w.accounts[rec.Options.AccountID] {
+        return false
+    }
+    for name, value := range w.Labels {
+        if rec.Labels[name] != value {
+            return false
+        }
+    }
+    return true
+}
+
+// Suppresses reports whether the window suppresses checks or notifications
+func (w *Window) Suppresses(kind string) bool {
+    return w.Suppress == SuppressAll || w.Suppress == kind
+}
+
+// Entry describes the window in effect for a record
+func (w *Window) Entry(end int64) config.ActiveMaintenance {
+    return config.ActiveMaintenance{Id: w.Id, Name: w.Name, Suppress: w.Suppress, End: end}
+}
+
+// FromLabels rebuilds the targeted parts of a record from the labels of an
+// alert, all the labels are matched against the label targets
+func FromLabels(labels map[string]string) config.SockTable {
+    rec := config.SockTable{Labels: labels}
+
+    rec.LocalAddr.Name = labels["src_name"]
+    rec.LocalAddr.IP = net.ParseIP(labels["src_ip"])
+    rec.RemoteAddr.Name = labels["dst_name"]
+    rec.RemoteAddr.IP = net.ParseIP(labels["dst_ip"])
+    rec.Relation.Mode = labels["mode"]
+
+    if port, err := strconv.ParseUint(labels["port"], 10, 16); err == nil {
+        rec.Relation.Port = uint16(port)
+    }
+    if account, err := strconv.ParseUint(labels["account_id"], 10, 32); err == nil {
+        rec.Options.AccountID = uint32(account)
+    }
+
+    return rec
+}
+
+// Suppressed reports whether any of the windows suppresses the kind for the record
+func Suppressed(items []config.ActiveMaintenance, kind string) bool {
+    for _, item := range items {
+        if item.Suppress == SuppressAll || item.Suppress == kind {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,233 @@
+package watch
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+    "strconv"
+    "strings"
+    "github.com/ltkh/netmap/internal/config"
+)
+
+const (
+    EventCreate = "create"
+    EventUpdate = "update"
+    EventDelete = "delete"
+    EventStatus = "status"
+
+    // Events a watcher may fall behind before it is dropped
+    watcherBuffer = 1024
+)
+
+var (
+    ErrCompacted = errors.New("revision is no longer available")
+    ErrStream    = errors.New("revision belongs to another node or to an earlier start of this node")
+)
+
+// Event is a change of a record applied on this node, Transition is set
+// when the update changed Relation.Result. Cursor is the stream and the
+// revision of the event, watchers resume from it.
+type Event struct {
+    Revision       uint64                 `json:"revision"`
+    Cursor         string                 `json:"cursor"`
+    Type           string                 `json:"type"`
+    Timestamp      int64                  `json:"timestamp"`
+    Record         config.SockTable       `json:"record"`
+    Transition     *config.StatusEvent    `json:"transition,omitempty"`
+}
+
+// Filter selects the events sent to a watcher, an empty filter keeps everything
+type Filter struct {
+    AccountID      string
+    SrcName        string
+    ResultOnly     bool
+}
+
+func (f Filter) Match(e Event) bool {
+    if f.AccountID != "" && f.AccountID != fmt.Sprint(e.Record.Options.AccountID) {
+        return false
+    }
+    if f.SrcName != "" && f.SrcName != e.Record.LocalAddr.Name {
+        return false
+    }
+    if f.ResultOnly && e.Transition == nil {
+        return false
+    }
+    return true
+}
+
+type Watcher struct {
+    Events         chan Event
+    filter         Filter
+    closed         bool
+}
+
+// Hub numbers the events of a node and keeps the last of them,
+// so that a watcher reconnecting with its cursor gets what it missed.
+// Revisions start from 1 when the node starts, so they only mean something
+// within the stream, which names the node and the time it started.
+type Hub struct {
+    sync.RWMutex
+    stream         string
+    revision       uint64
+    events         []Event
+    size           int
+    watchers       map[*Watcher]bool
+}
+
+func NewHub(size int) *Hub {
+    return &Hub{
+        stream:   epoch(),
+        size:     size,
+        watchers: make(map[*Watcher]bool),
+    }
+}
+
+func epoch() string {
+    return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Open names the stream after the node, events published before are dropped
+func (h *Hub) Open(node string) {
+    h.Lock()
+    defer h.Unlock()
+
+    h.stream = node + "." + epoch()
+    h.revision = 0
+    h.events = nil
+}
+
+// Cursor returns the cursor of the last event
+func (h *Hub) Cursor() string {
+    h.RLock()
+    defer h.RUnlock()
+
+    return FormatCursor(h.stream, h.revision)
+}
+
+// FormatCursor joins the stream and the revision as "stream:revision"
+func FormatCursor(stream string, revision uint64) string {
+    return stream + ":" + strconv.FormatUint(revision, 10)
+}
+
+// ParseCursor splits a cursor into the stream and the revision
+func ParseCursor(s string) (string, uint64, error) {
+    i := strings.LastIndex(s, ":")
+    if i <= 0 {
+        return "", 0, fmt.Errorf("invalid cursor: %q", s)
+    }
+    revision, err := strconv.ParseUint(s[i+1:], 10, 64)
+    if err != nil {
+        return "", 0, fmt.Errorf("invalid cursor: %q", s)
+    }
+    return s[:i], revision, nil
+}
+
+// Publish numbers the events and sends them to the watchers,
+// a watcher that can not keep up is closed
+func (h *Hub) Publish(events []Event) {
+    if len(events) == 0 {
+        return
+    }
+
+    h.Lock()
+    defer h.Unlock()
+
+    timestamp := time.Now().UTC().Unix()
+
+    for _, e := range events {
+        h.revision++
+        e.Revision = h.revision
+        e.Cursor = FormatCursor(h.stream, h.revision)
+        if e.Timestamp == 0 {
+            e.Timestamp = timestamp
+        }
+
+        h.events = append(h.events, e)
+
+        for w := range h.watchers {
+            if !w.filter.Match(e) {
+                continue
+            }
+            select {
+                case w.Events <- e:
+                default:
+                    h.close(w)
+            }
+        }
+    }
+
+    if len(h.events) > h.size {
+        h.events = append([]Event{}, h.events[len(h.events)-h.size:]...)
+    }
+}
+
+// Subscribe registers a watcher and returns the kept events after the cursor,
+// an empty cursor starts with the next event
+func (h *Hub) Subscribe(cursor string, filter Filter) (*Watcher, []Event, error) {
+    var stream string
+    var revision uint64
+
+    if cursor != "" {
+        var err error
+        if stream, revision, err = ParseCursor(cursor); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    h.Lock()
+    defer h.Unlock()
+
+    var backlog []Event
+
+    if cursor != "" {
+        if stream != h.stream {
+            return nil, nil, ErrStream
+        }
+        if revision > h.revision {
+            return nil, nil, ErrCompacted
+        }
+        if revision < h.revision && (len(h.events) == 0 || h.events[0].Revision > revision+1) {
+            return nil, nil, ErrCompacted
+        }
+        for _, e := range h.events {
+            if e.Revision > revision && filter.Match(e) {
+                backlog = append(backlog, e)
+            }
+        }
+    }
+
+    w := &Watcher{
+        Events: make(chan Event, watcherBuffer),
+        filter: filter,
+    }
+    h.watchers[w] = true
+
+    return w, backlog, nil
+}
+
+// Unsubscribe removes a watcher and closes its channel
+func (h *Hub) Unsubscribe(w *Watcher) {
+    h.Lock()
+    defer h.Unlock()
+
+    h.close(w)
+}
+
+func (h *Hub) close(w *Watcher) {
+    if w.closed {
+        return
+    }
+    w.closed = true
+    delete(h.watchers, w)
+    close(w.Events)
+}
+
+// Watchers returns the number of connected watchers
+func (h *Hub) Watchers() int {
+    h.RLock()
+    defer h.RUnlock()
+
+    return len(h.watchers)
+}